@@ -0,0 +1,219 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/utils"
+)
+
+const (
+	defaultMaxIterations = 5
+	defaultMaxBytes      = 32 << 10
+)
+
+// stoppedNotice ends the answer of a big model still calling tools after the last round
+const stoppedNotice = "\n\n... stopped, the tool call limit is reached"
+
+// Tool a read-only tool the big model can call during the diagnosis
+type Tool interface {
+	Spec() *bigmodel.Tool
+	// Call run the tool with the JSON arguments of the big model and return its output
+	Call(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+// Agent big model that serves the tool calls of the wrapped big model locally until it answers
+type Agent struct {
+	bigmodel.BigModel
+
+	tools         map[string]Tool
+	specs         []*bigmodel.Tool
+	maxIterations int
+	maxBytes      int
+}
+
+// New wrap the big model with the builtin tools, big models without tool support answer as they are
+func New(bm bigmodel.BigModel, opts ...Option) bigmodel.BigModel {
+	a := &Agent{
+		BigModel:      bm,
+		tools:         make(map[string]Tool),
+		maxIterations: defaultMaxIterations,
+		maxBytes:      defaultMaxBytes,
+	}
+	a.add(Builtins()...)
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+type Option func(*Agent)
+
+// WithTools add tools to the builtin ones, a tool replaces the one of the same name
+func WithTools(tools ...Tool) Option {
+	return func(a *Agent) {
+		a.add(tools...)
+	}
+}
+
+// WithMaxIterations specify how many rounds of tool calls are served before the big model has to answer
+func WithMaxIterations(n int) Option {
+	return func(a *Agent) {
+		a.maxIterations = n
+	}
+}
+
+// WithMaxBytes specify the most bytes of tool output sent to the big model for an answer
+func WithMaxBytes(n int) Option {
+	return func(a *Agent) {
+		a.maxBytes = n
+	}
+}
+
+func (a *Agent) add(tools ...Tool) {
+	for _, tool := range tools {
+		spec := tool.Spec()
+		if _, ok := a.tools[spec.Name]; ok {
+			for i, s := range a.specs {
+				if s.Name == spec.Name {
+					a.specs = append(a.specs[:i], a.specs[i+1:]...)
+					break
+				}
+			}
+		}
+		a.tools[spec.Name] = tool
+		a.specs = append(a.specs, spec)
+	}
+}
+
+func (a *Agent) Chat(messages []*bigmodel.Message) chan bigmodel.Result {
+	return a.ChatContext(context.Background(), messages)
+}
+
+// ChatContext chat until the big model answers without tool calls. The served calls are sent
+// as TypeToolCall results with the tool output as Content, so that they can be shown.
+func (a *Agent) ChatContext(ctx context.Context, messages []*bigmodel.Message) chan bigmodel.Result {
+	out := make(chan bigmodel.Result)
+
+	go func() {
+		defer close(out)
+		messages := messages[:len(messages):len(messages)]
+		remaining := a.maxBytes
+		for i := 0; ; i++ {
+			// the last round offers no tools so that the big model has to answer
+			tools := a.specs
+			if i >= a.maxIterations || remaining == 0 {
+				tools = nil
+			}
+
+			var calls []*bigmodel.ToolCall
+			var answer strings.Builder
+			in := bigmodel.ChatTools(ctx, a.BigModel, messages, tools)
+			for res := range in {
+				switch res.Type {
+				case bigmodel.TypeToolCall:
+					calls = append(calls, res.ToolCalls...)
+					continue
+				case bigmodel.TypeDone:
+					if len(calls) > 0 {
+						continue
+					}
+				case bigmodel.TypeData:
+					answer.WriteString(res.Content)
+				}
+				if !bigmodel.Send(ctx, out, res) {
+					go bigmodel.Drain(in)
+					return
+				}
+			}
+			if len(calls) == 0 {
+				return
+			}
+			// the big model keeps calling the tools it is no longer offered
+			if tools == nil {
+				if bigmodel.Send(ctx, out, bigmodel.Result{Type: bigmodel.TypeData, Content: stoppedNotice}) {
+					bigmodel.Send(ctx, out, bigmodel.Result{Type: bigmodel.TypeDone})
+				}
+				return
+			}
+
+			messages = append(messages, &bigmodel.Message{
+				Role:      bigmodel.RoleAssistant,
+				Content:   answer.String(),
+				ToolCalls: calls,
+			})
+			for _, call := range calls {
+				output := a.call(ctx, call)
+				if ctx.Err() != nil {
+					return
+				}
+				truncated := len(output) > remaining
+				if truncated {
+					output = utils.Truncate(output, remaining)
+				}
+				// the notice does not count against the limit
+				remaining -= len(output)
+				if truncated {
+					output += "\n... truncated, the tool output limit is reached"
+				}
+				messages = append(messages, bigmodel.ToolMessage(call.ID, output))
+				if !bigmodel.Send(ctx, out, bigmodel.Result{
+					Type:      bigmodel.TypeToolCall,
+					Content:   output,
+					ToolCalls: []*bigmodel.ToolCall{call},
+				}) {
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// call run the tool, errors are reported to the big model as the output
+func (a *Agent) call(ctx context.Context, call *bigmodel.ToolCall) string {
+	tool, ok := a.tools[call.Name]
+	if !ok {
+		return fmt.Sprintf("error: unknown tool %s", call.Name)
+	}
+	args := json.RawMessage(call.Arguments)
+	if len(strings.TrimSpace(call.Arguments)) == 0 {
+		args = json.RawMessage("{}")
+	}
+	output, err := tool.Call(ctx, args)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return output
+}
+
+func (a *Agent) ContextWindow() int {
+	return bigmodel.ContextWindow(a.BigModel)
+}
+
+func (a *Agent) Embed(ctx context.Context, texts []string) (*bigmodel.Embeddings, error) {
+	return bigmodel.Embed(ctx, a.BigModel, texts)
+}
@@ -0,0 +1,195 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ahaostudy/code-diagnostic/agent"
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/bigmodel/bigmodeltest"
+)
+
+// echo a tool answering with its text argument
+var echo = agent.NewTool(&bigmodel.Tool{
+	Name:       "echo",
+	Parameters: map[string]interface{}{"type": "object"},
+}, func(_ context.Context, raw json.RawMessage) (string, error) {
+	args := new(struct {
+		Text string `json:"text"`
+	})
+	err := json.Unmarshal(raw, args)
+	return args.Text, err
+})
+
+func call(id, name, text string) *bigmodel.ToolCall {
+	args, _ := json.Marshal(map[string]string{"text": text})
+	return &bigmodel.ToolCall{ID: id, Name: name, Arguments: string(args)}
+}
+
+// chat the answer and the served tool calls of the agent, and whether it finished with TypeDone
+func chat(t *testing.T, ctx context.Context, bm bigmodel.BigModel) (answer string, served []bigmodel.Result, done bool) {
+	t.Helper()
+	for res := range bigmodel.ChatContext(ctx, bm, bigmodel.Messages(bigmodel.UserMessage("why?"))) {
+		switch res.Type {
+		case bigmodel.TypeData:
+			answer += res.Content
+		case bigmodel.TypeToolCall:
+			served = append(served, res)
+		case bigmodel.TypeDone:
+			done = true
+		case bigmodel.TypeError:
+			t.Fatalf("unexpected error: %v", res.Err)
+		}
+	}
+	return answer, served, done
+}
+
+// toolMessages the tool results sent in the request
+func toolMessages(req *bigmodeltest.Request) []*bigmodel.Message {
+	var msgs []*bigmodel.Message
+	for _, msg := range req.Messages {
+		if msg.Role == bigmodel.RoleTool {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+func TestAgentServesToolCalls(t *testing.T) {
+	srv := bigmodeltest.NewServer(
+		bigmodeltest.CallTools(call("c1", "echo", "first"), call("c2", "echo", "second")),
+		bigmodeltest.Reply("the ", "answer"),
+	)
+	defer srv.Close()
+
+	answer, served, done := chat(t, context.Background(), agent.New(srv.ChatGPT(), agent.WithTools(echo)))
+	if answer != "the answer" || !done {
+		t.Fatalf("got answer %q, done %v", answer, done)
+	}
+	if len(served) != 2 || served[0].Content != "first" || served[1].ToolCalls[0].ID != "c2" {
+		t.Fatalf("got served calls %+v", served)
+	}
+
+	reqs := srv.AssertRequests(t, 2)
+	if len(reqs[0].Tools) != len(agent.Builtins())+1 {
+		t.Errorf("got %d tools offered, want the builtins and echo", len(reqs[0].Tools))
+	}
+	reqs[1].AssertMessage(t, 1, bigmodel.RoleAssistant, "")
+	if calls := reqs[1].Messages[1].ToolCalls; len(calls) != 2 || calls[0].Name != "echo" {
+		t.Errorf("got the assistant tool calls %+v", calls)
+	}
+	results := toolMessages(reqs[1])
+	if len(results) != 2 || results[0].ToolCallID != "c1" || results[1].Content != "second" {
+		t.Errorf("got the tool results %+v", results)
+	}
+}
+
+func TestAgentUnknownTool(t *testing.T) {
+	srv := bigmodeltest.NewServer(
+		bigmodeltest.CallTools(call("c1", "rm_rf", "/")),
+		bigmodeltest.Reply("ok"),
+	)
+	defer srv.Close()
+
+	answer, _, done := chat(t, context.Background(), agent.New(srv.ChatGPT()))
+	if answer != "ok" || !done {
+		t.Fatalf("got answer %q, done %v", answer, done)
+	}
+	results := toolMessages(srv.AssertRequests(t, 2)[1])
+	if len(results) != 1 || results[0].Content != "error: unknown tool rm_rf" {
+		t.Errorf("got the tool results %+v", results)
+	}
+}
+
+func TestAgentMaxIterations(t *testing.T) {
+	// the big model keeps calling tools after it is no longer offered any
+	srv := bigmodeltest.NewServer(
+		bigmodeltest.CallTools(call("c1", "echo", "first")),
+		bigmodeltest.CallTools(call("c2", "echo", "second")),
+		bigmodeltest.Reply("unused"),
+	)
+	defer srv.Close()
+
+	answer, served, done := chat(t, context.Background(), agent.New(srv.ChatGPT(), agent.WithTools(echo), agent.WithMaxIterations(1)))
+	if !strings.Contains(answer, "tool call limit") || !done {
+		t.Fatalf("got answer %q, done %v, want the limit notice", answer, done)
+	}
+	if len(served) != 1 {
+		t.Errorf("got %d served calls, want only the first round", len(served))
+	}
+	reqs := srv.AssertRequests(t, 2)
+	if len(reqs[0].Tools) == 0 || len(reqs[1].Tools) != 0 {
+		t.Errorf("got %d and %d tools offered, want none in the last round", len(reqs[0].Tools), len(reqs[1].Tools))
+	}
+}
+
+func TestAgentMaxBytes(t *testing.T) {
+	srv := bigmodeltest.NewServer(
+		bigmodeltest.CallTools(call("c1", "echo", "héllo"), call("c2", "echo", "world")),
+		bigmodeltest.Reply("ok"),
+	)
+	defer srv.Close()
+
+	// the limit falls in the middle of é, the byte left goes to the second call
+	_, _, done := chat(t, context.Background(), agent.New(srv.ChatGPT(), agent.WithTools(echo), agent.WithMaxBytes(2)))
+	if !done {
+		t.Fatal("the chat did not finish")
+	}
+	reqs := srv.AssertRequests(t, 2)
+	results := toolMessages(reqs[1])
+	if len(results) != 2 || !strings.HasPrefix(results[0].Content, "h\n") || !strings.HasPrefix(results[1].Content, "w\n") {
+		t.Errorf("got the tool results %+v, want them cut to the limit on a rune boundary", results)
+	}
+	for _, r := range results {
+		if !strings.Contains(r.Content, "truncated") {
+			t.Errorf("tool result %q has no truncation notice", r.Content)
+		}
+	}
+	// the budget is spent, the big model has to answer
+	if len(reqs[1].Tools) != 0 {
+		t.Errorf("got %d tools offered after the limit", len(reqs[1].Tools))
+	}
+}
+
+func TestAgentCanceledWhileServing(t *testing.T) {
+	srv := bigmodeltest.NewServer(
+		bigmodeltest.CallTools(call("c1", "block", "")),
+		bigmodeltest.Reply("unused"),
+	)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	block := agent.NewTool(&bigmodel.Tool{Name: "block"}, func(ctx context.Context, _ json.RawMessage) (string, error) {
+		cancel()
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+
+	_, served, done := chat(t, ctx, agent.New(srv.ChatGPT(), agent.WithTools(block)))
+	if done || len(served) != 0 {
+		t.Errorf("got done %v and %d served calls after the cancel", done, len(served))
+	}
+	srv.AssertRequests(t, 1)
+}
@@ -0,0 +1,313 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/history"
+	"github.com/ahaostudy/code-diagnostic/parse"
+)
+
+const (
+	// maxFileLines the most lines read_file returns at once
+	maxFileLines = 200
+	// maxResults the most declarations or callers listed
+	maxResults = 30
+	// maxLogCommits the most commits git_log lists
+	maxLogCommits = 10
+)
+
+type funcTool struct {
+	spec *bigmodel.Tool
+	call func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+// NewTool create a tool from its spec and function
+func NewTool(spec *bigmodel.Tool, call func(ctx context.Context, args json.RawMessage) (string, error)) Tool {
+	return &funcTool{spec: spec, call: call}
+}
+
+func (t *funcTool) Spec() *bigmodel.Tool {
+	return t.spec
+}
+
+func (t *funcTool) Call(ctx context.Context, args json.RawMessage) (string, error) {
+	return t.call(ctx, args)
+}
+
+// Builtins the read-only tools over the source of the project and its git history
+func Builtins() []Tool {
+	return []Tool{
+		NewTool(&bigmodel.Tool{
+			Name:        "read_function",
+			Description: "Read the source of a function or method of the project, such as Div, T.Method or (*T).Method.",
+			Parameters: object(map[string]interface{}{
+				"function": str("the name of the function"),
+				"file":     str("the file of the function, optional if the name is unique"),
+			}, "function"),
+		}, readFunction),
+		NewTool(&bigmodel.Tool{
+			Name:        "read_file",
+			Description: fmt.Sprintf("Read a range of lines of a source file of the project, at most %d lines at once.", maxFileLines),
+			Parameters: object(map[string]interface{}{
+				"file":       str("the path of the file, or the end of it such as pkg/file.go"),
+				"start_line": integer("the first line, starting at 1"),
+				"end_line":   integer("the last line"),
+			}, "file", "start_line", "end_line"),
+		}, readFile),
+		NewTool(&bigmodel.Tool{
+			Name:        "search_identifier",
+			Description: "Find the declarations of a type, function, method, variable or constant of the project by its name.",
+			Parameters: object(map[string]interface{}{
+				"name": str("the identifier, such as Config or T.Method"),
+			}, "name"),
+		}, searchIdentifier),
+		NewTool(&bigmodel.Tool{
+			Name:        "list_callers",
+			Description: "List the calls of a function or method in the project. Calls are matched by name, so calls of other functions with the same name are listed too.",
+			Parameters: object(map[string]interface{}{
+				"function": str("the name of the function"),
+			}, "function"),
+		}, listCallers),
+		NewTool(&bigmodel.Tool{
+			Name:        "git_log",
+			Description: fmt.Sprintf("List the last %d commits changing a file of the project, or only a function of it.", maxLogCommits),
+			Parameters: object(map[string]interface{}{
+				"file":     str("the path of the file, or the end of it such as pkg/file.go"),
+				"function": str("the name of a function of the file, optional"),
+			}, "file"),
+		}, gitLog),
+	}
+}
+
+func object(properties map[string]interface{}, required ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+func str(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "description": description}
+}
+
+func integer(description string) map[string]interface{} {
+	return map[string]interface{}{"type": "integer", "description": description}
+}
+
+func readFunction(_ context.Context, raw json.RawMessage) (string, error) {
+	args := new(struct {
+		Function string `json:"function"`
+		File     string `json:"file"`
+	})
+	if err := json.Unmarshal(raw, args); err != nil {
+		return "", err
+	}
+	name := args.Function
+	// drop the package path, such as github.com/x/y/math.Div
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var file string
+	if args.File != "" {
+		f, err := parse.ResolveFile(args.File)
+		if err != nil {
+			return "", err
+		}
+		file = f
+	}
+	decls, err := findFunctions(name, file)
+	if err != nil {
+		return "", err
+	}
+	if len(decls) == 0 && strings.Contains(name, ".") {
+		// the name may start with the package, such as math.Div
+		decls, err = findFunctions(name[strings.Index(name, ".")+1:], file)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(decls) == 0 {
+		return "", fmt.Errorf("function %s not found", args.Function)
+	}
+	return formatDeclarations(decls), nil
+}
+
+func findFunctions(name, file string) ([]*parse.Declaration, error) {
+	decls, err := parse.FindDeclarations(name)
+	if err != nil {
+		return nil, err
+	}
+	var funcs []*parse.Declaration
+	for _, d := range decls {
+		if (d.Kind == "func" || d.Kind == "method") && (file == "" || d.File == file) {
+			funcs = append(funcs, d)
+		}
+	}
+	return funcs, nil
+}
+
+func readFile(_ context.Context, raw json.RawMessage) (string, error) {
+	args := new(struct {
+		File      string `json:"file"`
+		StartLine int    `json:"start_line"`
+		EndLine   int    `json:"end_line"`
+	})
+	if err := json.Unmarshal(raw, args); err != nil {
+		return "", err
+	}
+	file, err := parse.ResolveFile(args.File)
+	if err != nil {
+		return "", err
+	}
+	source, err := parse.ReadSourceFile(file)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(string(source), "\n")
+	start, end := args.StartLine, args.EndLine
+	if start < 1 {
+		start = 1
+	}
+	if end > len(lines) {
+		end = len(lines)
+	}
+	if end < start {
+		return "", fmt.Errorf("invalid line range %d-%d, the file has %d lines", args.StartLine, args.EndLine, len(lines))
+	}
+	truncated := false
+	if end-start+1 > maxFileLines {
+		end, truncated = start+maxFileLines-1, true
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%s:%d-%d\n", file, start, end)
+	for i := start; i <= end; i++ {
+		fmt.Fprintf(&buf, "%d\t%s\n", i, lines[i-1])
+	}
+	if truncated {
+		fmt.Fprintf(&buf, "... truncated to %d lines\n", maxFileLines)
+	}
+	return buf.String(), nil
+}
+
+func searchIdentifier(_ context.Context, raw json.RawMessage) (string, error) {
+	args := new(struct {
+		Name string `json:"name"`
+	})
+	if err := json.Unmarshal(raw, args); err != nil {
+		return "", err
+	}
+	decls, err := parse.FindDeclarations(args.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(decls) == 0 {
+		return fmt.Sprintf("no declaration of %s found", args.Name), nil
+	}
+	return formatDeclarations(decls), nil
+}
+
+func formatDeclarations(decls []*parse.Declaration) string {
+	var buf strings.Builder
+	for i, d := range decls {
+		if i == maxResults {
+			fmt.Fprintf(&buf, "... %d more\n", len(decls)-maxResults)
+			break
+		}
+		fmt.Fprintf(&buf, "%s %s at %s:%d\n```go\n%s\n```\n", d.Kind, d.Name, d.File, d.Line, d.Source)
+	}
+	return buf.String()
+}
+
+func listCallers(_ context.Context, raw json.RawMessage) (string, error) {
+	args := new(struct {
+		Function string `json:"function"`
+	})
+	if err := json.Unmarshal(raw, args); err != nil {
+		return "", err
+	}
+	calls, err := parse.FindCallers(args.Function)
+	if err != nil {
+		return "", err
+	}
+	if len(calls) == 0 {
+		return fmt.Sprintf("no call of %s found", args.Function), nil
+	}
+	var buf strings.Builder
+	for i, c := range calls {
+		if i == maxResults {
+			fmt.Fprintf(&buf, "... %d more\n", len(calls)-maxResults)
+			break
+		}
+		caller := c.Caller
+		if caller == "" {
+			caller = "package scope"
+		}
+		fmt.Fprintf(&buf, "%s:%d in %s: %s\n", c.File, c.Line, caller, c.Code)
+	}
+	return buf.String(), nil
+}
+
+func gitLog(_ context.Context, raw json.RawMessage) (string, error) {
+	args := new(struct {
+		File     string `json:"file"`
+		Function string `json:"function"`
+	})
+	if err := json.Unmarshal(raw, args); err != nil {
+		return "", err
+	}
+	file, err := parse.ResolveFile(args.File)
+	if err != nil {
+		return "", err
+	}
+	var start, end int
+	if args.Function != "" {
+		decls, err := findFunctions(args.Function, file)
+		if err != nil {
+			return "", err
+		}
+		if len(decls) == 0 {
+			return "", fmt.Errorf("function %s not found in %s", args.Function, file)
+		}
+		start = decls[0].Line
+		end = start + strings.Count(decls[0].Source, "\n")
+	}
+	commits, err := history.Log(file, start, end, maxLogCommits)
+	if err != nil {
+		return "", errors.New("the git history is not available")
+	}
+	if len(commits) == 0 {
+		return "no commits found", nil
+	}
+	var buf strings.Builder
+	for _, c := range commits {
+		fmt.Fprintln(&buf, c)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,330 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ahaostudy/code-diagnostic/sse"
+	"github.com/ahaostudy/code-diagnostic/utils"
+)
+
+// anthropicVersion the version of the Messages API the requests are written for
+const anthropicVersion = "2023-06-01"
+
+// Anthropic big model of the Anthropic Messages API
+type Anthropic struct {
+	url string
+
+	model     string
+	maxTokens int
+	baseURL   string
+	apiKey    string
+	retry     retryPolicy
+}
+
+func NewAnthropic(apiKey string, opts ...AnthropicOption) BigModel {
+	a := &Anthropic{
+		model:     "claude-sonnet-4-5",
+		maxTokens: 4096,
+		baseURL:   "https://api.anthropic.com",
+		apiKey:    apiKey,
+		retry:     defaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.url = strings.TrimSuffix(a.baseURL, "/") + "/v1/messages"
+	return a
+}
+
+type AnthropicOption func(*Anthropic)
+
+// WithAnthropicModel specify Anthropic model
+func WithAnthropicModel(model string) AnthropicOption {
+	return func(a *Anthropic) {
+		a.model = model
+	}
+}
+
+// WithAnthropicMaxTokens specify the maximum number of tokens of the answer
+func WithAnthropicMaxTokens(n int) AnthropicOption {
+	return func(a *Anthropic) {
+		a.maxTokens = n
+	}
+}
+
+// WithAnthropicBaseURL specify Anthropic API base url
+func WithAnthropicBaseURL(url string) AnthropicOption {
+	return func(a *Anthropic) {
+		a.baseURL = url
+	}
+}
+
+func (a *Anthropic) ContextWindow() int {
+	if strings.HasPrefix(a.model, "claude") {
+		return 200000
+	}
+	return 0
+}
+
+func (a *Anthropic) Fingerprint() string {
+	return fmt.Sprintf("anthropic %s %s %d", a.url, a.model, a.maxTokens)
+}
+
+// anthropicEvent the data of a stream event, only the fields in use are decoded
+type anthropicEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Usage anthropicUsage `json:"usage"`
+	// Index and ContentBlock the content block of content_block_start, a tool_use block for tool calls
+	Index        int `json:"index"`
+	ContentBlock struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"content_block"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+		// PartialJSON a piece of the input of a tool_use block
+		PartialJSON string `json:"partial_json"`
+	} `json:"delta"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicErrorStatus http status of the error types
+var anthropicErrorStatus = map[string]int{
+	"invalid_request_error": 400,
+	"authentication_error":  401,
+	"permission_error":      403,
+	"not_found_error":       404,
+	"request_too_large":     413,
+	"rate_limit_error":      429,
+	"api_error":             500,
+	"overloaded_error":      529,
+}
+
+// anthropicUsage the usage of message_start, and of message_delta with the cumulative output tokens
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+}
+
+func (a *Anthropic) Chat(messages []*Message) chan Result {
+	return a.ChatContext(context.Background(), messages)
+}
+
+func (a *Anthropic) ChatContext(ctx context.Context, messages []*Message) chan Result {
+	return a.ChatTools(ctx, messages, nil)
+}
+
+func (a *Anthropic) ChatTools(ctx context.Context, messages []*Message, tools []*Tool) chan Result {
+	return a.retry.stream(ctx, "anthropic", func(ctx context.Context, out chan Result) (bool, error) {
+		return a.chat(ctx, messages, tools, out)
+	})
+}
+
+// anthropicBlock a content block of a message
+type anthropicBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	// ID, Name and Input of a tool_use block
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// ToolUseID and Content of a tool_result block
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string            `json:"role"`
+	Content []*anthropicBlock `json:"content"`
+}
+
+// MarshalJSON send the content of a text message as a string
+func (m *anthropicMessage) MarshalJSON() ([]byte, error) {
+	if len(m.Content) == 0 {
+		return json.Marshal(map[string]string{"role": m.Role, "content": ""})
+	}
+	if len(m.Content) == 1 && m.Content[0].Type == "text" {
+		return json.Marshal(map[string]string{"role": m.Role, "content": m.Content[0].Text})
+	}
+	type message anthropicMessage
+	return json.Marshal((*message)(m))
+}
+
+// anthropicMessages translate the messages, the tool calls are sent as tool_use blocks
+// and the tool results as tool_result blocks of the following user message
+func anthropicMessages(messages []*Message) []*anthropicMessage {
+	var msgs []*anthropicMessage
+	for _, msg := range messages {
+		role := msg.Role
+		var blocks []*anthropicBlock
+		switch {
+		case msg.Role == RoleTool:
+			role = RoleUser
+			blocks = append(blocks, &anthropicBlock{Type: "tool_result", ToolUseID: msg.ToolCallID, Content: msg.Content})
+		default:
+			if msg.Content != "" {
+				blocks = append(blocks, &anthropicBlock{Type: "text", Text: msg.Content})
+			}
+			for _, call := range msg.ToolCalls {
+				blocks = append(blocks, &anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Name, Input: call.arguments()})
+			}
+		}
+		// the results of the calls of a message are sent in a single user message
+		if n := len(msgs); n > 0 && msgs[n-1].Role == role {
+			msgs[n-1].Content = append(msgs[n-1].Content, blocks...)
+			continue
+		}
+		msgs = append(msgs, &anthropicMessage{Role: role, Content: blocks})
+	}
+	return msgs
+}
+
+// anthropicTools the tools in the shape of the Messages API
+func anthropicTools(tools []*Tool) []map[string]interface{} {
+	specs := make([]map[string]interface{}, len(tools))
+	for i, tool := range tools {
+		specs[i] = map[string]interface{}{"name": tool.Name, "description": tool.Description, "input_schema": tool.Parameters}
+	}
+	return specs
+}
+
+// chat send a single request and stream the answer into out,
+// streamed reports whether any data was sent so that the request can no longer be retried
+func (a *Anthropic) chat(ctx context.Context, messages []*Message, tools []*Tool, out chan Result) (streamed bool, err error) {
+	system, msgs := splitSystem(messages)
+	data := map[string]interface{}{
+		"model":      a.model,
+		"max_tokens": a.maxTokens,
+		"stream":     true,
+		"messages":   anthropicMessages(msgs),
+	}
+	if system != "" {
+		data["system"] = system
+	}
+	if len(tools) > 0 {
+		data["tools"] = anthropicTools(tools)
+	}
+
+	req := utils.NewRequest(a.url)
+	req.SetData(data)
+	req.SetHeader("x-api-key", a.apiKey)
+	req.SetHeader("anthropic-version", anthropicVersion)
+	req.SetHeader("Content-Type", "application/json")
+
+	resp, err := req.POSTWithContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("anthropic request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// error responses are in the shape {"type": "error", "error": {"type", "message"}}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, newAPIError(resp)
+	}
+
+	usage := &Usage{Model: a.model}
+	// calls the tool_use blocks by index, their input is streamed as pieces of JSON
+	calls := make(map[int]*ToolCall)
+	var order []int
+	dec := sse.NewDecoder(resp.Body)
+	for {
+		ev, err := dec.Next()
+		if err == io.EOF {
+			// the stream must end with message_stop, otherwise the answer was cut off
+			return streamed, fmt.Errorf("anthropic stream ended before message_stop: %w", io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return streamed, err
+		}
+
+		data := new(anthropicEvent)
+		if err := json.Unmarshal([]byte(ev.Data), data); err != nil {
+			return streamed, fmt.Errorf("response data error: %w", err)
+		}
+		switch data.Type {
+		case "message_start":
+			u := data.Message.Usage
+			usage.PromptTokens = u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+			usage.CompletionTokens = u.OutputTokens
+		case "message_delta":
+			usage.CompletionTokens = data.Usage.OutputTokens
+		case "content_block_start":
+			if data.ContentBlock.Type == "tool_use" {
+				calls[data.Index] = &ToolCall{ID: data.ContentBlock.ID, Name: data.ContentBlock.Name}
+				order = append(order, data.Index)
+			}
+		case "content_block_delta":
+			if call, ok := calls[data.Index]; ok && data.Delta.Type == "input_json_delta" {
+				call.Arguments += data.Delta.PartialJSON
+				continue
+			}
+			if data.Delta.Type != "text_delta" || data.Delta.Text == "" {
+				continue
+			}
+			if !Send(ctx, out, Result{Type: TypeData, Content: data.Delta.Text}) {
+				return true, ctx.Err()
+			}
+			streamed = true
+		case "message_stop":
+			if len(order) > 0 {
+				result := Result{Type: TypeToolCall}
+				for _, i := range order {
+					result.ToolCalls = append(result.ToolCalls, calls[i])
+				}
+				if !Send(ctx, out, result) {
+					return streamed, ctx.Err()
+				}
+			}
+			if !Send(ctx, out, Result{Type: TypeUsage, Usage: usage}) {
+				return streamed, ctx.Err()
+			}
+			Send(ctx, out, Result{Type: TypeDone})
+			return streamed, nil
+		case "error":
+			apiErr := &APIError{StatusCode: resp.StatusCode}
+			if data.Error != nil {
+				apiErr.Type = data.Error.Type
+				apiErr.Message = data.Error.Message
+			}
+			// errors sent in the stream after the response has started keep the status 200,
+			// take the status of the error type so that transient ones are retried
+			if status, ok := anthropicErrorStatus[apiErr.Type]; ok {
+				apiErr.StatusCode = status
+			}
+			return streamed, apiErr
+		}
+	}
+}
@@ -0,0 +1,218 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/bigmodel/bigmodeltest"
+)
+
+const anthropicPath = "/v1/messages"
+
+func newTestAnthropic(srv *bigmodeltest.Server) bigmodel.BigModel {
+	a := bigmodel.NewAnthropic("sk-ant-test", bigmodel.WithAnthropicBaseURL(srv.URL), bigmodel.WithAnthropicModel("claude-test"))
+	bigmodel.SetRetry(a, 3, time.Millisecond, 10*time.Millisecond)
+	return a
+}
+
+// anthropicStream the events of a streamed answer of the text chunks
+func anthropicStream(chunks ...string) *bigmodeltest.Response {
+	events := []string{
+		`message_start: {"type":"message_start","message":{"usage":{"input_tokens":20,"cache_read_input_tokens":5,"output_tokens":1}}}`,
+		`content_block_start: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`ping: {"type":"ping"}`,
+	}
+	for _, chunk := range chunks {
+		data, _ := json.Marshal(map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]string{"type": "text_delta", "text": chunk},
+		})
+		events = append(events, "content_block_delta: "+string(data))
+	}
+	return bigmodeltest.Events(anthropicPath, append(events,
+		`content_block_stop: {"type":"content_block_stop","index":0}`,
+		`message_delta: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7}}`,
+		`message_stop: {"type":"message_stop"}`,
+	)...)
+}
+
+func TestAnthropicStream(t *testing.T) {
+	srv := bigmodeltest.NewServer(anthropicStream("Hello", ", world"))
+	defer srv.Close()
+
+	content, rest := collect(t, newTestAnthropic(srv).Chat(bigmodel.Messages(bigmodel.SystemMessage("be brief"), bigmodel.UserMessage("hi"))))
+	if content != "Hello, world" {
+		t.Errorf("content is %q", content)
+	}
+	usage := resultOf(rest, bigmodel.TypeUsage)
+	if usage == nil || usage.Usage.PromptTokens != 25 || usage.Usage.CompletionTokens != 7 || usage.Usage.Model != "claude-test" {
+		t.Fatalf("usage is %+v, want 25 prompt and 7 completion tokens from message_delta", usage)
+	}
+	if last(t, rest).Type != bigmodel.TypeDone {
+		t.Errorf("the stream ended with %+v", last(t, rest))
+	}
+
+	req := srv.AssertRequests(t, 1)[0]
+	if req.Path != anthropicPath {
+		t.Errorf("request path is %s", req.Path)
+	}
+	req.AssertHeader(t, "x-api-key", "sk-ant-test")
+	req.AssertHeader(t, "anthropic-version", "2023-06-01")
+	req.AssertField(t, "system", "be brief")
+	req.AssertField(t, "stream", true)
+	req.AssertField(t, "messages", []map[string]string{{"role": "user", "content": "hi"}})
+}
+
+func TestAnthropicErrorEvent(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Events(anthropicPath,
+		`message_start: {"type":"message_start","message":{"usage":{"input_tokens":20}}}`,
+		`content_block_delta: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"partial"}}`,
+		`error: {"type":"error","error":{"type":"invalid_request_error","message":"bad things"}}`,
+	))
+	defer srv.Close()
+
+	content, rest := collect(t, newTestAnthropic(srv).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	res := resultOf(rest, bigmodel.TypeError)
+	var apiErr *bigmodel.APIError
+	if content != "partial" || res == nil || !errors.As(res.Err, &apiErr) {
+		t.Fatalf("got content %q and %+v, want the content followed by an *APIError", content, rest)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Type != "invalid_request_error" || apiErr.Message != "bad things" {
+		t.Errorf("error is %+v", apiErr)
+	}
+	srv.AssertRequests(t, 1)
+}
+
+func TestAnthropicOverloadedRetry(t *testing.T) {
+	t.Run("error event", func(t *testing.T) {
+		srv := bigmodeltest.NewServer(
+			bigmodeltest.Events(anthropicPath,
+				`message_start: {"type":"message_start","message":{"usage":{"input_tokens":20}}}`,
+				`error: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			),
+			anthropicStream("ok"),
+		)
+		defer srv.Close()
+		content, rest := collect(t, newTestAnthropic(srv).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+		if content != "ok" || last(t, rest).Type != bigmodel.TypeDone {
+			t.Fatalf("got content %q and %+v, want the retried answer", content, rest)
+		}
+		srv.AssertRequests(t, 2)
+	})
+	t.Run("error response", func(t *testing.T) {
+		srv := bigmodeltest.NewServer(
+			bigmodeltest.Raw(anthropicPath, 529, "application/json", `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`),
+			anthropicStream("ok"),
+		)
+		defer srv.Close()
+		content, rest := collect(t, newTestAnthropic(srv).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+		if content != "ok" || last(t, rest).Type != bigmodel.TypeDone {
+			t.Fatalf("got content %q and %+v, want the retried answer", content, rest)
+		}
+		srv.AssertRequests(t, 2)
+	})
+	t.Run("after the answer has begun", func(t *testing.T) {
+		srv := bigmodeltest.NewServer(
+			bigmodeltest.Events(anthropicPath,
+				`content_block_delta: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"partial"}}`,
+				`error: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			),
+			anthropicStream("unused"),
+		)
+		defer srv.Close()
+		_, rest := collect(t, newTestAnthropic(srv).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+		var apiErr *bigmodel.APIError
+		if res := resultOf(rest, bigmodel.TypeError); res == nil || !errors.As(res.Err, &apiErr) || apiErr.StatusCode != 529 {
+			t.Fatalf("got %+v, want the overloaded error", rest)
+		}
+		srv.AssertRequests(t, 1)
+	})
+}
+
+func TestAnthropicCutOff(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Events(anthropicPath,
+		`content_block_delta: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"partial"}}`,
+	))
+	defer srv.Close()
+	_, rest := collect(t, newTestAnthropic(srv).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if res := resultOf(rest, bigmodel.TypeError); res == nil {
+		t.Fatalf("got %+v, want an error for the stream without message_stop", rest)
+	}
+}
+
+func TestAnthropicToolCalls(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Events(anthropicPath,
+		`message_start: {"type":"message_start","message":{"usage":{"input_tokens":20}}}`,
+		`content_block_start: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`content_block_delta: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me look."}}`,
+		`content_block_stop: {"type":"content_block_stop","index":0}`,
+		`content_block_start: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"read_function","input":{}}}`,
+		`content_block_delta: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"function\":"}}`,
+		`content_block_delta: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":" \"Div\"}"}}`,
+		`content_block_stop: {"type":"content_block_stop","index":1}`,
+		`message_delta: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":9}}`,
+		`message_stop: {"type":"message_stop"}`,
+	), anthropicStream("done"))
+	defer srv.Close()
+
+	a := newTestAnthropic(srv).(bigmodel.ToolBigModel)
+	tools := []*bigmodel.Tool{{Name: "read_function", Description: "read a function", Parameters: map[string]interface{}{"type": "object"}}}
+	messages := bigmodel.Messages(bigmodel.UserMessage("why?"))
+	content, rest := collect(t, a.ChatTools(context.Background(), messages, tools))
+	res := resultOf(rest, bigmodel.TypeToolCall)
+	if content != "Let me look." || res == nil || len(res.ToolCalls) != 1 {
+		t.Fatalf("got content %q and %+v, want the text and a tool call", content, rest)
+	}
+	call := res.ToolCalls[0]
+	if call.ID != "toolu_1" || call.Name != "read_function" || call.Arguments != `{"function": "Div"}` {
+		t.Errorf("tool call is %+v", call)
+	}
+
+	// the call and its result are sent back as tool_use and tool_result blocks
+	messages = append(messages,
+		&bigmodel.Message{Role: bigmodel.RoleAssistant, Content: content, ToolCalls: res.ToolCalls},
+		bigmodel.ToolMessage("toolu_1", "func Div() {}"),
+	)
+	if content, _ := collect(t, a.ChatTools(context.Background(), messages, tools)); content != "done" {
+		t.Fatalf("content is %q", content)
+	}
+	reqs := srv.AssertRequests(t, 2)
+	reqs[0].AssertField(t, "tools", []map[string]interface{}{{
+		"name": "read_function", "description": "read a function", "input_schema": map[string]string{"type": "object"},
+	}})
+	reqs[1].AssertField(t, "messages", []map[string]interface{}{
+		{"role": "user", "content": "why?"},
+		{"role": "assistant", "content": []map[string]interface{}{
+			{"type": "text", "text": "Let me look."},
+			{"type": "tool_use", "id": "toolu_1", "name": "read_function", "input": map[string]string{"function": "Div"}},
+		}},
+		{"role": "user", "content": []map[string]interface{}{
+			{"type": "tool_result", "tool_use_id": "toolu_1", "content": "func Div() {}"},
+		}},
+	})
+}
@@ -0,0 +1,137 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/ahaostudy/code-diagnostic/utils"
+)
+
+// TokenProvider get an access token for the request, such as a Microsoft Entra ID token,
+// it is called before every request and is expected to cache the token until it expires
+type TokenProvider func(ctx context.Context) (string, error)
+
+// Azure big model of an Azure OpenAI deployment, it speaks the chat completions protocol of ChatGPT
+type Azure struct {
+	*ChatGPT
+
+	endpoint   string
+	deployment string
+	apiVersion string
+	token      TokenProvider
+	// embeddingDeployment the deployment of the embedding model, Embed is not supported without it
+	embeddingDeployment string
+}
+
+// NewAzure create the big model of the deployment on the endpoint such as https://{resource}.openai.azure.com,
+// the api key is sent in the api-key header unless WithAzureToken is specified
+func NewAzure(endpoint, deployment, apiKey string, opts ...AzureOption) BigModel {
+	az := &Azure{
+		ChatGPT:    NewChatGPT(apiKey, WithSpecifyModel(deployment)).(*ChatGPT),
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		deployment: deployment,
+		apiVersion: "2024-10-21",
+	}
+	for _, opt := range opts {
+		opt(az)
+	}
+	az.url = fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s",
+		az.endpoint, url.PathEscape(az.deployment), url.QueryEscape(az.apiVersion))
+	az.authorize = az.authorizeRequest
+	return az
+}
+
+type AzureOption func(*Azure)
+
+// WithAzureAPIVersion specify the api-version of the requests
+func WithAzureAPIVersion(version string) AzureOption {
+	return func(az *Azure) {
+		az.apiVersion = version
+	}
+}
+
+// WithAzureToken authenticate with the bearer token of the provider, such as a Microsoft Entra ID token
+// with the scope https://cognitiveservices.azure.com/.default, instead of the api key
+func WithAzureToken(provider TokenProvider) AzureOption {
+	return func(az *Azure) {
+		az.token = provider
+	}
+}
+
+// WithAzureModel specify the model of the deployment, which is used to look up its context window and price
+// when the deployment is not named after the model
+func WithAzureModel(model string) AzureOption {
+	return func(az *Azure) {
+		az.model = model
+	}
+}
+
+// WithAzureOptions apply the ChatGPT options, such as the generation parameters and the http client,
+// WithSpecifyBaseURL is ignored since the url is built from the endpoint and the deployment
+func WithAzureOptions(opts ...Option) AzureOption {
+	return func(az *Azure) {
+		baseURL := az.baseURL
+		for _, opt := range opts {
+			opt(az.ChatGPT)
+		}
+		if az.baseURL != baseURL {
+			log.Printf("azure ignores the base url %s, the requests go to the endpoint %s", az.baseURL, az.endpoint)
+			az.baseURL = baseURL
+		}
+	}
+}
+
+// WithAzureEmbeddingDeployment specify the deployment of the embedding model used by Embed
+func WithAzureEmbeddingDeployment(deployment string) AzureOption {
+	return func(az *Azure) {
+		az.embeddingDeployment = deployment
+	}
+}
+
+func (az *Azure) Embed(ctx context.Context, texts []string) (*Embeddings, error) {
+	if az.embeddingDeployment == "" {
+		return nil, ErrNoEmbeddings
+	}
+	e, err := az.embed(ctx, fmt.Sprintf("%s/openai/deployments/%s/embeddings?api-version=%s",
+		az.endpoint, url.PathEscape(az.embeddingDeployment), url.QueryEscape(az.apiVersion)), az.embeddingDeployment, texts)
+	if err != nil {
+		return nil, err
+	}
+	e.Model = "azure/" + az.embeddingDeployment
+	return e, nil
+}
+
+func (az *Azure) authorizeRequest(ctx context.Context, req *utils.Request) error {
+	if az.token == nil {
+		req.SetHeader("api-key", az.apiKey)
+		return nil
+	}
+	token, err := az.token(ctx)
+	if err != nil {
+		return fmt.Errorf("azure token: %w", err)
+	}
+	req.SetHeader("Authorization", "Bearer "+token)
+	return nil
+}
@@ -0,0 +1,123 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/bigmodel/bigmodeltest"
+)
+
+const azurePath = "/openai/deployments/gpt4o-prod/chat/completions"
+
+func TestAzureStream(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Reply("Hello").WithUsage(5, 1))
+	defer srv.Close()
+
+	az := bigmodel.NewAzure(srv.URL+"/", "gpt4o-prod", "azure-key",
+		bigmodel.WithAzureAPIVersion("2024-06-01"),
+		bigmodel.WithAzureModel("gpt-4o"),
+		bigmodel.WithAzureOptions(bigmodel.WithSpecifyBaseURL("https://api.openai.com")))
+	content, rest := collect(t, az.Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if content != "Hello" || last(t, rest).Type != bigmodel.TypeDone {
+		t.Fatalf("got content %q and %+v", content, rest)
+	}
+	if u := rest[0].Usage; u == nil || u.Model != "gpt-4o" {
+		t.Errorf("usage is %+v, want it metered as the model of the deployment", u)
+	}
+
+	req := srv.AssertRequests(t, 1)[0]
+	if req.Path != azurePath || req.Query.Get("api-version") != "2024-06-01" {
+		t.Errorf("request went to %s?%s", req.Path, req.Query.Encode())
+	}
+	req.AssertHeader(t, "api-key", "azure-key")
+	req.AssertHeader(t, "Authorization", "")
+}
+
+func TestAzureToken(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Reply("ok"))
+	defer srv.Close()
+
+	az := bigmodel.NewAzure(srv.URL, "gpt4o-prod", "", bigmodel.WithAzureToken(func(context.Context) (string, error) {
+		return "entra-token", nil
+	}))
+	if content, _ := collect(t, az.Chat(bigmodel.Messages(bigmodel.UserMessage("hi")))); content != "ok" {
+		t.Fatalf("content is %q", content)
+	}
+	req := srv.AssertRequests(t, 1)[0]
+	req.AssertHeader(t, "Authorization", "Bearer entra-token")
+	req.AssertHeader(t, "api-key", "")
+}
+
+func TestAzureTokenFailed(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Reply("unused"))
+	defer srv.Close()
+
+	expired := errors.New("credential expired")
+	az := bigmodel.NewAzure(srv.URL, "gpt4o-prod", "", bigmodel.WithAzureToken(func(context.Context) (string, error) {
+		return "", expired
+	}))
+	_, rest := collect(t, az.Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if res := last(t, rest); !errors.Is(res.Err, expired) {
+		t.Fatalf("got %+v, want the error of the token provider", res)
+	}
+	srv.AssertRequests(t, 0)
+}
+
+func TestAzureContentFilter(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Events(azurePath,
+		`{"choices":[],"prompt_filter_results":[{"prompt_index":0,"content_filter_results":{}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"Sure"}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"content_filter"}]}`,
+		"[DONE]",
+	))
+	defer srv.Close()
+
+	content, rest := collect(t, bigmodel.NewAzure(srv.URL, "gpt4o-prod", "azure-key").Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	var apiErr *bigmodel.APIError
+	if res := last(t, rest); content != "Sure" || !errors.As(res.Err, &apiErr) || apiErr.Code != "content_filter" {
+		t.Fatalf("got content %q and %+v, want the content filter error", content, res)
+	}
+	if apiErr.Retryable() {
+		t.Error("the content filter error is retryable")
+	}
+}
+
+func TestAzureInnerError(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Raw(azurePath, http.StatusBadRequest, "application/json", `{"error":{
+		"message":"The response was filtered due to the prompt triggering content management policy.",
+		"type":null,"param":"prompt","code":"content_filter","status":400,
+		"innererror":{"code":"ResponsibleAIPolicyViolation","content_filter_result":{"hate":{"filtered":true,"severity":"high"}}}}}`))
+	defer srv.Close()
+
+	_, rest := collect(t, bigmodel.NewAzure(srv.URL, "gpt4o-prod", "azure-key").Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	var apiErr *bigmodel.APIError
+	if res := last(t, rest); !errors.As(res.Err, &apiErr) {
+		t.Fatalf("got %+v, want an *APIError", res)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != "content_filter" || apiErr.Type != "ResponsibleAIPolicyViolation" {
+		t.Errorf("error is %+v", apiErr)
+	}
+	srv.AssertRequests(t, 1)
+}
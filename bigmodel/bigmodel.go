@@ -19,34 +19,201 @@
 
 package bigmodel
 
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
 // BigModel interface
 type BigModel interface {
-	// Chat Receive a query for large model calls and write the output results to the Result channel in real time
+	// Chat Receive a query for large model calls and write the output results to the Result channel in real time,
+	// the channel is closed after the TypeDone or TypeError result.
+	// Besides TypeData the channel may carry TypeUsage, TypeToolCall and TypeRoute results,
+	// callers only interested in the answer skip them
 	Chat(messages []*Message) chan Result
 }
 
+// ContextBigModel big model whose requests are aborted when the context is canceled or its deadline is exceeded,
+// the Result channel is closed without further results in that case
+type ContextBigModel interface {
+	BigModel
+	ChatContext(ctx context.Context, messages []*Message) chan Result
+}
+
+// ChatContext chat with the big model under the context, see AsContext for implementations without context support
+func ChatContext(ctx context.Context, bm BigModel, messages []*Message) chan Result {
+	return AsContext(bm).ChatContext(ctx, messages)
+}
+
+// AsContext adapt the big model to ContextBigModel.
+// Big models without context support cannot abort their request, but the adapter stops forwarding on cancel
+// and drains their results in the background, so that no goroutine is left blocked on the channel.
+func AsContext(bm BigModel) ContextBigModel {
+	if cbm, ok := bm.(ContextBigModel); ok {
+		return cbm
+	}
+	return &contextAdapter{BigModel: bm}
+}
+
+type contextAdapter struct {
+	BigModel
+}
+
+func (a *contextAdapter) ChatContext(ctx context.Context, messages []*Message) chan Result {
+	out := make(chan Result)
+
+	go func() {
+		defer close(out)
+		in := a.BigModel.Chat(messages)
+		for {
+			select {
+			case res, ok := <-in:
+				if !ok || !Send(ctx, out, res) {
+					go Drain(in)
+					return
+				}
+				if res.Type == TypeDone || res.Type == TypeError {
+					return
+				}
+			case <-ctx.Done():
+				go Drain(in)
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+func (a *contextAdapter) ContextWindow() int {
+	return ContextWindow(a.BigModel)
+}
+
+// Send send the result unless the context is done first, report whether it was sent
+func Send(ctx context.Context, out chan<- Result, res Result) bool {
+	select {
+	case out <- res:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Drain receive the remaining results until the final one or the channel is closed
+func Drain(in <-chan Result) {
+	for res := range in {
+		if res.Type == TypeDone || res.Type == TypeError {
+			return
+		}
+	}
+}
+
+// ContextWindower optional interface of BigModel reporting the context window of the model in tokens
+type ContextWindower interface {
+	ContextWindow() int
+}
+
+// ContextWindow the context window of the big model, 0 if unknown
+func ContextWindow(bm BigModel) int {
+	if cw, ok := bm.(ContextWindower); ok {
+		return cw.ContextWindow()
+	}
+	return 0
+}
+
+// Checker optional interface of BigModel checking that the model is ready before the first chat,
+// the context window of local models is only known once they are checked
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Check check the big model if it is a Checker
+func Check(ctx context.Context, bm BigModel) error {
+	if c, ok := bm.(Checker); ok {
+		return c.Check(ctx)
+	}
+	return nil
+}
+
+// Fingerprinter optional interface of BigModel describing the settings its answers depend on,
+// such as the endpoint, the model and the generation parameters
+type Fingerprinter interface {
+	Fingerprint() string
+}
+
+// Fingerprint the settings of the big model, its type if it is not a Fingerprinter
+func Fingerprint(bm BigModel) string {
+	if fp, ok := bm.(Fingerprinter); ok {
+		return fp.Fingerprint()
+	}
+	return fmt.Sprintf("%T", bm)
+}
+
 type Result struct {
 	Type    int
 	Content string
+	// Err the error of a TypeError result, such as an *APIError
+	Err error
+	// Usage the tokens used by the request of a TypeUsage result
+	Usage *Usage
+	// ToolCalls the tool calls of a TypeToolCall result
+	ToolCalls []*ToolCall
 }
 
 const (
 	TypeData = iota
 	TypeDone
 	TypeError
+	// TypeUsage sent before TypeDone by the big models reporting their token usage
+	TypeUsage
+	// TypeToolCall sent before TypeDone when the big model requests tool calls instead of answering
+	TypeToolCall
+	// TypeRoute sent by composite big models before the answer, Content is the name of the backend answering
+	TypeRoute
 )
 
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+
+	// ToolCalls the tool calls requested by an assistant message
+	ToolCalls []*ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID the call a tool message is the result of
+	ToolCallID string `json:"tool_call_id,omitempty"`
 }
 
 const (
 	RoleUser      = "user"
 	RoleAssistant = "assistant"
 	RoleSystem    = "system"
+	RoleTool      = "tool"
 )
 
+// splitSystem move the system messages to a separate system prompt
+// and merge consecutive messages of the same role, for the apis requiring the roles to alternate.
+// The messages of tool calls and results are kept as they are, their apis merge them in their own shape.
+func splitSystem(messages []*Message) (system string, msgs []*Message) {
+	var systems []string
+	for _, msg := range messages {
+		if msg.Role == RoleSystem {
+			systems = append(systems, msg.Content)
+			continue
+		}
+		if n := len(msgs); n > 0 && msgs[n-1].Role == msg.Role && plain(msgs[n-1]) && plain(msg) {
+			msgs[n-1] = &Message{Role: msg.Role, Content: msgs[n-1].Content + "\n\n" + msg.Content}
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return strings.Join(systems, "\n\n"), msgs
+}
+
+// plain report whether the message is neither a tool call nor a tool result
+func plain(msg *Message) bool {
+	return len(msg.ToolCalls) == 0 && msg.Role != RoleTool
+}
+
 func Messages(messages ...*Message) []*Message {
 	return messages
 }
@@ -71,3 +238,11 @@ func AssistantMessage(msg string) *Message {
 		Content: msg,
 	}
 }
+
+func ToolMessage(callID, content string) *Message {
+	return &Message{
+		Role:       RoleTool,
+		Content:    content,
+		ToolCallID: callID,
+	}
+}
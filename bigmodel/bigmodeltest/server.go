@@ -0,0 +1,427 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package bigmodeltest provides a fake OpenAI-compatible chat completions server for testing the big models,
+// it also answers the requests of other apis with raw scripted responses.
+package bigmodeltest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/sse"
+)
+
+// Response a scripted answer of the server
+type Response struct {
+	// Path the path of the request answered, the chat completions endpoint if empty
+	Path string
+	// Status the status code, the error body is sent instead of the stream unless it is 200
+	Status int
+	// Header added to the response, such as Retry-After
+	Header http.Header
+	// Error the message, type and code of the error body
+	Error     string
+	ErrorType string
+	ErrorCode string
+
+	// Chunks the content streamed, one chunk each
+	Chunks []string
+	// ToolCalls streamed in fragments after the content
+	ToolCalls []*bigmodel.ToolCall
+	// FinishReason "stop" by default, or "tool_calls" if there are tool calls
+	FinishReason string
+	// PromptTokens and CompletionTokens sent in the usage chunk when the request includes the usage
+	PromptTokens     int
+	CompletionTokens int
+	// Delay the time before each chunk
+	Delay time.Duration
+	// Malformed send a chunk that is not JSON after the content
+	Malformed bool
+	// Disconnect close the connection after the content, without finishing the stream
+	Disconnect bool
+
+	// Body sent as it is with the status instead of a chat completions answer, see Raw
+	Body string
+}
+
+// Reply stream the chunks of content
+func Reply(chunks ...string) *Response {
+	return &Response{Status: http.StatusOK, Chunks: chunks}
+}
+
+// CallTools request the tool calls
+func CallTools(calls ...*bigmodel.ToolCall) *Response {
+	return &Response{Status: http.StatusOK, ToolCalls: calls}
+}
+
+// Fail answer with the status and an error body
+func Fail(status int, message string) *Response {
+	return &Response{Status: status, Error: message, ErrorType: "api_error"}
+}
+
+// Unauthorized answer like an api rejecting the api key
+func Unauthorized() *Response {
+	r := Fail(http.StatusUnauthorized, "Incorrect API key provided.")
+	r.ErrorType, r.ErrorCode = "invalid_request_error", "invalid_api_key"
+	return r
+}
+
+// RateLimited answer with 429 asking to retry after the delay
+func RateLimited(retryAfter time.Duration) *Response {
+	r := Fail(http.StatusTooManyRequests, "Rate limit reached, please try again later.")
+	r.ErrorType, r.ErrorCode = "requests", "rate_limit_exceeded"
+	r.Header = http.Header{}
+	r.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	r.Header.Set("Retry-After-Ms", strconv.FormatInt(retryAfter.Milliseconds(), 10))
+	return r
+}
+
+// Malformed stream the chunks of content followed by a chunk that is not JSON
+func Malformed(chunks ...string) *Response {
+	r := Reply(chunks...)
+	r.Malformed = true
+	return r
+}
+
+// Disconnect stream the chunks of content, then drop the connection
+func Disconnect(chunks ...string) *Response {
+	r := Reply(chunks...)
+	r.Disconnect = true
+	return r
+}
+
+// Raw answer the request of the path with the status and the body as they are,
+// such as the streams of the native apis of the backends
+func Raw(path string, status int, contentType, body string) *Response {
+	return &Response{Path: path, Status: status, Header: http.Header{"Content-Type": {contentType}}, Body: body}
+}
+
+// Events answer the request of the path with the server-sent events,
+// each is "name: data" or only the data
+func Events(path string, events ...string) *Response {
+	var buf strings.Builder
+	enc := sse.NewEncoder(&buf)
+	for _, ev := range events {
+		e := &sse.Event{Data: ev}
+		if name, data, ok := strings.Cut(ev, ": "); ok && !strings.HasPrefix(ev, "{") {
+			e.Event, e.Data = name, data
+		}
+		_ = enc.Encode(e)
+	}
+	return Raw(path, http.StatusOK, "text/event-stream", buf.String())
+}
+
+// WithUsage report the tokens of the response
+func (r *Response) WithUsage(prompt, completion int) *Response {
+	r.PromptTokens, r.CompletionTokens = prompt, completion
+	return r
+}
+
+// Request a request received by the server
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	// Body the decoded json body, RawBody the body as it is
+	Body    map[string]interface{}
+	RawBody []byte
+
+	Model    string
+	Stream   bool
+	Messages []*bigmodel.Message
+	Tools    []*bigmodel.Tool
+}
+
+// Server fake chat completions server answering the requests with the scripted responses of their path in order
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses []*Response
+	requests  []*Request
+}
+
+// NewServer start a server answering with the responses, it must be closed
+func NewServer(responses ...*Response) *Server {
+	s := &Server{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Script add responses answered after the ones left
+func (s *Server) Script(responses ...*Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, responses...)
+}
+
+// Requests the requests received so far
+func (s *Server) Requests() []*Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Request(nil), s.requests...)
+}
+
+// ChatGPT a ChatGPT big model of the server waiting at most 10ms between retries, even if asked to retry after longer
+func (s *Server) ChatGPT(opts ...bigmodel.Option) bigmodel.BigModel {
+	opts = append([]bigmodel.Option{
+		bigmodel.WithSpecifyBaseURL(s.URL),
+		bigmodel.WithRetryBackoff(time.Millisecond, 10*time.Millisecond),
+	}, opts...)
+	return bigmodel.NewChatGPT("sk-test", opts...)
+}
+
+// AssertRequests fail the test unless the server received n requests, and return them
+func (s *Server) AssertRequests(t testing.TB, n int) []*Request {
+	t.Helper()
+	requests := s.Requests()
+	if len(requests) != n {
+		t.Fatalf("bigmodeltest: got %d requests, want %d", len(requests), n)
+	}
+	return requests
+}
+
+// AssertHeader fail the test unless the request has the header
+func (r *Request) AssertHeader(t testing.TB, key, want string) {
+	t.Helper()
+	if got := r.Header.Get(key); got != want {
+		t.Errorf("bigmodeltest: header %s is %q, want %q", key, got, want)
+	}
+}
+
+// AssertField fail the test unless the field of the body is encoded as want is
+func (r *Request) AssertField(t testing.TB, key string, want interface{}) {
+	t.Helper()
+	got, _ := json.Marshal(r.Body[key])
+	expected, _ := json.Marshal(want)
+	if string(got) != string(expected) {
+		t.Errorf("bigmodeltest: field %s is %s, want %s", key, got, expected)
+	}
+}
+
+// AssertMessage fail the test unless the i-th message has the role and contains the text
+func (r *Request) AssertMessage(t testing.TB, i int, role, contains string) {
+	t.Helper()
+	if i >= len(r.Messages) {
+		t.Errorf("bigmodeltest: got %d messages, want message %d", len(r.Messages), i)
+		return
+	}
+	msg := r.Messages[i]
+	if msg.Role != role || !strings.Contains(msg.Content, contains) {
+		t.Errorf("bigmodeltest: message %d is %s %q, want %s containing %q", i, msg.Role, msg.Content, role, contains)
+	}
+}
+
+// chatCompletions report whether the path is a chat completions endpoint, such as the one of an Azure deployment
+func chatCompletions(path string) bool {
+	return strings.HasSuffix(path, "/chat/completions")
+}
+
+// next pop the first response scripted for the path, nil if there is none
+func (s *Server) next(path string) *Response {
+	for i, resp := range s.responses {
+		if resp.Path == path || resp.Path == "" && chatCompletions(path) {
+			s.responses = append(s.responses[:i:i], s.responses[i+1:]...)
+			return resp
+		}
+	}
+	return nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	req, err := newRequest(r)
+	if err != nil {
+		writeError(w, &Response{Status: http.StatusBadRequest, Error: err.Error(), ErrorType: "invalid_request_error"})
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	// a request to another path must not use up the response scripted for the next one
+	resp := s.next(r.URL.Path)
+	s.mu.Unlock()
+
+	switch {
+	case resp == nil && !chatCompletions(r.URL.Path):
+		writeError(w, &Response{Status: http.StatusNotFound, Error: "unknown path " + r.URL.Path, ErrorType: "invalid_request_error"})
+	case resp == nil:
+		writeError(w, Fail(http.StatusInternalServerError, "bigmodeltest: no scripted response left"))
+	default:
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		if resp.Body != "" {
+			w.WriteHeader(resp.Status)
+			_, _ = io.WriteString(w, resp.Body)
+			return
+		}
+		if resp.Status != 0 && resp.Status != http.StatusOK {
+			writeError(w, resp)
+			return
+		}
+		s.stream(w, req, resp)
+	}
+}
+
+func newRequest(r *http.Request) (*Request, error) {
+	req := &Request{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header.Clone()}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.RawBody = data
+	// the requests of the other apis are kept as they are
+	if !chatCompletions(r.URL.Path) {
+		_ = json.Unmarshal(data, &req.Body)
+		return req, nil
+	}
+	if err := json.Unmarshal(data, &req.Body); err != nil {
+		return nil, fmt.Errorf("invalid json body: %w", err)
+	}
+	var body struct {
+		Model    string              `json:"model"`
+		Stream   bool                `json:"stream"`
+		Messages []*bigmodel.Message `json:"messages"`
+		Tools    []struct {
+			Function *bigmodel.Tool `json:"function"`
+		} `json:"tools"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("invalid chat completions body: %w", err)
+	}
+	req.Model, req.Stream, req.Messages = body.Model, body.Stream, body.Messages
+	for _, tool := range body.Tools {
+		req.Tools = append(req.Tools, tool.Function)
+	}
+	return req, nil
+}
+
+func writeError(w http.ResponseWriter, resp *Response) {
+	body := map[string]interface{}{"error": map[string]interface{}{
+		"message": resp.Error,
+		"type":    resp.ErrorType,
+		"code":    resp.ErrorCode,
+	}}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.Status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// stream write the response as chat completion chunks
+func (s *Server) stream(w http.ResponseWriter, req *Request, resp *Response) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	enc := sse.NewEncoder(w)
+	send := func(v interface{}) bool {
+		if resp.Delay > 0 {
+			time.Sleep(resp.Delay)
+		}
+		data, _ := json.Marshal(v)
+		return enc.Encode(&sse.Event{Data: string(data)}) == nil
+	}
+	delta := func(delta map[string]interface{}, finish interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"object":  "chat.completion.chunk",
+			"model":   req.Model,
+			"choices": []interface{}{map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finish}},
+		}
+	}
+
+	if !send(delta(map[string]interface{}{"role": "assistant", "content": ""}, nil)) {
+		return
+	}
+	for _, chunk := range resp.Chunks {
+		if !send(delta(map[string]interface{}{"content": chunk}, nil)) {
+			return
+		}
+	}
+	// the id and name come first and the arguments follow in two fragments, like the real api does
+	for i, call := range resp.ToolCalls {
+		half := len(call.Arguments) / 2
+		fragments := []map[string]interface{}{
+			{"index": i, "id": call.ID, "type": "function", "function": map[string]interface{}{"name": call.Name, "arguments": ""}},
+			{"index": i, "function": map[string]interface{}{"arguments": call.Arguments[:half]}},
+			{"index": i, "function": map[string]interface{}{"arguments": call.Arguments[half:]}},
+		}
+		for _, fragment := range fragments {
+			if !send(delta(map[string]interface{}{"tool_calls": []interface{}{fragment}}, nil)) {
+				return
+			}
+		}
+	}
+	if resp.Malformed {
+		_ = enc.Encode(&sse.Event{Data: `{"choices": [{"delta": {"content": "`})
+	}
+	if resp.Disconnect {
+		disconnect(w)
+		return
+	}
+
+	finish := resp.FinishReason
+	if finish == "" {
+		finish = "stop"
+		if len(resp.ToolCalls) > 0 {
+			finish = "tool_calls"
+		}
+	}
+	if !send(delta(map[string]interface{}{}, finish)) {
+		return
+	}
+	if options, _ := req.Body["stream_options"].(map[string]interface{}); options["include_usage"] == true {
+		usage := map[string]interface{}{
+			"object":  "chat.completion.chunk",
+			"model":   req.Model,
+			"choices": []interface{}{},
+			"usage": map[string]interface{}{
+				"prompt_tokens":     resp.PromptTokens,
+				"completion_tokens": resp.CompletionTokens,
+				"total_tokens":      resp.PromptTokens + resp.CompletionTokens,
+			},
+		}
+		if !send(usage) {
+			return
+		}
+	}
+	_ = enc.Encode(&sse.Event{Data: "[DONE]"})
+}
+
+// disconnect drop the connection in the middle of the stream
+func disconnect(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic("bigmodeltest: the response writer cannot be hijacked")
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	_ = conn.Close()
+}
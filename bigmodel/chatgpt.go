@@ -20,11 +20,16 @@
 package bigmodel
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/ahaostudy/code-diagnostic/sse"
 	"github.com/ahaostudy/code-diagnostic/utils"
 )
 
@@ -35,6 +40,20 @@ type ChatGPT struct {
 	model   string
 	baseURL string
 	apiKey  string
+	retry   retryPolicy
+	// embeddingModel the model of Embed, which provides no embeddings without it
+	embeddingModel string
+
+	// params the generation parameters and extra fields of the request body
+	params map[string]interface{}
+	// header the extra headers of the request
+	header map[string]string
+	client *http.Client
+
+	// authorize set the authentication headers of the request, the api key as bearer token by default
+	authorize func(ctx context.Context, req *utils.Request) error
+	// noStreamOptions set once the backend rejected stream_options, the usage is no longer requested
+	noStreamOptions atomic.Bool
 }
 
 func NewChatGPT(apiKey string, opts ...Option) BigModel {
@@ -42,14 +61,25 @@ func NewChatGPT(apiKey string, opts ...Option) BigModel {
 		model:   "gpt-3.5-turbo",
 		baseURL: "https://api.openai.com",
 		apiKey:  apiKey,
+		retry:   defaultRetryPolicy,
+		params:  make(map[string]interface{}),
+		header:  make(map[string]string),
 	}
 	for _, opt := range opts {
 		opt(gpt)
 	}
 	gpt.url = strings.TrimSuffix(gpt.baseURL, "/") + "/v1/chat/completions"
+	gpt.authorize = gpt.bearer
 	return gpt
 }
 
+func (gpt *ChatGPT) bearer(_ context.Context, req *utils.Request) error {
+	if gpt.apiKey != "" {
+		req.SetHeader("Authorization", "Bearer "+gpt.apiKey)
+	}
+	return nil
+}
+
 type Option func(*ChatGPT)
 
 // WithSpecifyModel specify ChatGPT model
@@ -66,75 +96,399 @@ func WithSpecifyBaseURL(url string) Option {
 	}
 }
 
+// WithEmbeddingModel embed the texts with the model, such as text-embedding-3-small,
+// ChatGPT provides no embeddings unless it is specified since not every compatible api serves them
+func WithEmbeddingModel(model string) Option {
+	return func(gpt *ChatGPT) {
+		gpt.embeddingModel = model
+	}
+}
+
+// contextWindows context window of the known models, matched by the longest prefix of the model name
+var contextWindows = map[string]int{
+	"gpt-3.5-turbo":     16385,
+	"gpt-3.5-turbo-16k": 16385,
+	"gpt-4":             8192,
+	"gpt-4-32k":         32768,
+	"gpt-4-turbo":       128000,
+	"gpt-4-1106":        128000,
+	"gpt-4-0125":        128000,
+	"gpt-4o":            128000,
+	"gpt-4.1":           1047576,
+	"o1":                200000,
+	"o3":                200000,
+	"o4-mini":           200000,
+}
+
+func (gpt *ChatGPT) ContextWindow() int {
+	var prefix string
+	for p := range contextWindows {
+		if strings.HasPrefix(gpt.model, p) && len(p) > len(prefix) {
+			prefix = p
+		}
+	}
+	return contextWindows[prefix]
+}
+
+// WithMaxRetries specify how many times a request is retried on 429, 5xx and connection errors,
+// requests are never retried once data has been streamed
+func WithMaxRetries(n int) Option {
+	return func(gpt *ChatGPT) {
+		gpt.retry.maxRetries = n
+	}
+}
+
+// WithRetryBackoff specify the delay of the first retry, doubled on each retry up to max
+func WithRetryBackoff(base, max time.Duration) Option {
+	return func(gpt *ChatGPT) {
+		gpt.retry.baseDelay = base
+		gpt.retry.maxDelay = max
+	}
+}
+
+// WithTemperature specify the sampling temperature, between 0 and 2
+func WithTemperature(temperature float64) Option {
+	return func(gpt *ChatGPT) {
+		gpt.params["temperature"] = temperature
+	}
+}
+
+// WithTopP specify the nucleus sampling probability mass
+func WithTopP(topP float64) Option {
+	return func(gpt *ChatGPT) {
+		gpt.params["top_p"] = topP
+	}
+}
+
+// WithMaxTokens specify the maximum number of tokens of the answer
+func WithMaxTokens(n int) Option {
+	return func(gpt *ChatGPT) {
+		gpt.params["max_tokens"] = n
+	}
+}
+
+// WithSeed specify the seed for best-effort deterministic sampling
+func WithSeed(seed int64) Option {
+	return func(gpt *ChatGPT) {
+		gpt.params["seed"] = seed
+	}
+}
+
+// WithStop specify up to 4 sequences where the model stops generating
+func WithStop(stop ...string) Option {
+	return func(gpt *ChatGPT) {
+		gpt.params["stop"] = stop
+	}
+}
+
+// WithResponseFormat specify the response_format, such as {"type": "json_object"}
+// or {"type": "json_schema", "json_schema": {...}}
+func WithResponseFormat(format interface{}) Option {
+	return func(gpt *ChatGPT) {
+		gpt.params["response_format"] = format
+	}
+}
+
+// WithOrganization specify the OpenAI organization the requests are billed to
+func WithOrganization(org string) Option {
+	return WithHeader("OpenAI-Organization", org)
+}
+
+// WithProject specify the OpenAI project the requests are billed to
+func WithProject(project string) Option {
+	return WithHeader("OpenAI-Project", project)
+}
+
+// WithHeader add a header to the requests, it overrides the headers set by the client,
+// such as the Authorization of a proxy in front of the api
+func WithHeader(key, value string) Option {
+	return func(gpt *ChatGPT) {
+		gpt.header[key] = value
+	}
+}
+
+// WithBodyField add a field to the request body, such as the parameters of other OpenAI compatible apis,
+// the model, messages and stream fields cannot be overridden
+func WithBodyField(key string, value interface{}) Option {
+	return func(gpt *ChatGPT) {
+		gpt.params[key] = value
+	}
+}
+
+// WithHTTPClient specify the http client of the requests, utils.DefaultClient by default
+func WithHTTPClient(client *http.Client) Option {
+	return func(gpt *ChatGPT) {
+		gpt.client = client
+	}
+}
+
+// WithTransport specify the transport of the requests, such as one with a proxy or custom CAs
+func WithTransport(transport http.RoundTripper) Option {
+	return func(gpt *ChatGPT) {
+		client := *gpt.httpClient()
+		client.Transport = transport
+		gpt.client = &client
+	}
+}
+
+// WithTimeout specify the time limit of a request including the streamed answer, no limit if 0
+func WithTimeout(timeout time.Duration) Option {
+	return func(gpt *ChatGPT) {
+		client := *gpt.httpClient()
+		client.Timeout = timeout
+		gpt.client = &client
+	}
+}
+
+func (gpt *ChatGPT) httpClient() *http.Client {
+	if gpt.client != nil {
+		return gpt.client
+	}
+	return utils.DefaultClient
+}
+
+func (gpt *ChatGPT) Fingerprint() string {
+	params, _ := json.Marshal(gpt.params)
+	return fmt.Sprintf("openai %s %s %s", gpt.url, gpt.model, params)
+}
+
+func (gpt *ChatGPT) Embed(ctx context.Context, texts []string) (*Embeddings, error) {
+	if gpt.embeddingModel == "" {
+		return nil, ErrNoEmbeddings
+	}
+	e, err := gpt.embed(ctx, strings.TrimSuffix(gpt.baseURL, "/")+"/v1/embeddings", gpt.embeddingModel, texts)
+	if err != nil {
+		return nil, err
+	}
+	e.Model = "openai/" + gpt.embeddingModel
+	return e, nil
+}
+
+// setHeader set the headers of the request, the ones of WithHeader last so that they override the others
+func (gpt *ChatGPT) setHeader(ctx context.Context, req *utils.Request) error {
+	req.SetHeader("Content-Type", "application/json")
+	if err := gpt.authorize(ctx, req); err != nil {
+		return err
+	}
+	for k, v := range gpt.header {
+		req.SetHeader(k, v)
+	}
+	return nil
+}
+
+// embed request the embeddings of the model from the api at the url, the model of the result is left to the caller
+func (gpt *ChatGPT) embed(ctx context.Context, url, model string, texts []string) (*Embeddings, error) {
+	req := utils.NewRequest(url)
+	req.SetData(map[string]interface{}{"model": model, "input": texts})
+	req.SetClient(gpt.client)
+	if err := gpt.setHeader(ctx, req); err != nil {
+		return nil, err
+	}
+	body := new(struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+		Usage *struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
+	})
+	if err := postJSON(ctx, req, body); err != nil {
+		return nil, fmt.Errorf("openai embeddings request failed: %w", err)
+	}
+	e := &Embeddings{Vectors: make([][]float32, len(texts))}
+	for _, d := range body.Data {
+		if d.Index >= 0 && d.Index < len(e.Vectors) {
+			e.Vectors[d.Index] = d.Embedding
+		}
+	}
+	if body.Usage != nil {
+		e.Usage = &Usage{Model: model, PromptTokens: body.Usage.PromptTokens}
+	}
+	return e, nil
+}
+
 type chunk struct {
 	Choices []struct {
 		Delta struct {
 			Content string `json:"content"`
+			// ToolCalls the fragments of the tool calls, the arguments are streamed in pieces
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
 		} `json:"delta"`
 		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	Error *struct {
+		Message string    `json:"message"`
+		Type    string    `json:"type"`
+		Code    errorCode `json:"code"`
+	} `json:"error"`
+	// Usage sent in the last chunk without choices when include_usage is requested
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
 }
 
 func (gpt *ChatGPT) Chat(messages []*Message) chan Result {
-	out := make(chan Result)
-
-	go func() {
-		req := utils.NewRequest(gpt.url)
-		req.SetData(map[string]interface{}{
-			"model":    gpt.model,
-			"stream":   true,
-			"messages": messages,
-		})
-		req.SetHeader("Authorization", "Bearer "+gpt.apiKey)
-		req.SetHeader("Content-Type", "application/json")
+	return gpt.ChatContext(context.Background(), messages)
+}
 
-		// response
-		resp, err := req.POST()
-		if err != nil {
-			log.Fatalln("openai request failed:", err)
+func (gpt *ChatGPT) ChatContext(ctx context.Context, messages []*Message) chan Result {
+	return gpt.retry.stream(ctx, "openai", func(ctx context.Context, out chan Result) (bool, error) {
+		return gpt.chat(ctx, messages, nil, out)
+	})
+}
+
+func (gpt *ChatGPT) ChatTools(ctx context.Context, messages []*Message, tools []*Tool) chan Result {
+	return gpt.retry.stream(ctx, "openai", func(ctx context.Context, out chan Result) (bool, error) {
+		return gpt.chat(ctx, messages, tools, out)
+	})
+}
+
+// openaiTools the tools in the shape of the chat completions api
+func openaiTools(tools []*Tool) []map[string]interface{} {
+	specs := make([]map[string]interface{}, len(tools))
+	for i, tool := range tools {
+		specs[i] = map[string]interface{}{"type": "function", "function": tool}
+	}
+	return specs
+}
+
+// chat send a single request and stream the answer into out,
+// streamed reports whether any data was sent so that the request can no longer be retried
+func (gpt *ChatGPT) chat(ctx context.Context, messages []*Message, tools []*Tool, out chan Result) (streamed bool, err error) {
+	data := make(map[string]interface{}, len(gpt.params)+3)
+	for k, v := range gpt.params {
+		data[k] = v
+	}
+	data["model"] = gpt.model
+	data["stream"] = true
+	data["messages"] = messages
+	if len(tools) > 0 {
+		data["tools"] = openaiTools(tools)
+	}
+	// constrain the answer to the schema of the request, unless the format is specified by WithResponseFormat
+	if schema := SchemaOf(ctx); schema != nil {
+		if _, ok := data["response_format"]; !ok {
+			data["response_format"] = map[string]interface{}{
+				"type":        "json_schema",
+				"json_schema": map[string]interface{}{"name": schema.Name, "schema": schema.Schema, "strict": true},
+			}
+		}
+	}
+	// report the token usage, unless the stream options are specified by WithBodyField
+	// or the backend does not know them, as some OpenAI-compatible servers
+	_, specified := data["stream_options"]
+	withOptions := !specified && !gpt.noStreamOptions.Load()
+	if withOptions {
+		data["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+
+	req := utils.NewRequest(gpt.url)
+	req.SetData(data)
+	req.SetClient(gpt.client)
+	if err := gpt.setHeader(ctx, req); err != nil {
+		return false, err
+	}
+
+	// response
+	resp, err := req.POSTWithContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("openai request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := newAPIError(resp)
+		if withOptions && apiErr.StatusCode == http.StatusBadRequest && strings.Contains(apiErr.Message, "stream_options") {
+			// send the request again without them, and the next ones too
+			gpt.noStreamOptions.Store(true)
+			resp.Body.Close()
+			return gpt.chat(ctx, messages, tools, out)
+		}
+		return false, apiErr
+	}
+
+	// the tool calls are sent once complete, before the final result
+	var calls []*ToolCall
+	done := func() {
+		if len(calls) > 0 && !Send(ctx, out, Result{Type: TypeToolCall, ToolCalls: calls}) {
 			return
 		}
-		defer resp.Body.Close()
+		Send(ctx, out, Result{Type: TypeDone})
+	}
 
-		// TODO: response status exception
+	// read response stream data
+	dec := sse.NewDecoder(resp.Body)
+	for {
+		ev, err := dec.Next()
+		if err == io.EOF {
+			done()
+			return streamed, nil
+		}
+		if err != nil {
+			return streamed, err
+		}
 
-		// read response stream data
-		buf := make([]byte, 4096)
-		var chunks, tmp string
-		for {
-			n, err := resp.Body.Read(buf)
-			if err == io.EOF {
-				out <- Result{Type: TypeDone}
-				return
+		// done
+		if ev.Data == "[DONE]" {
+			done()
+			return streamed, nil
+		}
+		data := new(chunk)
+		if err := json.Unmarshal([]byte(ev.Data), data); err != nil {
+			return streamed, fmt.Errorf("response data error: %w", err)
+		}
+		if data.Error != nil {
+			return streamed, &APIError{
+				StatusCode: resp.StatusCode,
+				Code:       string(data.Error.Code),
+				Type:       data.Error.Type,
+				Message:    data.Error.Message,
 			}
-			if err != nil {
-				out <- Result{Type: TypeError, Content: err.Error()}
-				return
+		}
+		if data.Usage != nil {
+			usage := &Usage{Model: gpt.model, PromptTokens: data.Usage.PromptTokens, CompletionTokens: data.Usage.CompletionTokens}
+			if !Send(ctx, out, Result{Type: TypeUsage, Usage: usage}) {
+				return streamed, ctx.Err()
 			}
-
-			chunks, tmp = tmp+string(buf[:n]), ""
-			for _, chk := range strings.Split(chunks, "\n\n") {
-				chk = strings.TrimPrefix(chk, "data: ")
-
-				// done
-				if chk == "[DONE]" {
-					out <- Result{Type: TypeDone}
-					return
-				}
-				data := new(chunk)
-				err := json.Unmarshal([]byte(chk), data)
-				if err != nil {
-					tmp += chk
-					continue
-				}
-				if len(data.Choices) == 0 {
-					out <- Result{Type: TypeError, Content: "response data error"}
-					return
-				}
-				out <- Result{Type: TypeData, Content: data.Choices[0].Delta.Content}
+		}
+		// azure sends the results of its prompt filter in a chunk without choices
+		if len(data.Choices) == 0 {
+			continue
+		}
+		if data.Choices[0].FinishReason == "content_filter" {
+			return streamed, &APIError{
+				StatusCode: resp.StatusCode,
+				Code:       "content_filter",
+				Message:    "the answer was stopped by the content filter",
 			}
 		}
-	}()
-
-	return out
+		delta := data.Choices[0].Delta
+		for _, tc := range delta.ToolCalls {
+			for len(calls) <= tc.Index {
+				calls = append(calls, new(ToolCall))
+			}
+			call := calls[tc.Index]
+			if tc.ID != "" {
+				call.ID = tc.ID
+			}
+			call.Name += tc.Function.Name
+			call.Arguments += tc.Function.Arguments
+		}
+		if delta.Content == "" {
+			continue
+		}
+		if !Send(ctx, out, Result{Type: TypeData, Content: delta.Content}) {
+			return true, ctx.Err()
+		}
+		streamed = true
+	}
 }
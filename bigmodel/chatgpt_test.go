@@ -0,0 +1,254 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/bigmodel/bigmodeltest"
+)
+
+func TestChatGPTStream(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Reply("Hello", ", ", "world").WithUsage(12, 3))
+	defer srv.Close()
+
+	content, rest := collect(t, srv.ChatGPT(bigmodel.WithSpecifyModel("gpt-4o")).Chat(bigmodel.Messages(
+		bigmodel.SystemMessage("be brief"),
+		bigmodel.UserMessage("hi"),
+	)))
+	if content != "Hello, world" {
+		t.Errorf("content is %q", content)
+	}
+	if len(rest) != 2 || rest[0].Type != bigmodel.TypeUsage || rest[1].Type != bigmodel.TypeDone {
+		t.Fatalf("results after the content are %+v, want usage and done", rest)
+	}
+	if u := rest[0].Usage; u.Model != "gpt-4o" || u.PromptTokens != 12 || u.CompletionTokens != 3 {
+		t.Errorf("usage is %+v", u)
+	}
+
+	req := srv.AssertRequests(t, 1)[0]
+	req.AssertHeader(t, "Authorization", "Bearer sk-test")
+	req.AssertHeader(t, "Content-Type", "application/json")
+	req.AssertField(t, "model", "gpt-4o")
+	req.AssertField(t, "stream", true)
+	req.AssertMessage(t, 0, bigmodel.RoleSystem, "be brief")
+	req.AssertMessage(t, 1, bigmodel.RoleUser, "hi")
+}
+
+func TestChatGPTUnauthorized(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Unauthorized(), bigmodeltest.Reply("unused"))
+	defer srv.Close()
+
+	content, rest := collect(t, srv.ChatGPT().Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	res := last(t, rest)
+	var apiErr *bigmodel.APIError
+	if content != "" || res.Type != bigmodel.TypeError || !errors.As(res.Err, &apiErr) {
+		t.Fatalf("got content %q and %+v, want an *APIError", content, res)
+	}
+	if apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != "invalid_api_key" {
+		t.Errorf("error is %+v", apiErr)
+	}
+	srv.AssertRequests(t, 1)
+}
+
+func TestChatGPTRateLimitedRetry(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.RateLimited(time.Millisecond), bigmodeltest.Reply("ok"))
+	defer srv.Close()
+
+	content, rest := collect(t, srv.ChatGPT().Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if content != "ok" || last(t, rest).Type != bigmodel.TypeDone {
+		t.Fatalf("got content %q and %+v", content, rest)
+	}
+	srv.AssertRequests(t, 2)
+}
+
+func TestChatGPTRateLimitedGiveUp(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.RateLimited(time.Millisecond), bigmodeltest.RateLimited(time.Millisecond))
+	defer srv.Close()
+
+	_, rest := collect(t, srv.ChatGPT(bigmodel.WithMaxRetries(1)).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	var apiErr *bigmodel.APIError
+	if res := last(t, rest); !errors.As(res.Err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got %+v, want the 429 error", res)
+	}
+	srv.AssertRequests(t, 2)
+}
+
+func TestChatGPTUnknownStreamOptions(t *testing.T) {
+	srv := bigmodeltest.NewServer(
+		bigmodeltest.Fail(http.StatusBadRequest, "Unrecognized request argument supplied: stream_options"),
+		bigmodeltest.Reply("ok"),
+		bigmodeltest.Reply("again"),
+	)
+	defer srv.Close()
+
+	gpt := srv.ChatGPT()
+	content, rest := collect(t, gpt.Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if content != "ok" || last(t, rest).Type != bigmodel.TypeDone {
+		t.Fatalf("got content %q and %+v", content, rest)
+	}
+	if content, _ := collect(t, gpt.Chat(bigmodel.Messages(bigmodel.UserMessage("hi")))); content != "again" {
+		t.Fatalf("got content %q of the second chat", content)
+	}
+	reqs := srv.AssertRequests(t, 3)
+	if _, ok := reqs[0].Body["stream_options"]; !ok {
+		t.Error("the first request has no stream_options")
+	}
+	for _, req := range reqs[1:] {
+		if _, ok := req.Body["stream_options"]; ok {
+			t.Error("stream_options sent again after the backend rejected them")
+		}
+	}
+}
+
+func TestChatGPTMalformedChunk(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Malformed("partial"), bigmodeltest.Reply("unused"))
+	defer srv.Close()
+
+	content, rest := collect(t, srv.ChatGPT().Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if res := last(t, rest); content != "partial" || res.Type != bigmodel.TypeError {
+		t.Fatalf("got content %q and %+v, want the content followed by an error", content, res)
+	}
+	// the answer has begun, so it is not retried
+	srv.AssertRequests(t, 1)
+}
+
+func TestChatGPTDisconnect(t *testing.T) {
+	t.Run("before the answer", func(t *testing.T) {
+		srv := bigmodeltest.NewServer(bigmodeltest.Disconnect(), bigmodeltest.Reply("ok"))
+		defer srv.Close()
+
+		content, rest := collect(t, srv.ChatGPT().Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+		if content != "ok" || last(t, rest).Type != bigmodel.TypeDone {
+			t.Fatalf("got content %q and %+v, want the retried answer", content, rest)
+		}
+		srv.AssertRequests(t, 2)
+	})
+	t.Run("in the middle of the answer", func(t *testing.T) {
+		srv := bigmodeltest.NewServer(bigmodeltest.Disconnect("half of"), bigmodeltest.Reply("unused"))
+		defer srv.Close()
+
+		content, rest := collect(t, srv.ChatGPT().Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+		if res := last(t, rest); content != "half of" || res.Type != bigmodel.TypeError {
+			t.Fatalf("got content %q and %+v, want the content followed by an error", content, res)
+		}
+		srv.AssertRequests(t, 1)
+	})
+}
+
+func TestChatGPTToolCalls(t *testing.T) {
+	calls := []*bigmodel.ToolCall{
+		{ID: "call_1", Name: "read_function", Arguments: `{"file":"main.go","function":"Div"}`},
+		{ID: "call_2", Name: "git_log", Arguments: `{"file":"math.go"}`},
+	}
+	srv := bigmodeltest.NewServer(bigmodeltest.CallTools(calls...))
+	defer srv.Close()
+
+	tools := []*bigmodel.Tool{{Name: "read_function"}, {Name: "git_log"}}
+	bm := srv.ChatGPT().(bigmodel.ToolBigModel)
+	content, rest := collect(t, bm.ChatTools(context.Background(), bigmodel.Messages(bigmodel.UserMessage("hi")), tools))
+	var got []*bigmodel.ToolCall
+	for _, res := range rest {
+		if res.Type == bigmodel.TypeToolCall {
+			got = res.ToolCalls
+		}
+	}
+	if content != "" || last(t, rest).Type != bigmodel.TypeDone {
+		t.Fatalf("got content %q and %+v, want the tool calls and done", content, rest)
+	}
+	if len(got) != len(calls) {
+		t.Fatalf("got %d tool calls, want %d", len(got), len(calls))
+	}
+	for i, call := range calls {
+		if *got[i] != *call {
+			t.Errorf("tool call %d is %+v, want %+v", i, got[i], call)
+		}
+	}
+
+	req := srv.AssertRequests(t, 1)[0]
+	if len(req.Tools) != 2 || req.Tools[0].Name != "read_function" {
+		t.Errorf("tools sent are %+v", req.Tools)
+	}
+}
+
+func TestFakeServerUnknownPath(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Reply("ok"))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/v1/completions", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status is %d, want 404", resp.StatusCode)
+	}
+	// the scripted response is still answered to the next request
+	content, _ := collect(t, srv.ChatGPT().Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if content != "ok" {
+		t.Errorf("content is %q", content)
+	}
+}
+
+func TestChatGPTHeaderOverride(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Reply("ok"))
+	defer srv.Close()
+
+	bm := srv.ChatGPT(bigmodel.WithHeader("authorization", "Bearer proxy-token"), bigmodel.WithHeader("X-Proxy", "on"))
+	collect(t, bm.Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+
+	req := srv.AssertRequests(t, 1)[0]
+	req.AssertHeader(t, "Authorization", "Bearer proxy-token")
+	req.AssertHeader(t, "X-Proxy", "on")
+	req.AssertHeader(t, "Content-Type", "application/json")
+}
+
+func TestChatGPTEmbed(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Raw("/v1/embeddings", http.StatusOK, "application/json",
+		`{"data":[{"index":1,"embedding":[0,1]},{"index":0,"embedding":[1,0]}],"usage":{"prompt_tokens":8,"total_tokens":8}}`))
+	defer srv.Close()
+
+	if _, err := bigmodel.Embed(context.Background(), srv.ChatGPT(), []string{"a"}); !errors.Is(err, bigmodel.ErrNoEmbeddings) {
+		t.Fatalf("got %v without an embedding model, want ErrNoEmbeddings", err)
+	}
+	srv.AssertRequests(t, 0)
+
+	meter := new(bigmodel.Meter)
+	bm := bigmodel.Metered(srv.ChatGPT(bigmodel.WithEmbeddingModel("text-embedding-3-small")), meter)
+	e, err := bigmodel.Embed(context.Background(), bm, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Model != "openai/text-embedding-3-small" || len(e.Vectors) != 2 || e.Vectors[0][0] != 1 || e.Vectors[1][1] != 1 {
+		t.Errorf("embeddings are %+v", e)
+	}
+	req := srv.AssertRequests(t, 1)[0]
+	req.AssertField(t, "model", "text-embedding-3-small")
+	req.AssertField(t, "input", []string{"a", "b"})
+	if usage := meter.Usage(); len(usage) != 1 || usage[0].Model != "text-embedding-3-small" || usage[0].PromptTokens != 8 {
+		t.Errorf("metered %+v, want the tokens of the embeddings", usage)
+	}
+}
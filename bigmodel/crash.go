@@ -0,0 +1,50 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import "context"
+
+// Crash what is known locally of the crash being diagnosed
+type Crash struct {
+	Panic string
+	// Hints the findings of the local heuristics
+	Hints []*Hint
+}
+
+// Hint a finding of the local heuristics at a line of the source
+type Hint struct {
+	File    string
+	Line    int
+	Message string
+}
+
+type crashKey struct{}
+
+// WithCrash tell the big models what is known locally of the crash diagnosed in the requests made with the context,
+// the ones answering without a model, such as Offline, answer from it instead of the prompt
+func WithCrash(ctx context.Context, crash *Crash) context.Context {
+	return context.WithValue(ctx, crashKey{}, crash)
+}
+
+// CrashOf the crash diagnosed, nil if it is not known
+func CrashOf(ctx context.Context) *Crash {
+	crash, _ := ctx.Value(crashKey{}).(*Crash)
+	return crash
+}
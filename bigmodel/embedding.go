@@ -0,0 +1,72 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ahaostudy/code-diagnostic/utils"
+)
+
+// ErrNoEmbeddings the big model does not provide embeddings
+var ErrNoEmbeddings = errors.New("the big model does not provide embeddings")
+
+// Embeddings the vectors of the texts in order, the vectors of different models cannot be compared
+type Embeddings struct {
+	// Model the backend and model the vectors are from, such as "openai/text-embedding-3-small"
+	Model   string
+	Vectors [][]float32
+	// Usage the tokens of the texts, nil if the backend does not report them
+	Usage *Usage
+}
+
+// Embedder optional interface of BigModel embedding texts, such as to find similar incidents
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) (*Embeddings, error)
+}
+
+// Embed embed the texts with the big model, ErrNoEmbeddings if it does not provide embeddings
+func Embed(ctx context.Context, bm BigModel, texts []string) (*Embeddings, error) {
+	if e, ok := bm.(Embedder); ok {
+		return e.Embed(ctx, texts)
+	}
+	return nil, ErrNoEmbeddings
+}
+
+// postJSON send the request and decode the json response into v
+func postJSON(ctx context.Context, req *utils.Request, v interface{}) error {
+	req.SetHeader("Content-Type", "application/json")
+	resp, err := req.POSTWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return newAPIError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("response data error: %w", err)
+	}
+	return nil
+}
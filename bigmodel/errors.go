@@ -0,0 +1,239 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// APIError an error response of the big model api
+type APIError struct {
+	StatusCode int    `json:"status_code"`
+	Code       string `json:"code"`
+	Type       string `json:"type"`
+	Message    string `json:"message"`
+
+	// RetryAfter how long the api asked to wait before retrying, 0 if not specified
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("api error %d", e.StatusCode)
+	if e.Type != "" {
+		msg += " " + e.Type
+	}
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Retryable report whether the request may succeed if it is sent again
+func (e *APIError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// errorCode an error code or status that is a string in some apis and a number in others
+type errorCode string
+
+func (c *errorCode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*c = errorCode(s)
+		return nil
+	}
+	*c = errorCode(strings.Trim(string(data), `"`))
+	if *c == "null" {
+		*c = ""
+	}
+	return nil
+}
+
+// errorBody the error of an error response, either {"message", "type", "code"} or only the message,
+// google apis report the type as status and the retry delay in the details
+type errorBody struct {
+	Message string    `json:"message"`
+	Type    string    `json:"type"`
+	Code    errorCode `json:"code"`
+	Status  errorCode `json:"status"`
+	Details []struct {
+		RetryDelay string `json:"retryDelay"`
+	} `json:"details"`
+	// InnerError azure reports the reason of content filter errors here
+	InnerError struct {
+		Code string `json:"code"`
+	} `json:"innererror"`
+}
+
+func (e *errorBody) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &e.Message); err == nil {
+		return nil
+	}
+	type plain errorBody
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+// newAPIError decode the error response in the shape {"error": {"message", "type", "code"}} or {"error": "message"},
+// or {"statusCode", "message"} of the azure gateway
+func newAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: retryAfter(resp.Header),
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	data := new(struct {
+		Error   errorBody `json:"error"`
+		Message string    `json:"message"`
+	})
+	err := json.Unmarshal(body, data)
+	if data.Error.Message == "" {
+		data.Error.Message = data.Message
+	}
+	if err == nil && data.Error.Message != "" {
+		apiErr.Message = data.Error.Message
+		apiErr.Type = data.Error.Type
+		if apiErr.Type == "" {
+			apiErr.Type = data.Error.InnerError.Code
+		}
+		if apiErr.Type == "" {
+			apiErr.Type = string(data.Error.Status)
+		}
+		apiErr.Code = string(data.Error.Code)
+		for _, detail := range data.Error.Details {
+			if d, err := time.ParseDuration(detail.RetryDelay); err == nil && apiErr.RetryAfter == 0 {
+				apiErr.RetryAfter = d
+			}
+		}
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
+
+// retryAfter parse the Retry-After header, in seconds or as an http date
+func retryAfter(header http.Header) time.Duration {
+	if ms, err := strconv.Atoi(header.Get("Retry-After-Ms")); err == nil {
+		return time.Duration(ms) * time.Millisecond
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(value); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// retryableError report whether the request failed before reaching the api or the connection was reset
+func retryableError(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryPolicy exponential backoff of retried requests
+type retryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	maxRetries: 3,
+	baseDelay:  500 * time.Millisecond,
+	maxDelay:   30 * time.Second,
+}
+
+// delay how long to wait before the retry, the Retry-After of the api takes precedence
+func (p retryPolicy) delay(attempt int, err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		if apiErr.RetryAfter > p.maxDelay {
+			return p.maxDelay
+		}
+		return apiErr.RetryAfter
+	}
+	d := p.baseDelay << attempt
+	if d <= 0 || d > p.maxDelay {
+		d = p.maxDelay
+	}
+	// add up to 50% jitter so that clients do not retry in lockstep
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// stream run the streaming request in the background and retry it by the policy,
+// the request reports whether any data was sent so that it is not retried once the answer has begun
+func (p retryPolicy) stream(ctx context.Context, name string, request func(ctx context.Context, out chan Result) (streamed bool, err error)) chan Result {
+	out := make(chan Result)
+
+	go func() {
+		defer close(out)
+		for attempt := 0; ; attempt++ {
+			streamed, err := request(ctx, out)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			if streamed || attempt >= p.maxRetries || !retryableError(err) {
+				Send(ctx, out, Result{Type: TypeError, Content: err.Error(), Err: err})
+				return
+			}
+			delay := p.delay(attempt, err)
+			log.Printf("%s request failed, retry in %v: %v", name, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,43 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import "time"
+
+// SetRetry change the retry policy of the big model, so that the tests do not wait
+func SetRetry(bm BigModel, maxRetries int, baseDelay, maxDelay time.Duration) {
+	policy := retryPolicy{maxRetries: maxRetries, baseDelay: baseDelay, maxDelay: maxDelay}
+	switch m := bm.(type) {
+	case *ChatGPT:
+		m.retry = policy
+	case *Azure:
+		m.retry = policy
+	case *LlamaCpp:
+		m.gpt.retry = policy
+	case *Anthropic:
+		m.retry = policy
+	case *Gemini:
+		m.retry = policy
+	case *Ollama:
+		m.retry = policy
+	default:
+		panic("SetRetry: unknown big model")
+	}
+}
@@ -0,0 +1,410 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/ahaostudy/code-diagnostic/sse"
+	"github.com/ahaostudy/code-diagnostic/utils"
+)
+
+// Gemini big model of the Google Gemini api
+type Gemini struct {
+	model     string
+	maxTokens int
+	baseURL   string
+	apiKey    string
+	retry     retryPolicy
+	// embeddingModel the model of Embed
+	embeddingModel string
+}
+
+func NewGemini(apiKey string, opts ...GeminiOption) BigModel {
+	g := &Gemini{
+		model:          "gemini-2.5-flash",
+		baseURL:        "https://generativelanguage.googleapis.com",
+		apiKey:         apiKey,
+		retry:          defaultRetryPolicy,
+		embeddingModel: "gemini-embedding-001",
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	g.baseURL = strings.TrimSuffix(g.baseURL, "/")
+	return g
+}
+
+type GeminiOption func(*Gemini)
+
+// WithGeminiModel specify Gemini model
+func WithGeminiModel(model string) GeminiOption {
+	return func(g *Gemini) {
+		g.model = model
+	}
+}
+
+// WithGeminiMaxTokens specify the maximum number of tokens of the answer, the model default if 0
+func WithGeminiMaxTokens(n int) GeminiOption {
+	return func(g *Gemini) {
+		g.maxTokens = n
+	}
+}
+
+// WithGeminiBaseURL specify Gemini API base url
+func WithGeminiBaseURL(url string) GeminiOption {
+	return func(g *Gemini) {
+		g.baseURL = url
+	}
+}
+
+func (g *Gemini) ContextWindow() int {
+	if strings.HasPrefix(g.model, "gemini-") {
+		return 1048576
+	}
+	return 0
+}
+
+// WithGeminiEmbeddingModel specify the model of Embed, gemini-embedding-001 by default
+func WithGeminiEmbeddingModel(model string) GeminiOption {
+	return func(g *Gemini) {
+		g.embeddingModel = model
+	}
+}
+
+func (g *Gemini) Embed(ctx context.Context, texts []string) (*Embeddings, error) {
+	model := "models/" + g.embeddingModel
+	requests := make([]interface{}, len(texts))
+	for i, text := range texts {
+		requests[i] = map[string]interface{}{
+			"model":   model,
+			"content": &geminiContent{Parts: []*geminiPart{{Text: text}}},
+		}
+	}
+	req := utils.NewRequest(fmt.Sprintf("%s/v1beta/%s:batchEmbedContents", g.baseURL, model))
+	req.SetData(map[string]interface{}{"requests": requests})
+	req.SetHeader("x-goog-api-key", g.apiKey)
+	body := new(struct {
+		Embeddings []struct {
+			Values []float32 `json:"values"`
+		} `json:"embeddings"`
+	})
+	if err := postJSON(ctx, req, body); err != nil {
+		return nil, fmt.Errorf("gemini embeddings request failed: %w", err)
+	}
+	e := &Embeddings{Model: "gemini/" + g.embeddingModel, Vectors: make([][]float32, len(body.Embeddings))}
+	for i, embedding := range body.Embeddings {
+		e.Vectors[i] = embedding.Values
+	}
+	return e, nil
+}
+
+func (g *Gemini) Fingerprint() string {
+	return fmt.Sprintf("gemini %s %s %d", g.baseURL, g.model, g.maxTokens)
+}
+
+func (g *Gemini) Chat(messages []*Message) chan Result {
+	return g.ChatContext(context.Background(), messages)
+}
+
+func (g *Gemini) ChatContext(ctx context.Context, messages []*Message) chan Result {
+	return g.ChatTools(ctx, messages, nil)
+}
+
+func (g *Gemini) ChatTools(ctx context.Context, messages []*Message, tools []*Tool) chan Result {
+	return g.retry.stream(ctx, "gemini", func(ctx context.Context, out chan Result) (bool, error) {
+		return g.chat(ctx, messages, tools, out)
+	})
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiFunctionCall struct {
+	// ID the id of the call, only some models send one
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// geminiFunctionResponse the result of a call, matched with the call by name
+type geminiFunctionResponse struct {
+	Name     string            `json:"name"`
+	Response map[string]string `json:"response"`
+}
+
+type geminiContent struct {
+	Role  string        `json:"role,omitempty"`
+	Parts []*geminiPart `json:"parts"`
+}
+
+// geminiChunk a streamed GenerateContentResponse, only the fields in use are decoded
+type geminiChunk struct {
+	Candidates []struct {
+		Content       geminiContent `json:"content"`
+		FinishReason  string        `json:"finishReason"`
+		SafetyRatings []struct {
+			Category string `json:"category"`
+			Blocked  bool   `json:"blocked"`
+		} `json:"safetyRatings"`
+	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	// UsageMetadata the usage so far, the last chunk holds the total
+	UsageMetadata *struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+		ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
+	} `json:"usageMetadata"`
+	Error *errorBody `json:"error"`
+}
+
+// geminiBlocked the finish reasons of answers stopped by the safety filters or policies
+var geminiBlocked = map[string]bool{
+	"SAFETY":             true,
+	"RECITATION":         true,
+	"BLOCKLIST":          true,
+	"PROHIBITED_CONTENT": true,
+	"SPII":               true,
+}
+
+// geminiContents translate the messages, the assistant role is called model
+// and the system messages are moved to the system instruction.
+// The tool calls are sent as functionCall parts and their results as functionResponse parts of a user content.
+func geminiContents(messages []*Message) (system *geminiContent, contents []*geminiContent) {
+	sys, msgs := splitSystem(messages)
+	if sys != "" {
+		system = &geminiContent{Parts: []*geminiPart{{Text: sys}}}
+	}
+	names := toolNames(msgs)
+	for _, msg := range msgs {
+		if msg.Role == RoleTool {
+			part := &geminiPart{FunctionResponse: &geminiFunctionResponse{
+				Name:     names[msg.ToolCallID],
+				Response: map[string]string{"content": msg.Content},
+			}}
+			// the results of the calls of a message are sent in a single content
+			if n := len(contents); n > 0 && contents[n-1].Parts[0].FunctionResponse != nil {
+				contents[n-1].Parts = append(contents[n-1].Parts, part)
+				continue
+			}
+			contents = append(contents, &geminiContent{Role: RoleUser, Parts: []*geminiPart{part}})
+			continue
+		}
+		role := msg.Role
+		if role == RoleAssistant {
+			role = "model"
+		}
+		content := &geminiContent{Role: role}
+		if msg.Content != "" || len(msg.ToolCalls) == 0 {
+			content.Parts = append(content.Parts, &geminiPart{Text: msg.Content})
+		}
+		for _, call := range msg.ToolCalls {
+			content.Parts = append(content.Parts, &geminiPart{FunctionCall: &geminiFunctionCall{Name: call.Name, Args: call.arguments()}})
+		}
+		contents = append(contents, content)
+	}
+	return system, contents
+}
+
+// geminiTools the tools as the function declarations of the Gemini api
+func geminiTools(tools []*Tool) []map[string]interface{} {
+	decls := make([]map[string]interface{}, len(tools))
+	for i, tool := range tools {
+		decls[i] = map[string]interface{}{"name": tool.Name, "description": tool.Description, "parametersJsonSchema": tool.Parameters}
+	}
+	return []map[string]interface{}{{"functionDeclarations": decls}}
+}
+
+// chat send a single request and stream the answer into out,
+// streamed reports whether any data was sent so that the request can no longer be retried
+func (g *Gemini) chat(ctx context.Context, messages []*Message, tools []*Tool, out chan Result) (streamed bool, err error) {
+	system, contents := geminiContents(messages)
+	data := map[string]interface{}{
+		"contents": contents,
+	}
+	if system != nil {
+		data["systemInstruction"] = system
+	}
+	if len(tools) > 0 {
+		data["tools"] = geminiTools(tools)
+	}
+	config := make(map[string]interface{})
+	if g.maxTokens > 0 {
+		config["maxOutputTokens"] = g.maxTokens
+	}
+	if schema := SchemaOf(ctx); schema != nil {
+		config["responseMimeType"] = "application/json"
+		config["responseJsonSchema"] = schema.Schema
+	}
+	if len(config) > 0 {
+		data["generationConfig"] = config
+	}
+
+	req := utils.NewRequest(fmt.Sprintf("%s/v1beta/models/%s:streamGenerateContent?alt=sse", g.baseURL, g.model))
+	req.SetData(data)
+	req.SetHeader("x-goog-api-key", g.apiKey)
+	req.SetHeader("Content-Type", "application/json")
+
+	resp, err := req.POSTWithContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("gemini request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// quota errors are 429 RESOURCE_EXHAUSTED, retried after the delay in their details
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, newAPIError(resp)
+	}
+
+	// the answer is streamed as server-sent events with alt=sse, or as a JSON array otherwise
+	next := geminiArray(json.NewDecoder(resp.Body))
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct == "text/event-stream" {
+		next = geminiEvents(sse.NewDecoder(resp.Body))
+	}
+
+	var usage *Usage
+	var calls []*ToolCall
+	for {
+		data, err := next()
+		if err == io.EOF {
+			if len(calls) > 0 && !Send(ctx, out, Result{Type: TypeToolCall, ToolCalls: calls}) {
+				return streamed, ctx.Err()
+			}
+			if usage != nil && !Send(ctx, out, Result{Type: TypeUsage, Usage: usage}) {
+				return streamed, ctx.Err()
+			}
+			Send(ctx, out, Result{Type: TypeDone})
+			return streamed, nil
+		}
+		if err != nil {
+			return streamed, err
+		}
+
+		if data.Error != nil {
+			return streamed, &APIError{
+				StatusCode: resp.StatusCode,
+				Code:       string(data.Error.Code),
+				Type:       string(data.Error.Status),
+				Message:    data.Error.Message,
+			}
+		}
+		if u := data.UsageMetadata; u != nil {
+			usage = &Usage{
+				Model:            g.model,
+				PromptTokens:     u.PromptTokenCount,
+				CompletionTokens: u.CandidatesTokenCount + u.ThoughtsTokenCount,
+			}
+		}
+		if data.PromptFeedback != nil && data.PromptFeedback.BlockReason != "" {
+			return streamed, &APIError{
+				StatusCode: resp.StatusCode,
+				Type:       "blocked",
+				Code:       data.PromptFeedback.BlockReason,
+				Message:    "the prompt was blocked by gemini",
+			}
+		}
+		if len(data.Candidates) == 0 {
+			continue
+		}
+		candidate := data.Candidates[0]
+		for _, part := range candidate.Content.Parts {
+			if fc := part.FunctionCall; fc != nil {
+				call := &ToolCall{ID: fc.ID, Name: fc.Name, Arguments: string(fc.Args)}
+				if call.ID == "" {
+					call.ID = callID(fc.Name, len(calls))
+				}
+				calls = append(calls, call)
+				continue
+			}
+			if part.Text == "" {
+				continue
+			}
+			if !Send(ctx, out, Result{Type: TypeData, Content: part.Text}) {
+				return true, ctx.Err()
+			}
+			streamed = true
+		}
+		if geminiBlocked[candidate.FinishReason] {
+			msg := "the answer was blocked by gemini"
+			for _, rating := range candidate.SafetyRatings {
+				if rating.Blocked {
+					msg += ": " + rating.Category
+				}
+			}
+			return streamed, &APIError{
+				StatusCode: resp.StatusCode,
+				Type:       "blocked",
+				Code:       candidate.FinishReason,
+				Message:    msg,
+			}
+		}
+	}
+}
+
+// geminiEvents read the chunks of the server-sent events
+func geminiEvents(dec *sse.Decoder) func() (*geminiChunk, error) {
+	return func() (*geminiChunk, error) {
+		ev, err := dec.Next()
+		if err != nil {
+			return nil, err
+		}
+		data := new(geminiChunk)
+		if err := json.Unmarshal([]byte(ev.Data), data); err != nil {
+			return nil, fmt.Errorf("response data error: %w", err)
+		}
+		return data, nil
+	}
+}
+
+// geminiArray read the chunks of the JSON array as they arrive
+func geminiArray(dec *json.Decoder) func() (*geminiChunk, error) {
+	started := false
+	return func() (*geminiChunk, error) {
+		if !started {
+			if tok, err := dec.Token(); err != nil {
+				return nil, err
+			} else if tok != json.Delim('[') {
+				return nil, fmt.Errorf("response data error: unexpected %v", tok)
+			}
+			started = true
+		}
+		if !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return nil, fmt.Errorf("response data error: %w", err)
+			}
+			return nil, io.EOF
+		}
+		data := new(geminiChunk)
+		if err := dec.Decode(data); err != nil {
+			return nil, fmt.Errorf("response data error: %w", err)
+		}
+		return data, nil
+	}
+}
@@ -0,0 +1,174 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/bigmodel/bigmodeltest"
+)
+
+const geminiPath = "/v1beta/models/gemini-test:streamGenerateContent"
+
+func newTestGemini(srv *bigmodeltest.Server) bigmodel.BigModel {
+	g := bigmodel.NewGemini("g-test", bigmodel.WithGeminiBaseURL(srv.URL), bigmodel.WithGeminiModel("gemini-test"))
+	bigmodel.SetRetry(g, 3, time.Millisecond, 10*time.Millisecond)
+	return g
+}
+
+var geminiChunks = []string{
+	`{"candidates":[{"content":{"role":"model","parts":[{"text":"Hello"}]}}],"usageMetadata":{"promptTokenCount":11}}`,
+	`{"candidates":[{"content":{"role":"model","parts":[{"text":", world"}]},"finishReason":"STOP"}],` +
+		`"usageMetadata":{"promptTokenCount":11,"candidatesTokenCount":4,"thoughtsTokenCount":2}}`,
+}
+
+func TestGeminiStream(t *testing.T) {
+	for name, resp := range map[string]*bigmodeltest.Response{
+		"sse":        bigmodeltest.Events(geminiPath, geminiChunks...),
+		"json array": bigmodeltest.Raw(geminiPath, http.StatusOK, "application/json", "["+geminiChunks[0]+",\r\n"+geminiChunks[1]+"]"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := bigmodeltest.NewServer(resp)
+			defer srv.Close()
+			content, rest := collect(t, newTestGemini(srv).Chat(bigmodel.Messages(bigmodel.SystemMessage("be brief"), bigmodel.UserMessage("hi"))))
+			if content != "Hello, world" {
+				t.Errorf("content is %q", content)
+			}
+			usage := resultOf(rest, bigmodel.TypeUsage)
+			if usage == nil || usage.Usage.PromptTokens != 11 || usage.Usage.CompletionTokens != 6 {
+				t.Fatalf("usage is %+v, want 11 prompt and 6 completion tokens of the last chunk", usage)
+			}
+			if last(t, rest).Type != bigmodel.TypeDone {
+				t.Errorf("the stream ended with %+v", last(t, rest))
+			}
+
+			req := srv.AssertRequests(t, 1)[0]
+			req.AssertHeader(t, "x-goog-api-key", "g-test")
+			req.AssertField(t, "systemInstruction", map[string]interface{}{"parts": []map[string]string{{"text": "be brief"}}})
+			req.AssertField(t, "contents", []map[string]interface{}{{"role": "user", "parts": []map[string]string{{"text": "hi"}}}})
+		})
+	}
+}
+
+func TestGeminiResourceExhausted(t *testing.T) {
+	exhausted := func() *bigmodeltest.Response {
+		return bigmodeltest.Raw(geminiPath, http.StatusTooManyRequests, "application/json",
+			`{"error":{"code":429,"message":"Resource has been exhausted.","status":"RESOURCE_EXHAUSTED",`+
+				`"details":[{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"0.005s"}]}}`)
+	}
+
+	t.Run("retry after the delay", func(t *testing.T) {
+		srv := bigmodeltest.NewServer(exhausted(), bigmodeltest.Events(geminiPath, geminiChunks...))
+		defer srv.Close()
+		g := newTestGemini(srv)
+		// the backoff is a minute, so the answer only comes in time if the retry delay of the error is taken
+		bigmodel.SetRetry(g, 1, time.Minute, time.Minute)
+		content, rest := collect(t, g.Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+		if content != "Hello, world" || last(t, rest).Type != bigmodel.TypeDone {
+			t.Fatalf("got content %q and %+v, want the retried answer", content, rest)
+		}
+		srv.AssertRequests(t, 2)
+	})
+	t.Run("give up", func(t *testing.T) {
+		srv := bigmodeltest.NewServer(exhausted(), exhausted())
+		defer srv.Close()
+		g := newTestGemini(srv)
+		bigmodel.SetRetry(g, 1, time.Millisecond, 10*time.Millisecond)
+		_, rest := collect(t, g.Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+		var apiErr *bigmodel.APIError
+		if res := resultOf(rest, bigmodel.TypeError); res == nil || !errors.As(res.Err, &apiErr) {
+			t.Fatalf("got %+v, want an *APIError", rest)
+		}
+		if apiErr.StatusCode != http.StatusTooManyRequests || apiErr.Type != "RESOURCE_EXHAUSTED" || apiErr.RetryAfter != 5*time.Millisecond {
+			t.Errorf("error is %+v", apiErr)
+		}
+		srv.AssertRequests(t, 2)
+	})
+}
+
+func TestGeminiBlocked(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Events(geminiPath,
+		`{"candidates":[{"content":{"parts":[]},"finishReason":"SAFETY",`+
+			`"safetyRatings":[{"category":"HARM_CATEGORY_DANGEROUS_CONTENT","blocked":true}]}]}`,
+	))
+	defer srv.Close()
+	_, rest := collect(t, newTestGemini(srv).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	var apiErr *bigmodel.APIError
+	if res := resultOf(rest, bigmodel.TypeError); res == nil || !errors.As(res.Err, &apiErr) || apiErr.Code != "SAFETY" {
+		t.Fatalf("got %+v, want the answer blocked for safety", rest)
+	}
+}
+
+func TestGeminiToolCalls(t *testing.T) {
+	srv := bigmodeltest.NewServer(
+		bigmodeltest.Events(geminiPath,
+			`{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"read_file","args":{"file":"main.go"}}},`+
+				`{"functionCall":{"name":"git_log","args":{"file":"main.go"}}}]},"finishReason":"STOP"}]}`,
+		),
+		bigmodeltest.Events(geminiPath, geminiChunks...),
+	)
+	defer srv.Close()
+
+	g := newTestGemini(srv).(bigmodel.ToolBigModel)
+	tools := []*bigmodel.Tool{
+		{Name: "read_file", Description: "read a file", Parameters: map[string]interface{}{"type": "object"}},
+		{Name: "git_log", Description: "list the commits", Parameters: map[string]interface{}{"type": "object"}},
+	}
+	messages := bigmodel.Messages(bigmodel.UserMessage("why?"))
+	_, rest := collect(t, g.ChatTools(context.Background(), messages, tools))
+	res := resultOf(rest, bigmodel.TypeToolCall)
+	if res == nil || len(res.ToolCalls) != 2 || last(t, rest).Type != bigmodel.TypeDone {
+		t.Fatalf("got %+v, want two tool calls", rest)
+	}
+	if call := res.ToolCalls[0]; call.ID == "" || call.ID == res.ToolCalls[1].ID || call.Name != "read_file" || call.Arguments != `{"file":"main.go"}` {
+		t.Errorf("tool calls are %+v and %+v", call, res.ToolCalls[1])
+	}
+
+	// the results are sent back in a single content, matched with the calls by name
+	messages = append(messages,
+		&bigmodel.Message{Role: bigmodel.RoleAssistant, ToolCalls: res.ToolCalls},
+		bigmodel.ToolMessage(res.ToolCalls[0].ID, "package main"),
+		bigmodel.ToolMessage(res.ToolCalls[1].ID, "no commits found"),
+	)
+	if content, _ := collect(t, g.ChatTools(context.Background(), messages, tools)); content != "Hello, world" {
+		t.Fatalf("content is %q", content)
+	}
+	reqs := srv.AssertRequests(t, 2)
+	reqs[0].AssertField(t, "tools", []map[string]interface{}{{"functionDeclarations": []map[string]interface{}{
+		{"name": "read_file", "description": "read a file", "parametersJsonSchema": map[string]string{"type": "object"}},
+		{"name": "git_log", "description": "list the commits", "parametersJsonSchema": map[string]string{"type": "object"}},
+	}}})
+	reqs[1].AssertField(t, "contents", []map[string]interface{}{
+		{"role": "user", "parts": []map[string]string{{"text": "why?"}}},
+		{"role": "model", "parts": []map[string]interface{}{
+			{"functionCall": map[string]interface{}{"name": "read_file", "args": map[string]string{"file": "main.go"}}},
+			{"functionCall": map[string]interface{}{"name": "git_log", "args": map[string]string{"file": "main.go"}}},
+		}},
+		{"role": "user", "parts": []map[string]interface{}{
+			{"functionResponse": map[string]interface{}{"name": "read_file", "response": map[string]string{"content": "package main"}}},
+			{"functionResponse": map[string]interface{}{"name": "git_log", "response": map[string]string{"content": "no commits found"}}},
+		}},
+	})
+}
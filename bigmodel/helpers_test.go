@@ -0,0 +1,71 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+)
+
+// collect the results of the stream until it is closed
+func collect(t *testing.T, results chan bigmodel.Result) (content string, rest []bigmodel.Result) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var buf strings.Builder
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				return buf.String(), rest
+			}
+			if res.Type == bigmodel.TypeData {
+				buf.WriteString(res.Content)
+				continue
+			}
+			rest = append(rest, res)
+		case <-ctx.Done():
+			t.Fatal("the stream was not closed")
+		}
+	}
+}
+
+// last the last result of the stream, which is TypeDone or TypeError
+func last(t *testing.T, rest []bigmodel.Result) bigmodel.Result {
+	t.Helper()
+	if len(rest) == 0 {
+		t.Fatal("the stream ended without a result")
+	}
+	return rest[len(rest)-1]
+}
+
+// resultOf the first result of the type, nil if there is none
+func resultOf(rest []bigmodel.Result, typ int) *bigmodel.Result {
+	for i := range rest {
+		if rest[i].Type == typ {
+			return &rest[i]
+		}
+	}
+	return nil
+}
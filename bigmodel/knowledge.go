@@ -0,0 +1,224 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import "regexp"
+
+// Knowledge a common cause of a go panic or error and how to fix it
+type Knowledge struct {
+	Title   string
+	Pattern *regexp.Regexp
+	Causes  []string
+	Fixes   []string
+}
+
+// KnowledgeBase the curated knowledge of the offline big model, matched in order
+var KnowledgeBase = []*Knowledge{
+	{
+		Title:   "Integer divide by zero",
+		Pattern: regexp.MustCompile(`integer divide by zero`),
+		Causes: []string{
+			"The divisor of a `/` or `%` operation on integers is zero.",
+			"The divisor usually comes from a parameter, a configuration value or a length that can be zero.",
+		},
+		Fixes: []string{
+			"Check the divisor before dividing and return an error instead: `if b == 0 { return 0, errors.New(\"division by zero\") }`.",
+			"Validate the value where it enters the program, such as when parsing configuration or input.",
+		},
+	},
+	{
+		Title:   "Assignment to entry in nil map",
+		Pattern: regexp.MustCompile(`assignment to entry in nil map`),
+		Causes: []string{
+			"A map declared with `var m map[K]V` or a map field of a struct is nil until it is created with `make`.",
+			"Reading a nil map is allowed, writing to it panics.",
+		},
+		Fixes: []string{
+			"Initialize the map with `make(map[K]V)` or a composite literal before writing to it.",
+			"Initialize map fields in the constructor of the struct, or lazily: `if s.m == nil { s.m = make(map[K]V) }`.",
+		},
+	},
+	{
+		Title:   "Nil pointer dereference",
+		Pattern: regexp.MustCompile(`nil pointer dereference|invalid memory address`),
+		Causes: []string{
+			"A field or method of a nil pointer is accessed, or a nil pointer is dereferenced with `*`.",
+			"Common sources are ignored errors (`v, _ := f()`), missing map entries of pointer type, uninitialized struct fields and nil interfaces holding nil pointers.",
+		},
+		Fixes: []string{
+			"Handle the error returned together with the pointer instead of ignoring it.",
+			"Check the pointer for nil before using it, or make the constructor guarantee it is never nil.",
+		},
+	},
+	{
+		Title:   "Index out of range",
+		Pattern: regexp.MustCompile(`index out of range`),
+		Causes: []string{
+			"A slice, array or string is indexed with a value that is negative or not less than its length.",
+			"Off-by-one loops (`i <= len(s)`) and assuming a non-empty result are the usual causes.",
+		},
+		Fixes: []string{
+			"Check the index against `len(s)` before using it.",
+			"Use `for i := range s` or `for i := 0; i < len(s); i++` to iterate.",
+		},
+	},
+	{
+		Title:   "Slice bounds out of range",
+		Pattern: regexp.MustCompile(`slice bounds out of range`),
+		Causes: []string{
+			"A slice expression `s[low:high]` uses a bound greater than the length or capacity, or `low > high`.",
+		},
+		Fixes: []string{
+			"Clamp the bounds: `if high > len(s) { high = len(s) }`, and make sure `low <= high`.",
+		},
+	},
+	{
+		Title:   "Failed type assertion",
+		Pattern: regexp.MustCompile(`interface conversion`),
+		Causes: []string{
+			"A single-value type assertion `x.(T)` panics when the dynamic type of `x` is not `T` or `x` is nil.",
+		},
+		Fixes: []string{
+			"Use the two-value form `v, ok := x.(T)` and handle `!ok`.",
+			"Use a type switch when several types are possible.",
+		},
+	},
+	{
+		Title:   "Send on or close of a closed channel",
+		Pattern: regexp.MustCompile(`send on closed channel|close of closed channel`),
+		Causes: []string{
+			"A channel is closed twice, or a value is sent after the channel was closed, usually by concurrent goroutines.",
+		},
+		Fixes: []string{
+			"Only the sending side should close a channel, and only once; guard it with `sync.Once` if several paths can close it.",
+			"Wait for all senders with a `sync.WaitGroup` before closing the channel.",
+		},
+	},
+	{
+		Title:   "Close of nil channel",
+		Pattern: regexp.MustCompile(`close of nil channel`),
+		Causes: []string{
+			"A channel declared with `var ch chan T` or a channel field is nil until it is created with `make`.",
+		},
+		Fixes: []string{
+			"Create the channel with `make(chan T)` before using it.",
+		},
+	},
+	{
+		Title:   "Negative WaitGroup counter",
+		Pattern: regexp.MustCompile(`negative WaitGroup counter`),
+		Causes: []string{
+			"`Done` is called more times than `Add`, often because `Add` is called inside the goroutine or `Done` is deferred twice.",
+		},
+		Fixes: []string{
+			"Call `wg.Add(n)` before starting the goroutines and `defer wg.Done()` exactly once in each of them.",
+		},
+	},
+	{
+		Title:   "Concurrent map access",
+		Pattern: regexp.MustCompile(`concurrent map (writes|read and map write|iteration and map write)`),
+		Causes: []string{
+			"Go maps are not safe for concurrent use, a map is written by one goroutine while used by another.",
+		},
+		Fixes: []string{
+			"Guard the map with a `sync.Mutex` or `sync.RWMutex`, or use `sync.Map` for append-only caches.",
+		},
+	},
+	{
+		Title:   "Unmarshal into a nil or non-pointer value",
+		Pattern: regexp.MustCompile(`json: Unmarshal\((nil|non-pointer)`),
+		Causes: []string{
+			"`json.Unmarshal` needs a non-nil pointer to write the decoded value into.",
+		},
+		Fixes: []string{
+			"Pass the address of a value: `var v T; json.Unmarshal(data, &v)`.",
+		},
+	},
+	{
+		Title:   "Invalid use of reflect.Value",
+		Pattern: regexp.MustCompile(`reflect: call of .* on zero Value|reflect: .* using unaddressable value`),
+		Causes: []string{
+			"A method is called on the zero `reflect.Value`, such as the result of looking up a missing field, or an unaddressable value is modified.",
+		},
+		Fixes: []string{
+			"Check `v.IsValid()` before using the value, and pass a pointer to `reflect.ValueOf(&x).Elem()` to modify it.",
+		},
+	},
+	{
+		Title:   "Unhashable map key",
+		Pattern: regexp.MustCompile(`hash of unhashable type|comparing uncomparable type`),
+		Causes: []string{
+			"An interface holding a slice, map or function is used as a map key or compared with `==`.",
+		},
+		Fixes: []string{
+			"Use a comparable key such as a string built from the value, or compare with `reflect.DeepEqual`.",
+		},
+	},
+	{
+		Title:   "Invalid slice length",
+		Pattern: regexp.MustCompile(`makeslice: (len|cap) out of range`),
+		Causes: []string{
+			"`make([]T, n)` is called with a negative or huge `n`, usually computed from input.",
+		},
+		Fixes: []string{
+			"Validate the length before calling `make`.",
+		},
+	},
+	{
+		Title:   "No rows in result set",
+		Pattern: regexp.MustCompile(`sql: no rows in result set`),
+		Causes: []string{
+			"`QueryRow(...).Scan` returns `sql.ErrNoRows` when the query matches nothing.",
+		},
+		Fixes: []string{
+			"Handle it explicitly: `if errors.Is(err, sql.ErrNoRows) { ... }`.",
+		},
+	},
+	{
+		Title:   "Context deadline exceeded or canceled",
+		Pattern: regexp.MustCompile(`context deadline exceeded|context canceled`),
+		Causes: []string{
+			"The operation took longer than the deadline of its context, or the caller canceled it.",
+		},
+		Fixes: []string{
+			"Check which context is used and its timeout, and whether the downstream call is slow or blocked.",
+		},
+	},
+	{
+		Title:   "Connection refused",
+		Pattern: regexp.MustCompile(`connection refused`),
+		Causes: []string{
+			"Nothing listens on the address, the service is down or the host and port are wrong.",
+		},
+		Fixes: []string{
+			"Verify the address in the configuration and that the service is running and reachable.",
+		},
+	},
+	{
+		Title:   "Too many open files",
+		Pattern: regexp.MustCompile(`too many open files`),
+		Causes: []string{
+			"Files, sockets or response bodies are not closed and leak file descriptors.",
+		},
+		Fixes: []string{
+			"`defer f.Close()` and `defer resp.Body.Close()` right after checking the error.",
+		},
+	},
+}
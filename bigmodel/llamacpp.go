@@ -0,0 +1,204 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ahaostudy/code-diagnostic/utils"
+)
+
+// LlamaCpp big model served by a local llama.cpp server through its OpenAI compatible endpoint
+type LlamaCpp struct {
+	gpt *ChatGPT
+
+	baseURL string
+	apiKey  string
+	model   string
+	numCtx  int
+	opts    []Option
+
+	// mu guards the availability check, which is done once before the first chat
+	mu    sync.Mutex
+	ready bool
+}
+
+func NewLlamaCpp(opts ...LlamaCppOption) BigModel {
+	l := &LlamaCpp{
+		baseURL: "http://localhost:8080",
+		model:   "local",
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	l.baseURL = strings.TrimSuffix(l.baseURL, "/")
+	gptOpts := append([]Option{WithSpecifyBaseURL(l.baseURL), WithSpecifyModel(l.model)}, l.opts...)
+	l.gpt = NewChatGPT(l.apiKey, gptOpts...).(*ChatGPT)
+	return l
+}
+
+type LlamaCppOption func(*LlamaCpp)
+
+// WithLlamaCppBaseURL specify the url of the llama.cpp server
+func WithLlamaCppBaseURL(url string) LlamaCppOption {
+	return func(l *LlamaCpp) {
+		l.baseURL = url
+	}
+}
+
+// WithLlamaCppAPIKey specify the api key the server was started with by --api-key
+func WithLlamaCppAPIKey(apiKey string) LlamaCppOption {
+	return func(l *LlamaCpp) {
+		l.apiKey = apiKey
+	}
+}
+
+// WithLlamaCppModel specify the model alias sent in the requests, the server answers with its loaded model anyway
+func WithLlamaCppModel(model string) LlamaCppOption {
+	return func(l *LlamaCpp) {
+		l.model = model
+	}
+}
+
+// WithLlamaCppContextSize specify the context size instead of the one reported by the server
+func WithLlamaCppContextSize(n int) LlamaCppOption {
+	return func(l *LlamaCpp) {
+		l.numCtx = n
+	}
+}
+
+// WithLlamaCppOptions apply the ChatGPT options, such as the generation parameters of the requests
+func WithLlamaCppOptions(opts ...Option) LlamaCppOption {
+	return func(l *LlamaCpp) {
+		l.opts = append(l.opts, opts...)
+	}
+}
+
+func (l *LlamaCpp) ContextWindow() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.numCtx > 0 {
+		return l.numCtx
+	}
+	return defaultLocalContext
+}
+
+func (l *LlamaCpp) Fingerprint() string {
+	return "llama.cpp " + l.gpt.Fingerprint()
+}
+
+// Embed embed the texts with the model of the server, which must be started with --embeddings
+func (l *LlamaCpp) Embed(ctx context.Context, texts []string) (*Embeddings, error) {
+	e, err := l.gpt.Embed(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	e.Model = "llama.cpp/" + l.gpt.model
+	return e, nil
+}
+
+// Check check that the server has loaded its model, a 503 *APIError is returned while it is loading.
+// The context size defaults to the context size of a slot of the server.
+func (l *LlamaCpp) Check(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ready {
+		return nil
+	}
+
+	resp, err := l.get(ctx, "/health")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if l.numCtx == 0 {
+		l.numCtx = l.props(ctx)
+	}
+	l.ready = true
+	return nil
+}
+
+// props get the context size of a slot, 0 if the server does not report it
+func (l *LlamaCpp) props(ctx context.Context) int {
+	resp, err := l.get(ctx, "/props")
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+
+	props := new(struct {
+		NCtx                      int `json:"n_ctx"`
+		DefaultGenerationSettings struct {
+			NCtx int `json:"n_ctx"`
+		} `json:"default_generation_settings"`
+	})
+	if err := json.NewDecoder(resp.Body).Decode(props); err != nil {
+		return 0
+	}
+	if props.DefaultGenerationSettings.NCtx > 0 {
+		return props.DefaultGenerationSettings.NCtx
+	}
+	return props.NCtx
+}
+
+func (l *LlamaCpp) get(ctx context.Context, path string) (*http.Response, error) {
+	req := utils.NewRequest(l.baseURL + path)
+	req.SetClient(l.gpt.client)
+	if l.apiKey != "" {
+		req.SetHeader("Authorization", "Bearer "+l.apiKey)
+	}
+	resp, err := req.GETWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("llama.cpp request failed: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, newAPIError(resp)
+	}
+	return resp, nil
+}
+
+func (l *LlamaCpp) Chat(messages []*Message) chan Result {
+	return l.ChatContext(context.Background(), messages)
+}
+
+func (l *LlamaCpp) ChatContext(ctx context.Context, messages []*Message) chan Result {
+	return l.gpt.retry.stream(ctx, "llama.cpp", func(ctx context.Context, out chan Result) (bool, error) {
+		if err := l.Check(ctx); err != nil {
+			return false, err
+		}
+		return l.gpt.chat(ctx, messages, nil, out)
+	})
+}
+
+func (l *LlamaCpp) ChatTools(ctx context.Context, messages []*Message, tools []*Tool) chan Result {
+	return l.gpt.retry.stream(ctx, "llama.cpp", func(ctx context.Context, out chan Result) (bool, error) {
+		if err := l.Check(ctx); err != nil {
+			return false, err
+		}
+		return l.gpt.chat(ctx, messages, tools, out)
+	})
+}
@@ -0,0 +1,115 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/bigmodel/bigmodeltest"
+)
+
+func newTestLlamaCpp(srv *bigmodeltest.Server, opts ...bigmodel.LlamaCppOption) bigmodel.BigModel {
+	l := bigmodel.NewLlamaCpp(append([]bigmodel.LlamaCppOption{bigmodel.WithLlamaCppBaseURL(srv.URL)}, opts...)...)
+	bigmodel.SetRetry(l, 3, time.Millisecond, 10*time.Millisecond)
+	return l
+}
+
+func llamaCppHealth(status int) *bigmodeltest.Response {
+	if status == http.StatusServiceUnavailable {
+		return bigmodeltest.Raw("/health", status, "application/json",
+			`{"error":{"code":503,"message":"Loading model","type":"unavailable_error"}}`)
+	}
+	return bigmodeltest.Raw("/health", status, "application/json", `{"status":"ok"}`)
+}
+
+func TestLlamaCppLoading(t *testing.T) {
+	srv := bigmodeltest.NewServer(
+		llamaCppHealth(http.StatusServiceUnavailable),
+		llamaCppHealth(http.StatusOK),
+		bigmodeltest.Raw("/props", http.StatusOK, "application/json", `{"default_generation_settings":{"n_ctx":2048},"total_slots":1}`),
+		bigmodeltest.Reply("ok").WithUsage(9, 1),
+	)
+	defer srv.Close()
+
+	l := newTestLlamaCpp(srv, bigmodel.WithLlamaCppAPIKey("local-key"))
+	content, rest := collect(t, l.Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if content != "ok" || last(t, rest).Type != bigmodel.TypeDone {
+		t.Fatalf("got content %q and %+v, want the answer once the model is loaded", content, rest)
+	}
+	if n := bigmodel.ContextWindow(l); n != 2048 {
+		t.Errorf("context window is %d, want the n_ctx of the slot", n)
+	}
+	reqs := srv.AssertRequests(t, 4)
+	for i, path := range []string{"/health", "/health", "/props", "/v1/chat/completions"} {
+		if reqs[i].Path != path {
+			t.Errorf("request %d is %s, want %s", i, reqs[i].Path, path)
+		}
+		reqs[i].AssertHeader(t, "Authorization", "Bearer local-key")
+	}
+	reqs[3].AssertField(t, "model", "local")
+}
+
+func TestLlamaCppStillLoading(t *testing.T) {
+	srv := bigmodeltest.NewServer(llamaCppHealth(http.StatusServiceUnavailable), llamaCppHealth(http.StatusServiceUnavailable))
+	defer srv.Close()
+
+	l := newTestLlamaCpp(srv)
+	bigmodel.SetRetry(l, 1, time.Millisecond, time.Millisecond)
+	_, rest := collect(t, l.Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	var apiErr *bigmodel.APIError
+	if res := last(t, rest); !errors.As(res.Err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || apiErr.Message != "Loading model" {
+		t.Fatalf("got %+v, want the 503 of the loading model", res)
+	}
+	srv.AssertRequests(t, 2)
+}
+
+func TestLlamaCppContextSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		props *bigmodeltest.Response
+		opts  []bigmodel.LlamaCppOption
+		want  int
+	}{
+		{name: "older server", props: bigmodeltest.Raw("/props", http.StatusOK, "application/json", `{"n_ctx":4096}`), want: 4096},
+		{name: "no props", props: bigmodeltest.Raw("/props", http.StatusNotFound, "text/plain", "Not Found"), want: 8192},
+		{name: "specified", opts: []bigmodel.LlamaCppOption{bigmodel.WithLlamaCppContextSize(1024)}, want: 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := bigmodeltest.NewServer(llamaCppHealth(http.StatusOK), bigmodeltest.Reply("ok"))
+			defer srv.Close()
+			if tt.props != nil {
+				srv.Script(tt.props)
+			}
+			l := newTestLlamaCpp(srv, tt.opts...)
+			if err := l.(bigmodel.Checker).Check(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if n := bigmodel.ContextWindow(l); n != tt.want {
+				t.Errorf("context window is %d, want %d", n, tt.want)
+			}
+		})
+	}
+}
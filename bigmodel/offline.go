@@ -0,0 +1,131 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Offline big model answering from the local heuristics and the knowledge base,
+// it needs neither network nor api key, the crash is taken from the context, see WithCrash
+type Offline struct {
+	knowledge []*Knowledge
+}
+
+func NewOffline(opts ...OfflineOption) BigModel {
+	o := &Offline{knowledge: KnowledgeBase}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+type OfflineOption func(*Offline)
+
+// WithKnowledge add knowledge matched before the builtin one
+func WithKnowledge(knowledge ...*Knowledge) OfflineOption {
+	return func(o *Offline) {
+		o.knowledge = append(knowledge[:len(knowledge):len(knowledge)], o.knowledge...)
+	}
+}
+
+func (o *Offline) Chat(messages []*Message) chan Result {
+	return o.ChatContext(context.Background(), messages)
+}
+
+func (o *Offline) ChatContext(ctx context.Context, messages []*Message) chan Result {
+	out := make(chan Result)
+
+	go func() {
+		defer close(out)
+		for _, chunk := range strings.SplitAfter(o.answer(CrashOf(ctx), messages), " ") {
+			if !Send(ctx, out, Result{Type: TypeData, Content: chunk}) {
+				return
+			}
+		}
+		Send(ctx, out, Result{Type: TypeDone})
+	}()
+
+	return out
+}
+
+func (o *Offline) Fingerprint() string {
+	return fmt.Sprintf("offline %d", len(o.knowledge))
+}
+
+func (o *Offline) ContextWindow() int {
+	return 1 << 20
+}
+
+// answer explain the crash, or the first message taken as the panic if the crash is not known
+func (o *Offline) answer(crash *Crash, messages []*Message) string {
+	var first string
+	var questions int
+	for _, m := range messages {
+		if first == "" && m.Role != RoleAssistant {
+			first = m.Content
+			continue
+		}
+		if m.Role == RoleUser {
+			questions++
+		}
+	}
+	if crash == nil {
+		crash = &Crash{Panic: first}
+	}
+
+	var buf strings.Builder
+	if questions > 0 {
+		buf.WriteString("The offline model cannot answer follow-up questions, it only explains the error from the local analysis and its knowledge base.\n\n")
+	}
+	buf.WriteString("## Offline diagnosis\n\n")
+
+	if len(crash.Hints) > 0 {
+		buf.WriteString("**Local analysis**\n\n")
+		for _, h := range crash.Hints {
+			fmt.Fprintf(&buf, "- %s (`%s:%d`)\n", h.Message, h.File, h.Line)
+		}
+		buf.WriteString("\n")
+	}
+
+	var matched bool
+	for _, k := range o.knowledge {
+		if !k.Pattern.MatchString(crash.Panic) {
+			continue
+		}
+		matched = true
+		buf.WriteString("**" + k.Title + "**\n\nPossible causes:\n\n")
+		for _, c := range k.Causes {
+			buf.WriteString("- " + c + "\n")
+		}
+		buf.WriteString("\nHow to fix:\n\n")
+		for _, f := range k.Fixes {
+			buf.WriteString("- " + f + "\n")
+		}
+		buf.WriteString("\n")
+	}
+
+	if !matched && len(crash.Hints) == 0 {
+		buf.WriteString("No local explanation was found for this error, configure a big model for a deeper analysis.\n")
+	}
+	return buf.String()
+}
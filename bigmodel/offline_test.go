@@ -0,0 +1,73 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+)
+
+func TestOfflineAnswersFromCrash(t *testing.T) {
+	crash := &bigmodel.Crash{
+		Panic: "assignment to entry in nil map",
+		Hints: []*bigmodel.Hint{{File: "/app/cache.go", Line: 42, Message: "the map `m` is never made"}},
+	}
+	// neither the guidance nor the template of the prompt is taken for the crash
+	prompt := "Project guidance:\n- docs/setup.md:1: read this first\n```\nindex out of range [3] with length 2\n```\n"
+	ctx := bigmodel.WithCrash(context.Background(), crash)
+
+	content, _ := collect(t, bigmodel.NewOffline().(bigmodel.ContextBigModel).ChatContext(ctx, bigmodel.Messages(bigmodel.UserMessage(prompt))))
+	for _, want := range []string{"the map `m` is never made (`/app/cache.go:42`)", "Assignment to entry in nil map"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("the answer does not contain %q:\n%s", want, content)
+		}
+	}
+	for _, unwanted := range []string{"read this first", "Index out of range"} {
+		if strings.Contains(content, unwanted) {
+			t.Errorf("the answer contains %q from the prompt:\n%s", unwanted, content)
+		}
+	}
+}
+
+func TestOfflineWithoutCrash(t *testing.T) {
+	content, _ := collect(t, bigmodel.NewOffline().Chat(bigmodel.Messages(bigmodel.UserMessage("runtime error: invalid memory address or nil pointer dereference"))))
+	if !strings.Contains(content, "Nil pointer dereference") {
+		t.Errorf("the answer does not explain the message:\n%s", content)
+	}
+}
+
+func TestOfflineFollowUp(t *testing.T) {
+	messages := bigmodel.Messages(bigmodel.UserMessage("runtime error: invalid memory address or nil pointer dereference"),
+		bigmodel.AssistantMessage("..."), bigmodel.UserMessage("why?"))
+	content, _ := collect(t, bigmodel.NewOffline().Chat(messages))
+	if !strings.Contains(content, "cannot answer follow-up questions") || !strings.Contains(content, "Nil pointer dereference") {
+		t.Errorf("the answer does not explain the message:\n%s", content)
+	}
+}
+
+func TestOfflineUnknown(t *testing.T) {
+	content, _ := collect(t, bigmodel.NewOffline().Chat(bigmodel.Messages(bigmodel.UserMessage("something else"))))
+	if !strings.Contains(content, "No local explanation") {
+		t.Errorf("the answer claims to explain an unknown error:\n%s", content)
+	}
+}
@@ -0,0 +1,362 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ahaostudy/code-diagnostic/utils"
+)
+
+// defaultLocalContext context size of local models unless specified,
+// large enough for the diagnostic prompt but small enough for the memory of a laptop
+const defaultLocalContext = 8192
+
+// Ollama big model served by a local Ollama server through its native api
+type Ollama struct {
+	baseURL string
+	model   string
+	numCtx  int
+	pull    bool
+	retry   retryPolicy
+	// embeddingModel the model of Embed, the chat model by default
+	embeddingModel string
+
+	// mu guards the availability check, which is done once before the first chat
+	mu    sync.Mutex
+	ready bool
+}
+
+func NewOllama(model string, opts ...OllamaOption) BigModel {
+	o := &Ollama{
+		baseURL: "http://localhost:11434",
+		model:   model,
+		retry:   defaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.baseURL = strings.TrimSuffix(o.baseURL, "/")
+	if o.embeddingModel == "" {
+		o.embeddingModel = o.model
+	}
+	return o
+}
+
+type OllamaOption func(*Ollama)
+
+// WithOllamaBaseURL specify the url of the Ollama server
+func WithOllamaBaseURL(url string) OllamaOption {
+	return func(o *Ollama) {
+		o.baseURL = url
+	}
+}
+
+// WithOllamaContextSize specify the context size (num_ctx) the model is loaded with,
+// 8192 or the context length of the model if smaller by default
+func WithOllamaContextSize(n int) OllamaOption {
+	return func(o *Ollama) {
+		o.numCtx = n
+	}
+}
+
+// WithOllamaPull pull the model before the first chat if it is not available on the server
+func WithOllamaPull() OllamaOption {
+	return func(o *Ollama) {
+		o.pull = true
+	}
+}
+
+func (o *Ollama) ContextWindow() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.numCtx > 0 {
+		return o.numCtx
+	}
+	return defaultLocalContext
+}
+
+func (o *Ollama) Fingerprint() string {
+	return fmt.Sprintf("ollama %s %s %d", o.baseURL, o.model, o.ContextWindow())
+}
+
+// WithOllamaEmbeddingModel specify the model of Embed, such as nomic-embed-text, the chat model by default
+func WithOllamaEmbeddingModel(model string) OllamaOption {
+	return func(o *Ollama) {
+		o.embeddingModel = model
+	}
+}
+
+func (o *Ollama) Embed(ctx context.Context, texts []string) (*Embeddings, error) {
+	req := utils.NewRequest(o.baseURL + "/api/embed")
+	req.SetData(map[string]interface{}{"model": o.embeddingModel, "input": texts})
+	body := new(struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	})
+	if err := postJSON(ctx, req, body); err != nil {
+		return nil, fmt.Errorf("ollama embeddings request failed: %w", err)
+	}
+	return &Embeddings{Model: "ollama/" + o.embeddingModel, Vectors: body.Embeddings}, nil
+}
+
+// Check check that the model is available on the server, and pull it if WithOllamaPull is specified.
+// The context size defaults to the context length of the model if it is smaller than 8192.
+func (o *Ollama) Check(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.ready {
+		return nil
+	}
+
+	length, err := o.show(ctx)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound && o.pull {
+		if err = o.pullModel(ctx); err == nil {
+			length, err = o.show(ctx)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.numCtx == 0 {
+		o.numCtx = defaultLocalContext
+		if length > 0 && length < o.numCtx {
+			o.numCtx = length
+		}
+	}
+	o.ready = true
+	return nil
+}
+
+// show get the context length of the model, an *APIError with status 404 if the model is not pulled
+func (o *Ollama) show(ctx context.Context) (contextLength int, err error) {
+	req := utils.NewRequest(o.baseURL + "/api/show")
+	req.SetData(map[string]interface{}{"model": o.model})
+	req.SetHeader("Content-Type", "application/json")
+	resp, err := req.POSTWithContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ollama request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, newAPIError(resp)
+	}
+
+	// the context length is reported as "<architecture>.context_length"
+	info := new(struct {
+		ModelInfo map[string]interface{} `json:"model_info"`
+	})
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return 0, fmt.Errorf("response data error: %w", err)
+	}
+	for k, v := range info.ModelInfo {
+		if n, ok := v.(float64); ok && strings.HasSuffix(k, ".context_length") {
+			return int(n), nil
+		}
+	}
+	return 0, nil
+}
+
+// pullModel pull the model and log its progress
+func (o *Ollama) pullModel(ctx context.Context) error {
+	log.Printf("ollama model %s not found, pulling", o.model)
+	req := utils.NewRequest(o.baseURL + "/api/pull")
+	req.SetData(map[string]interface{}{"model": o.model, "stream": true})
+	req.SetHeader("Content-Type", "application/json")
+	resp, err := req.POSTWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("ollama request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return newAPIError(resp)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	var last string
+	for {
+		progress := new(struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		})
+		if err := dec.Decode(progress); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("ollama pull %s: %w", o.model, err)
+		}
+		if progress.Error != "" {
+			return &APIError{StatusCode: resp.StatusCode, Message: progress.Error}
+		}
+		if progress.Status == "success" {
+			log.Printf("ollama model %s pulled", o.model)
+			return nil
+		}
+		if progress.Status != last {
+			log.Printf("ollama pull %s: %s", o.model, progress.Status)
+			last = progress.Status
+		}
+	}
+}
+
+func (o *Ollama) Chat(messages []*Message) chan Result {
+	return o.ChatContext(context.Background(), messages)
+}
+
+func (o *Ollama) ChatContext(ctx context.Context, messages []*Message) chan Result {
+	return o.ChatTools(ctx, messages, nil)
+}
+
+func (o *Ollama) ChatTools(ctx context.Context, messages []*Message, tools []*Tool) chan Result {
+	return o.retry.stream(ctx, "ollama", func(ctx context.Context, out chan Result) (bool, error) {
+		if err := o.Check(ctx); err != nil {
+			return false, err
+		}
+		return o.chat(ctx, messages, tools, out)
+	})
+}
+
+// ollamaMessage the message of /api/chat, whose tool calls take their arguments as an object
+// and whose tool results name their tool
+type ollamaMessage struct {
+	Role      string            `json:"role"`
+	Content   string            `json:"content"`
+	ToolCalls []*ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string            `json:"tool_name,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+func ollamaMessages(messages []*Message) []*ollamaMessage {
+	names := toolNames(messages)
+	msgs := make([]*ollamaMessage, len(messages))
+	for i, msg := range messages {
+		m := &ollamaMessage{Role: msg.Role, Content: msg.Content}
+		if msg.Role == RoleTool {
+			m.ToolName = names[msg.ToolCallID]
+		}
+		for _, call := range msg.ToolCalls {
+			tc := new(ollamaToolCall)
+			tc.Function.Name, tc.Function.Arguments = call.Name, call.arguments()
+			m.ToolCalls = append(m.ToolCalls, tc)
+		}
+		msgs[i] = m
+	}
+	return msgs
+}
+
+// ollamaChunk a line of the NDJSON stream of /api/chat
+type ollamaChunk struct {
+	Message struct {
+		Content string `json:"content"`
+		// ToolCalls the complete tool calls, sent in a line of their own
+		ToolCalls []*ollamaToolCall `json:"tool_calls"`
+	} `json:"message"`
+	Done  bool   `json:"done"`
+	Error string `json:"error"`
+	// PromptEvalCount and EvalCount the token usage reported in the done line
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+// chat send a single request and stream the answer into out,
+// streamed reports whether any data was sent so that the request can no longer be retried
+func (o *Ollama) chat(ctx context.Context, messages []*Message, tools []*Tool, out chan Result) (streamed bool, err error) {
+	data := map[string]interface{}{
+		"model":    o.model,
+		"stream":   true,
+		"messages": ollamaMessages(messages),
+		"options":  map[string]interface{}{"num_ctx": o.ContextWindow()},
+	}
+	if len(tools) > 0 {
+		data["tools"] = openaiTools(tools)
+	}
+	if schema := SchemaOf(ctx); schema != nil {
+		data["format"] = schema.Schema
+	}
+	req := utils.NewRequest(o.baseURL + "/api/chat")
+	req.SetData(data)
+	req.SetHeader("Content-Type", "application/json")
+
+	resp, err := req.POSTWithContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("ollama request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, newAPIError(resp)
+	}
+
+	var calls []*ToolCall
+	dec := json.NewDecoder(resp.Body)
+	for {
+		data := new(ollamaChunk)
+		if err := dec.Decode(data); err != nil {
+			if err == io.EOF {
+				// the stream must end with a done line, otherwise the answer was cut off
+				err = io.ErrUnexpectedEOF
+			}
+			return streamed, fmt.Errorf("ollama stream: %w", err)
+		}
+		if data.Error != "" {
+			return streamed, &APIError{StatusCode: http.StatusInternalServerError, Message: data.Error}
+		}
+		for _, tc := range data.Message.ToolCalls {
+			calls = append(calls, &ToolCall{
+				ID:        callID(tc.Function.Name, len(calls)),
+				Name:      tc.Function.Name,
+				Arguments: string(tc.Function.Arguments),
+			})
+		}
+		if data.Message.Content != "" {
+			if !Send(ctx, out, Result{Type: TypeData, Content: data.Message.Content}) {
+				return true, ctx.Err()
+			}
+			streamed = true
+		}
+		if data.Done {
+			if len(calls) > 0 && !Send(ctx, out, Result{Type: TypeToolCall, ToolCalls: calls}) {
+				return streamed, ctx.Err()
+			}
+			// local models are priced by the "ollama/" prefix
+			usage := &Usage{Model: "ollama/" + o.model, PromptTokens: data.PromptEvalCount, CompletionTokens: data.EvalCount}
+			if !Send(ctx, out, Result{Type: TypeUsage, Usage: usage}) {
+				return streamed, ctx.Err()
+			}
+			Send(ctx, out, Result{Type: TypeDone})
+			return streamed, nil
+		}
+	}
+}
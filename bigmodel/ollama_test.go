@@ -0,0 +1,200 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/bigmodel/bigmodeltest"
+)
+
+func newTestOllama(srv *bigmodeltest.Server, opts ...bigmodel.OllamaOption) bigmodel.BigModel {
+	o := bigmodel.NewOllama("llama-test", append([]bigmodel.OllamaOption{bigmodel.WithOllamaBaseURL(srv.URL)}, opts...)...)
+	bigmodel.SetRetry(o, 3, time.Millisecond, 10*time.Millisecond)
+	return o
+}
+
+// ndjson the lines of a newline-delimited JSON stream
+func ndjson(path string, lines ...string) *bigmodeltest.Response {
+	return bigmodeltest.Raw(path, http.StatusOK, "application/x-ndjson", strings.Join(lines, "\n")+"\n")
+}
+
+func ollamaShow(contextLength int) *bigmodeltest.Response {
+	return bigmodeltest.Raw("/api/show", http.StatusOK, "application/json",
+		`{"model_info":{"general.architecture":"llama","llama.context_length":`+strconv.Itoa(contextLength)+`}}`)
+}
+
+func ollamaAnswer(chunks ...string) *bigmodeltest.Response {
+	var lines []string
+	for _, chunk := range chunks {
+		lines = append(lines, `{"model":"llama-test","message":{"role":"assistant","content":"`+chunk+`"},"done":false}`)
+	}
+	lines = append(lines, `{"model":"llama-test","message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":30,"eval_count":4}`)
+	return ndjson("/api/chat", lines...)
+}
+
+func TestOllamaStream(t *testing.T) {
+	srv := bigmodeltest.NewServer(ollamaShow(4096), ollamaAnswer("Hello", ", world"), ollamaAnswer("again"))
+	defer srv.Close()
+
+	o := newTestOllama(srv)
+	if n := bigmodel.ContextWindow(o); n != 8192 {
+		t.Errorf("context window before the check is %d, want the default 8192", n)
+	}
+	content, rest := collect(t, o.Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if content != "Hello, world" || last(t, rest).Type != bigmodel.TypeDone {
+		t.Fatalf("got content %q and %+v", content, rest)
+	}
+	usage := resultOf(rest, bigmodel.TypeUsage)
+	if usage == nil || usage.Usage.Model != "ollama/llama-test" || usage.Usage.PromptTokens != 30 || usage.Usage.CompletionTokens != 4 {
+		t.Errorf("usage is %+v", usage)
+	}
+	// the model of 4096 tokens is loaded with its whole context instead of the default
+	if n := bigmodel.ContextWindow(o); n != 4096 {
+		t.Errorf("context window is %d, want the 4096 of the model", n)
+	}
+
+	// the model is only shown once
+	if content, _ := collect(t, o.Chat(bigmodel.Messages(bigmodel.UserMessage("hi")))); content != "again" {
+		t.Errorf("content of the second chat is %q", content)
+	}
+	reqs := srv.AssertRequests(t, 3)
+	reqs[0].AssertField(t, "model", "llama-test")
+	if reqs[1].Path != "/api/chat" {
+		t.Fatalf("request path is %s", reqs[1].Path)
+	}
+	reqs[1].AssertField(t, "options", map[string]int{"num_ctx": 4096})
+	reqs[1].AssertField(t, "messages", []map[string]string{{"role": "user", "content": "hi"}})
+}
+
+func TestOllamaContextSize(t *testing.T) {
+	srv := bigmodeltest.NewServer(ollamaShow(131072), ollamaAnswer("ok"))
+	defer srv.Close()
+
+	// a larger model is loaded with the default context, which fits the memory of a laptop
+	o := newTestOllama(srv)
+	collect(t, o.Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if n := bigmodel.ContextWindow(o); n != 8192 {
+		t.Errorf("context window is %d, want the default 8192", n)
+	}
+}
+
+func TestOllamaPull(t *testing.T) {
+	notFound := func() *bigmodeltest.Response {
+		return bigmodeltest.Raw("/api/show", http.StatusNotFound, "application/json", `{"error":"model 'llama-test' not found"}`)
+	}
+
+	t.Run("pull", func(t *testing.T) {
+		srv := bigmodeltest.NewServer(
+			notFound(),
+			ndjson("/api/pull", `{"status":"pulling manifest"}`, `{"status":"downloading","completed":1,"total":2}`, `{"status":"success"}`),
+			ollamaShow(2048),
+			ollamaAnswer("ok"),
+		)
+		defer srv.Close()
+		content, rest := collect(t, newTestOllama(srv, bigmodel.WithOllamaPull()).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+		if content != "ok" || last(t, rest).Type != bigmodel.TypeDone {
+			t.Fatalf("got content %q and %+v, want the answer after the pull", content, rest)
+		}
+		reqs := srv.AssertRequests(t, 4)
+		reqs[1].AssertField(t, "model", "llama-test")
+		reqs[3].AssertField(t, "options", map[string]int{"num_ctx": 2048})
+	})
+	t.Run("pull failed", func(t *testing.T) {
+		srv := bigmodeltest.NewServer(notFound(), ndjson("/api/pull", `{"status":"pulling manifest"}`, `{"error":"file does not exist"}`))
+		defer srv.Close()
+		_, rest := collect(t, newTestOllama(srv, bigmodel.WithOllamaPull()).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+		if res := last(t, rest); res.Type != bigmodel.TypeError || !strings.Contains(res.Err.Error(), "file does not exist") {
+			t.Fatalf("got %+v, want the error of the pull", res)
+		}
+	})
+	t.Run("not pulled", func(t *testing.T) {
+		srv := bigmodeltest.NewServer(notFound())
+		defer srv.Close()
+		_, rest := collect(t, newTestOllama(srv).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+		var apiErr *bigmodel.APIError
+		if res := last(t, rest); !errors.As(res.Err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			t.Fatalf("got %+v, want the 404 of the model", res)
+		}
+		srv.AssertRequests(t, 1)
+	})
+}
+
+func TestOllamaCutOff(t *testing.T) {
+	cut := ndjson("/api/chat", `{"message":{"role":"assistant","content":"partial"},"done":false}`)
+	srv := bigmodeltest.NewServer(ollamaShow(4096), cut)
+	defer srv.Close()
+	content, rest := collect(t, newTestOllama(srv).Chat(bigmodel.Messages(bigmodel.UserMessage("hi"))))
+	if res := last(t, rest); content != "partial" || res.Type != bigmodel.TypeError {
+		t.Fatalf("got content %q and %+v, want an error for the stream without a done line", content, res)
+	}
+}
+
+func TestOllamaToolCalls(t *testing.T) {
+	srv := bigmodeltest.NewServer(
+		ollamaShow(4096),
+		ndjson("/api/chat",
+			`{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"read_function","arguments":{"function":"Div"}}}]},"done":false}`,
+			`{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop"}`,
+		),
+		ollamaAnswer("done"),
+	)
+	defer srv.Close()
+
+	o := newTestOllama(srv).(bigmodel.ToolBigModel)
+	tools := []*bigmodel.Tool{{Name: "read_function", Description: "read a function", Parameters: map[string]interface{}{"type": "object"}}}
+	messages := bigmodel.Messages(bigmodel.UserMessage("why?"))
+	_, rest := collect(t, o.ChatTools(context.Background(), messages, tools))
+	res := resultOf(rest, bigmodel.TypeToolCall)
+	if res == nil || len(res.ToolCalls) != 1 || last(t, rest).Type != bigmodel.TypeDone {
+		t.Fatalf("got %+v, want a tool call", rest)
+	}
+	call := res.ToolCalls[0]
+	if call.ID == "" || call.Name != "read_function" || call.Arguments != `{"function":"Div"}` {
+		t.Errorf("tool call is %+v", call)
+	}
+
+	// the arguments are sent back as an object and the result names its tool
+	messages = append(messages,
+		&bigmodel.Message{Role: bigmodel.RoleAssistant, ToolCalls: res.ToolCalls},
+		bigmodel.ToolMessage(call.ID, "func Div() {}"),
+	)
+	if content, _ := collect(t, o.ChatTools(context.Background(), messages, tools)); content != "done" {
+		t.Fatalf("content is %q", content)
+	}
+	reqs := srv.AssertRequests(t, 3)
+	reqs[1].AssertField(t, "tools", []map[string]interface{}{{"type": "function", "function": map[string]interface{}{
+		"name": "read_function", "description": "read a function", "parameters": map[string]string{"type": "object"},
+	}}})
+	reqs[2].AssertField(t, "messages", []map[string]interface{}{
+		{"role": "user", "content": "why?"},
+		{"role": "assistant", "content": "", "tool_calls": []map[string]interface{}{
+			{"function": map[string]interface{}{"name": "read_function", "arguments": map[string]string{"function": "Div"}}},
+		}},
+		{"role": "tool", "content": "func Div() {}", "tool_name": "read_function"},
+	})
+}
@@ -0,0 +1,42 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import "context"
+
+// Schema the JSON schema the answer must match, such as the structured diagnosis
+type Schema struct {
+	Name   string
+	Schema map[string]interface{}
+}
+
+type schemaKey struct{}
+
+// WithSchema ask for answers matching the schema in the requests made with the context,
+// the big models supporting structured output constrain their answer to it, the others rely on the prompt
+func WithSchema(ctx context.Context, schema *Schema) context.Context {
+	return context.WithValue(ctx, schemaKey{}, schema)
+}
+
+// SchemaOf the schema the answer must match, nil if any answer will do
+func SchemaOf(ctx context.Context) *Schema {
+	schema, _ := ctx.Value(schemaKey{}).(*Schema)
+	return schema
+}
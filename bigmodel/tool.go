@@ -0,0 +1,107 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Tool a function the big model can call, Parameters is the JSON schema of its arguments
+type Tool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+// ToolCall a call of a tool requested by the big model, Arguments is a JSON object
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// openaiToolCall the tool call in the shape of the chat completions api, which Message is sent in
+type openaiToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+func (c *ToolCall) MarshalJSON() ([]byte, error) {
+	call := openaiToolCall{ID: c.ID, Type: "function"}
+	call.Function.Name = c.Name
+	call.Function.Arguments = c.Arguments
+	return json.Marshal(call)
+}
+
+func (c *ToolCall) UnmarshalJSON(data []byte) error {
+	call := new(openaiToolCall)
+	if err := json.Unmarshal(data, call); err != nil {
+		return err
+	}
+	c.ID, c.Name, c.Arguments = call.ID, call.Function.Name, call.Function.Arguments
+	return nil
+}
+
+// ToolBigModel big model that can call tools, the requested calls are sent as a TypeToolCall result
+// and their results are sent back as tool messages in the next chat
+type ToolBigModel interface {
+	ContextBigModel
+	ChatTools(ctx context.Context, messages []*Message, tools []*Tool) chan Result
+}
+
+// ChatTools chat with the big model offering it the tools,
+// big models without tool support answer without them
+func ChatTools(ctx context.Context, bm BigModel, messages []*Message, tools []*Tool) chan Result {
+	if tbm, ok := bm.(ToolBigModel); ok {
+		return tbm.ChatTools(ctx, messages, tools)
+	}
+	return ChatContext(ctx, bm, messages)
+}
+
+// toolNames the names of the tool calls of the messages by id, for the apis sending the results by tool name
+func toolNames(messages []*Message) map[string]string {
+	names := make(map[string]string)
+	for _, msg := range messages {
+		for _, call := range msg.ToolCalls {
+			names[call.ID] = call.Name
+		}
+	}
+	return names
+}
+
+// callID the id of the i-th call of an answer of the apis not identifying calls,
+// whose results are matched by the tool name
+func callID(name string, i int) string {
+	return fmt.Sprintf("%s_%d", name, i)
+}
+
+// arguments the arguments of the call as a JSON object, for the apis taking them as an object instead of a string
+func (c *ToolCall) arguments() json.RawMessage {
+	if !json.Valid([]byte(c.Arguments)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(c.Arguments)
+}
@@ -0,0 +1,229 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigmodel
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Usage tokens used by the requests to a model
+type Usage struct {
+	Model            string `json:"model"`
+	Requests         int    `json:"requests"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	// Cost in USD, set by Prices.Bill
+	Cost float64 `json:"cost"`
+}
+
+// Price USD per million tokens
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// Prices price of the models, matched by the longest prefix of the model name
+type Prices map[string]Price
+
+// DefaultPrices list prices of the known models, local models are free
+var DefaultPrices = Prices{
+	"gpt-3.5-turbo":          {0.5, 1.5},
+	"gpt-4":                  {30, 60},
+	"gpt-4-32k":              {60, 120},
+	"gpt-4-turbo":            {10, 30},
+	"gpt-4o":                 {2.5, 10},
+	"gpt-4o-mini":            {0.15, 0.6},
+	"gpt-4.1":                {2, 8},
+	"gpt-4.1-mini":           {0.4, 1.6},
+	"gpt-4.1-nano":           {0.1, 0.4},
+	"o1":                     {15, 60},
+	"o3":                     {2, 8},
+	"o4-mini":                {1.1, 4.4},
+	"claude-3-5-haiku":       {0.8, 4},
+	"claude-3-5-sonnet":      {3, 15},
+	"claude-3-7-sonnet":      {3, 15},
+	"claude-haiku-4-5":       {1, 5},
+	"claude-sonnet-4":        {3, 15},
+	"claude-opus-4":          {15, 75},
+	"claude-opus-4-5":        {5, 25},
+	"gemini-2.0-flash":       {0.1, 0.4},
+	"gemini-2.5-flash":       {0.3, 2.5},
+	"gemini-2.5-flash-lite":  {0.1, 0.4},
+	"gemini-2.5-pro":         {1.25, 10},
+	"text-embedding-3-small": {0.02, 0},
+	"text-embedding-3-large": {0.13, 0},
+	"text-embedding-ada-002": {0.1, 0},
+	"local":                  {0, 0},
+	"ollama/":                {0, 0},
+}
+
+// Price the price of the model, false if it is unknown
+func (p Prices) Price(model string) (Price, bool) {
+	var prefix string
+	found := false
+	for k := range p {
+		if strings.HasPrefix(model, k) && (!found || len(k) > len(prefix)) {
+			prefix, found = k, true
+		}
+	}
+	return p[prefix], found
+}
+
+// Bill usage of a period and its cost
+type Bill struct {
+	Usage            []*Usage `json:"usage"`
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	Cost             float64  `json:"cost"`
+	// Unpriced models missing from the price table, their cost is not included
+	Unpriced []string `json:"unpriced,omitempty"`
+}
+
+func (b *Bill) String() string {
+	s := fmt.Sprintf("%d prompt + %d completion tokens, $%.4f", b.PromptTokens, b.CompletionTokens, b.Cost)
+	if len(b.Unpriced) > 0 {
+		s += " (no price of " + strings.Join(b.Unpriced, ", ") + ")"
+	}
+	return s
+}
+
+// Bill convert the usage to cost
+func (p Prices) Bill(usage []*Usage) *Bill {
+	bill := &Bill{Usage: make([]*Usage, len(usage))}
+	for i, u := range usage {
+		cp := *u
+		price, ok := p.Price(u.Model)
+		if ok {
+			cp.Cost = (float64(u.PromptTokens)*price.Prompt + float64(u.CompletionTokens)*price.Completion) / 1e6
+		} else {
+			bill.Unpriced = append(bill.Unpriced, u.Model)
+		}
+		bill.Usage[i] = &cp
+		bill.PromptTokens += cp.PromptTokens
+		bill.CompletionTokens += cp.CompletionTokens
+		bill.Cost += cp.Cost
+	}
+	return bill
+}
+
+// Meter aggregate the usage per model
+type Meter struct {
+	mu    sync.Mutex
+	usage map[string]*Usage
+}
+
+// ProcessMeter the usage of every metered big model of the process
+var ProcessMeter = new(Meter)
+
+func (m *Meter) Add(u *Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usage == nil {
+		m.usage = make(map[string]*Usage)
+	}
+	total, ok := m.usage[u.Model]
+	if !ok {
+		total = &Usage{Model: u.Model}
+		m.usage[u.Model] = total
+	}
+	total.Requests++
+	total.PromptTokens += u.PromptTokens
+	total.CompletionTokens += u.CompletionTokens
+}
+
+// Usage the usage so far sorted by model, nil if the meter is nil
+func (m *Meter) Usage() []*Usage {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := make([]*Usage, 0, len(m.usage))
+	for _, u := range m.usage {
+		cp := *u
+		usage = append(usage, &cp)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Model < usage[j].Model
+	})
+	return usage
+}
+
+type meteredModel struct {
+	BigModel
+	meters []*Meter
+}
+
+// Metered add the TypeUsage results and the usage of the embeddings of the big model to the meters,
+// the results are still forwarded
+func Metered(bm BigModel, meters ...*Meter) BigModel {
+	return &meteredModel{BigModel: bm, meters: meters}
+}
+
+func (m *meteredModel) Chat(messages []*Message) chan Result {
+	return m.ChatContext(context.Background(), messages)
+}
+
+func (m *meteredModel) ChatContext(ctx context.Context, messages []*Message) chan Result {
+	return m.meter(ctx, ChatContext(ctx, m.BigModel, messages))
+}
+
+func (m *meteredModel) ChatTools(ctx context.Context, messages []*Message, tools []*Tool) chan Result {
+	return m.meter(ctx, ChatTools(ctx, m.BigModel, messages, tools))
+}
+
+func (m *meteredModel) meter(ctx context.Context, in chan Result) chan Result {
+	out := make(chan Result)
+
+	go func() {
+		defer close(out)
+		for res := range in {
+			if res.Type == TypeUsage && res.Usage != nil {
+				for _, meter := range m.meters {
+					meter.Add(res.Usage)
+				}
+			}
+			if !Send(ctx, out, res) {
+				go Drain(in)
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+func (m *meteredModel) ContextWindow() int {
+	return ContextWindow(m.BigModel)
+}
+
+func (m *meteredModel) Embed(ctx context.Context, texts []string) (*Embeddings, error) {
+	e, err := Embed(ctx, m.BigModel, texts)
+	if err == nil && e.Usage != nil {
+		for _, meter := range m.meters {
+			meter.Add(e.Usage)
+		}
+	}
+	return e, err
+}
@@ -0,0 +1,371 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+)
+
+const (
+	defaultTTL      = 24 * time.Hour
+	defaultMaxBytes = 64 << 20
+)
+
+// Cache big model replaying the answer of an identical earlier request from disk,
+// requests are identical when their normalized messages, tools and model settings are
+type Cache struct {
+	bm       bigmodel.BigModel
+	dir      string
+	ttl      time.Duration
+	maxBytes int64
+	bypass   bool
+	mu       sync.Mutex
+}
+
+// New cache the answers of the big model, in the user cache directory by default
+func New(bm bigmodel.BigModel, opts ...Option) bigmodel.BigModel {
+	c := &Cache{bm: bm, ttl: defaultTTL, maxBytes: defaultMaxBytes}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.dir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			dir = os.TempDir()
+		}
+		c.dir = filepath.Join(dir, "code-diagnostic")
+	}
+	return c
+}
+
+type Option func(*Cache)
+
+// WithDir specify the directory the answers are stored in
+func WithDir(dir string) Option {
+	return func(c *Cache) {
+		c.dir = dir
+	}
+}
+
+// WithTTL specify how long an answer is replayed, 0 replays it until it is evicted
+func WithTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.ttl = ttl
+	}
+}
+
+// WithMaxBytes specify the most bytes the answers take on disk, the least recently used ones are evicted first,
+// 0 does not limit them
+func WithMaxBytes(n int64) Option {
+	return func(c *Cache) {
+		c.maxBytes = n
+	}
+}
+
+// WithBypass never replay a cached answer, the fresh answers are still stored
+func WithBypass() Option {
+	return func(c *Cache) {
+		c.bypass = true
+	}
+}
+
+type bypassKey struct{}
+
+// Bypass skip the cached answer for the requests made with the context, the fresh answer replaces it
+func Bypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+func bypassed(ctx context.Context) bool {
+	b, _ := ctx.Value(bypassKey{}).(bool)
+	return b
+}
+
+func (c *Cache) Chat(messages []*bigmodel.Message) chan bigmodel.Result {
+	return c.ChatContext(context.Background(), messages)
+}
+
+func (c *Cache) ChatContext(ctx context.Context, messages []*bigmodel.Message) chan bigmodel.Result {
+	return c.chat(ctx, messages, nil, func() chan bigmodel.Result {
+		return bigmodel.ChatContext(ctx, c.bm, messages)
+	})
+}
+
+func (c *Cache) ChatTools(ctx context.Context, messages []*bigmodel.Message, tools []*bigmodel.Tool) chan bigmodel.Result {
+	return c.chat(ctx, messages, tools, func() chan bigmodel.Result {
+		return bigmodel.ChatTools(ctx, c.bm, messages, tools)
+	})
+}
+
+func (c *Cache) ContextWindow() int {
+	return bigmodel.ContextWindow(c.bm)
+}
+
+// Embed embed the texts with the big model, embeddings are not cached
+func (c *Cache) Embed(ctx context.Context, texts []string) (*bigmodel.Embeddings, error) {
+	return bigmodel.Embed(ctx, c.bm, texts)
+}
+
+func (c *Cache) Fingerprint() string {
+	return bigmodel.Fingerprint(c.bm)
+}
+
+func (c *Cache) chat(ctx context.Context, messages []*bigmodel.Message, tools []*bigmodel.Tool, request func() chan bigmodel.Result) chan bigmodel.Result {
+	model := bigmodel.Fingerprint(c.bm)
+	if schema := bigmodel.SchemaOf(ctx); schema != nil {
+		model += " schema " + schema.Name
+	}
+	key := Key(model, messages, tools)
+	if !c.bypass && !bypassed(ctx) {
+		if e := c.load(key); e != nil {
+			log.Printf("replaying the answer cached at %s", e.Created.Format(time.DateTime))
+			return e.replay(ctx)
+		}
+	}
+	return c.record(ctx, key, request())
+}
+
+// entry a complete answer stored on disk, without its usage since a replay costs nothing
+type entry struct {
+	Created time.Time `json:"created"`
+	Results []*result `json:"results"`
+}
+
+type result struct {
+	Type      int                  `json:"type"`
+	Content   string               `json:"content,omitempty"`
+	ToolCalls []*bigmodel.ToolCall `json:"tool_calls,omitempty"`
+}
+
+func (e *entry) replay(ctx context.Context) chan bigmodel.Result {
+	out := make(chan bigmodel.Result)
+
+	go func() {
+		defer close(out)
+		for _, res := range e.Results {
+			if !bigmodel.Send(ctx, out, bigmodel.Result{Type: res.Type, Content: res.Content, ToolCalls: res.ToolCalls}) {
+				return
+			}
+		}
+		bigmodel.Send(ctx, out, bigmodel.Result{Type: bigmodel.TypeDone})
+	}()
+
+	return out
+}
+
+// record forward the answer and store it once it is complete
+func (c *Cache) record(ctx context.Context, key string, in chan bigmodel.Result) chan bigmodel.Result {
+	out := make(chan bigmodel.Result)
+
+	go func() {
+		defer close(out)
+		e := &entry{Created: time.Now()}
+		for res := range in {
+			switch res.Type {
+			case bigmodel.TypeDone:
+				c.store(key, e)
+			case bigmodel.TypeError:
+				e = nil
+			case bigmodel.TypeUsage:
+			default:
+				if e != nil {
+					e.Results = append(e.Results, &result{Type: res.Type, Content: res.Content, ToolCalls: res.ToolCalls})
+				}
+			}
+			if !bigmodel.Send(ctx, out, res) {
+				go bigmodel.Drain(in)
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// Key the hash of the normalized request to the model with the fingerprint,
+// two runs of the same crash have the same key
+func Key(model string, messages []*bigmodel.Message, tools []*bigmodel.Tool) string {
+	type message struct {
+		Role       string               `json:"role"`
+		Content    string               `json:"content"`
+		ToolCalls  []*bigmodel.ToolCall `json:"tool_calls,omitempty"`
+		ToolCallID string               `json:"tool_call_id,omitempty"`
+	}
+	req := struct {
+		Model    string           `json:"model"`
+		Messages []*message       `json:"messages"`
+		Tools    []*bigmodel.Tool `json:"tools,omitempty"`
+	}{Model: model, Tools: tools}
+	for _, msg := range messages {
+		req.Messages = append(req.Messages, &message{
+			Role:       msg.Role,
+			Content:    normalize(msg.Content),
+			ToolCalls:  msg.ToolCalls,
+			ToolCallID: msg.ToolCallID,
+		})
+	}
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	addressRegexp = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+	// offsetRegexp match the pc offset that ends a file line of the stack
+	offsetRegexp = regexp.MustCompile(`(?m)(\.go:\d+ \+)0x[0-9a-fA-F]+([ \t]*)$`)
+	// frameRegexp match a function line of the stack whose arguments are only words,
+	// e.g. "main.(*T).F(0xc000012345, {0x4b2f60, 0x1}, ...)"
+	frameRegexp     = regexp.MustCompile(`(?m)^(\S+\()((?:0x[0-9a-fA-F]+|[{}.,? ])*)(\)[ \t]*)$`)
+	goroutineRegexp = regexp.MustCompile(`goroutine \d+`)
+	trailingRegexp  = regexp.MustCompile(`[ \t]+\n`)
+)
+
+// normalize drop what changes between two runs of the same crash,
+// such as the addresses and goroutine ids of the stack, and the line endings.
+// Only the pc offsets and argument words of the stack are masked,
+// the hex literals of the source code and the panic value are kept
+func normalize(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = offsetRegexp.ReplaceAllString(content, "${1}0x?${2}")
+	content = frameRegexp.ReplaceAllStringFunc(content, func(frame string) string {
+		m := frameRegexp.FindStringSubmatch(frame)
+		return m[1] + addressRegexp.ReplaceAllString(m[2], "0x?") + m[3]
+	})
+	content = goroutineRegexp.ReplaceAllString(content, "goroutine ?")
+	content = trailingRegexp.ReplaceAllString(content, "\n")
+	return strings.TrimSpace(content)
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// load the unexpired answer of the key, nil if there is none
+func (c *Cache) load(key string) *entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := c.path(key)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	e := new(entry)
+	if err := json.Unmarshal(data, e); err != nil || c.expired(e.Created) {
+		_ = os.Remove(name)
+		return nil
+	}
+	// the modification time is when the answer was last used, which the eviction goes by
+	now := time.Now()
+	_ = os.Chtimes(name, now, now)
+	return e
+}
+
+func (c *Cache) expired(created time.Time) bool {
+	return c.ttl > 0 && time.Since(created) > c.ttl
+}
+
+func (c *Cache) store(key string, e *entry) {
+	if e == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.write(key, e); err != nil {
+		log.Printf("failed to cache the answer: %v", err)
+		return
+	}
+	c.prune()
+}
+
+func (c *Cache) write(key string, e *entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+// prune evict the expired answers, then the least recently used ones until they fit in the max bytes
+func (c *Cache) prune() {
+	names, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	type file struct {
+		name string
+		info os.FileInfo
+	}
+	var files []*file
+	var total int64
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		// an answer is created before it is last used, so it has expired if it was not used within the ttl
+		if c.expired(info.ModTime()) {
+			_ = os.Remove(name)
+			continue
+		}
+		files = append(files, &file{name: name, info: info})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].info.ModTime().Before(files[j].info.ModTime())
+	})
+	for _, f := range files {
+		if c.maxBytes <= 0 || total <= c.maxBytes {
+			break
+		}
+		if os.Remove(f.name) == nil {
+			total -= f.info.Size()
+		}
+	}
+}
@@ -0,0 +1,224 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+)
+
+func TestNormalize(t *testing.T) {
+	run := func(goroutine, arg, offset string) string {
+		return "panic: bad mask 0xff\n\n" +
+			"goroutine " + goroutine + " [running]:\n" +
+			"main.(*T).Check(" + arg + ", {0x4b2f60, 0x1}, ...)\n" +
+			"\t/app/main.go:12 +" + offset + "\n" +
+			"\n```go\n\tif v&0x10 != 0 {\n\t\tcheck(0x20)\n\t}\n```\n"
+	}
+	a := normalize(run("1", "0xc000012345", "0x1d"))
+	b := normalize(run("7", "0xc000098765", "0x2f"))
+	if a != b {
+		t.Fatalf("two runs of the same crash differ:\n%s\n---\n%s", a, b)
+	}
+	for _, want := range []string{"0xff", "0x10", "check(0x20)", "Check(0x?, {0x?, 0x?}, ...)", "main.go:12 +0x?"} {
+		if !strings.Contains(a, want) {
+			t.Errorf("normalized content lacks %q:\n%s", want, a)
+		}
+	}
+}
+
+// fakeModel big model answering with its answers in turn, the last one repeatedly,
+// or failing after the first chunk if err is set
+type fakeModel struct {
+	answers []string
+	err     error
+	calls   int
+}
+
+func (m *fakeModel) Chat([]*bigmodel.Message) chan bigmodel.Result {
+	answer := m.answers[len(m.answers)-1]
+	if m.calls < len(m.answers) {
+		answer = m.answers[m.calls]
+	}
+	m.calls++
+	out := make(chan bigmodel.Result, 3)
+	out <- bigmodel.Result{Type: bigmodel.TypeData, Content: answer}
+	if m.err != nil {
+		out <- bigmodel.Result{Type: bigmodel.TypeError, Content: m.err.Error(), Err: m.err}
+	} else {
+		out <- bigmodel.Result{Type: bigmodel.TypeUsage, Usage: &bigmodel.Usage{PromptTokens: 10, CompletionTokens: 2}}
+		out <- bigmodel.Result{Type: bigmodel.TypeDone}
+	}
+	close(out)
+	return out
+}
+
+// ask the content and the types of the results of the answer to the prompt
+func ask(ctx context.Context, bm bigmodel.BigModel, prompt string) (string, []int) {
+	var content strings.Builder
+	var types []int
+	for res := range bigmodel.ChatContext(ctx, bm, bigmodel.Messages(bigmodel.UserMessage(prompt))) {
+		content.WriteString(res.Content)
+		types = append(types, res.Type)
+	}
+	return content.String(), types
+}
+
+func cached(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestReplay(t *testing.T) {
+	fake := &fakeModel{answers: []string{"first", "second"}}
+	c := New(fake, WithDir(t.TempDir()))
+
+	if content, types := ask(context.Background(), c, "why"); content != "first" || len(types) != 3 || types[1] != bigmodel.TypeUsage {
+		t.Fatalf("got %q with the types %v, want the answer with its usage", content, types)
+	}
+	content, types := ask(context.Background(), c, "why")
+	if content != "first" || fake.calls != 1 {
+		t.Errorf("got %q after %d calls, want the cached answer", content, fake.calls)
+	}
+	if len(types) != 2 || types[0] != bigmodel.TypeData || types[1] != bigmodel.TypeDone {
+		t.Errorf("the replay sent the types %v, want no usage", types)
+	}
+	if content, _ := ask(context.Background(), c, "how"); content != "second" || fake.calls != 2 {
+		t.Errorf("got %q for another request", content)
+	}
+}
+
+func TestErrorNotStored(t *testing.T) {
+	dir := t.TempDir()
+	fake := &fakeModel{answers: []string{"partial"}, err: errors.New("connection reset")}
+	c := New(fake, WithDir(dir))
+
+	for i := 0; i < 2; i++ {
+		if _, types := ask(context.Background(), c, "why"); types[len(types)-1] != bigmodel.TypeError {
+			t.Fatalf("the answer ended with %v, want the error", types)
+		}
+	}
+	if fake.calls != 2 || len(cached(t, dir)) != 0 {
+		t.Errorf("the errored answer was cached, the big model was called %d times", fake.calls)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	dir := t.TempDir()
+	fake := &fakeModel{answers: []string{"old", "new"}}
+	c := New(fake, WithDir(dir), WithTTL(time.Hour))
+	ask(context.Background(), c, "why")
+
+	names := cached(t, dir)
+	if len(names) != 1 {
+		t.Fatalf("%d answers were cached, want 1", len(names))
+	}
+	e := new(entry)
+	data, _ := os.ReadFile(names[0])
+	if err := json.Unmarshal(data, e); err != nil {
+		t.Fatal(err)
+	}
+	e.Created = time.Now().Add(-2 * time.Hour)
+	data, _ = json.Marshal(e)
+	if err := os.WriteFile(names[0], data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := ask(context.Background(), c, "why"); content != "new" || fake.calls != 2 {
+		t.Errorf("got %q, want the expired answer asked again", content)
+	}
+	if content, _ := ask(context.Background(), c, "why"); content != "new" || fake.calls != 2 {
+		t.Errorf("got %q, want the new answer cached", content)
+	}
+}
+
+func TestPruneLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	fake := &fakeModel{answers: []string{strings.Repeat("a", 200), strings.Repeat("b", 200), strings.Repeat("c", 200)}}
+	c := New(fake, WithDir(dir), WithMaxBytes(0)).(*Cache)
+
+	ask(context.Background(), c, "a")
+	ask(context.Background(), c, "b")
+	names := cached(t, dir)
+	info, err := os.Stat(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for two answers, the one of b was used longest ago
+	c.maxBytes = 2*info.Size() + info.Size()/2
+	for i, name := range names {
+		past := time.Now().Add(-time.Duration(len(names)-i) * time.Minute)
+		if err := os.Chtimes(name, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content, _ := ask(context.Background(), c, "a"); content[0] != 'a' {
+		t.Fatalf("got %q, want the cached answer of a", content)
+	}
+	ask(context.Background(), c, "c")
+
+	if n := len(cached(t, dir)); n != 2 {
+		t.Fatalf("%d answers are cached, want 2", n)
+	}
+	calls := fake.calls
+	ask(context.Background(), c, "a")
+	ask(context.Background(), c, "c")
+	if fake.calls != calls {
+		t.Error("the recently used answers were evicted")
+	}
+	ask(context.Background(), c, "b")
+	if fake.calls != calls+1 {
+		t.Error("the least recently used answer was not evicted")
+	}
+}
+
+func TestBypass(t *testing.T) {
+	dir := t.TempDir()
+	fake := &fakeModel{answers: []string{"old", "new", "newer"}}
+	c := New(fake, WithDir(dir))
+	ask(context.Background(), c, "why")
+
+	if content, _ := ask(Bypass(context.Background()), c, "why"); content != "new" {
+		t.Errorf("got %q, want a fresh answer", content)
+	}
+	if content, _ := ask(context.Background(), c, "why"); content != "new" || fake.calls != 2 {
+		t.Errorf("got %q, want the fresh answer to replace the cached one", content)
+	}
+
+	bypassing := New(fake, WithDir(dir), WithBypass())
+	if content, _ := ask(context.Background(), bypassing, "why"); content != "newer" || fake.calls != 3 {
+		t.Errorf("got %q, want a fresh answer", content)
+	}
+	if content, _ := ask(context.Background(), c, "why"); content != "newer" {
+		t.Errorf("got %q, want the answer stored while bypassing", content)
+	}
+}
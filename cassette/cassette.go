@@ -0,0 +1,331 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cassette
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/cache"
+)
+
+// ErrNoInteraction the request matches no interaction of the cassette
+var ErrNoInteraction = errors.New("no recorded interaction matches the request")
+
+// Match how a request is matched against the recorded interactions
+type Match int
+
+const (
+	// MatchStrict match the interaction whose messages and tools are exactly those of the request
+	MatchStrict Match = iota
+	// MatchFingerprint match the interaction whose normalized messages and tools are those of the request,
+	// so that another run of the same crash still matches, even on another machine or after the code moved:
+	// the addresses and goroutine ids are masked as in cache.Key, the directories of the source files
+	// and the line numbers too
+	MatchFingerprint
+	// MatchSequence replay the interactions in the recorded order whatever the requests are,
+	// such as when the code in the prompts changes between the runs
+	MatchSequence
+)
+
+// Tape the content of a cassette file
+type Tape struct {
+	// Fingerprint the settings of the recorded big model
+	Fingerprint   string         `json:"fingerprint"`
+	ContextWindow int            `json:"context_window,omitempty"`
+	Interactions  []*Interaction `json:"interactions"`
+}
+
+// Interaction a request and the stream answering it
+type Interaction struct {
+	Messages []*bigmodel.Message `json:"messages"`
+	Tools    []*bigmodel.Tool    `json:"tools,omitempty"`
+	Chunks   []*Chunk            `json:"chunks"`
+}
+
+// Chunk a result of the stream, Delay is the time since the request or the previous chunk
+type Chunk struct {
+	Delay     time.Duration        `json:"delay"`
+	Type      int                  `json:"type"`
+	Content   string               `json:"content,omitempty"`
+	Error     string               `json:"error,omitempty"`
+	Usage     *bigmodel.Usage      `json:"usage,omitempty"`
+	ToolCalls []*bigmodel.ToolCall `json:"tool_calls,omitempty"`
+	// APIError the error response of the api, so that the replayed error is an *bigmodel.APIError too
+	APIError *bigmodel.APIError `json:"api_error,omitempty"`
+}
+
+// recordedError the replayed error of a chunk, unwrapping to the api error it was caused by
+type recordedError struct {
+	msg string
+	api *bigmodel.APIError
+}
+
+func (e *recordedError) Error() string { return e.msg }
+
+func (e *recordedError) Unwrap() error { return e.api }
+
+// Cassette big model recording the streams of another big model to a file,
+// or serving them back from the file without calling any big model
+type Cassette struct {
+	bm       bigmodel.BigModel
+	path     string
+	match    Match
+	noDelays bool
+
+	mu   sync.Mutex
+	tape *Tape
+	used []bool
+}
+
+type Option func(*Cassette)
+
+// WithMatch specify how the requests are matched when replaying, MatchStrict by default
+func WithMatch(match Match) Option {
+	return func(c *Cassette) {
+		c.match = match
+	}
+}
+
+// WithoutDelays replay the chunks at once instead of with their recorded timing
+func WithoutDelays() Option {
+	return func(c *Cassette) {
+		c.noDelays = true
+	}
+}
+
+// Record forward the requests to the big model and write every interaction to the cassette file,
+// the file is overwritten
+func Record(bm bigmodel.BigModel, path string, opts ...Option) bigmodel.BigModel {
+	c := &Cassette{
+		bm:   bm,
+		path: path,
+		tape: &Tape{Fingerprint: bigmodel.Fingerprint(bm), ContextWindow: bigmodel.ContextWindow(bm)},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Replay serve the interactions of the cassette file, identical requests get the matching interactions in the recorded order
+func Replay(path string, opts ...Option) (bigmodel.BigModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tape := new(Tape)
+	if err := json.Unmarshal(data, tape); err != nil {
+		return nil, fmt.Errorf("cassette %s: %w", path, err)
+	}
+	c := &Cassette{path: path, tape: tape, used: make([]bool, len(tape.Interactions))}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+func (c *Cassette) Chat(messages []*bigmodel.Message) chan bigmodel.Result {
+	return c.ChatContext(context.Background(), messages)
+}
+
+func (c *Cassette) ChatContext(ctx context.Context, messages []*bigmodel.Message) chan bigmodel.Result {
+	if c.bm == nil {
+		return c.replay(ctx, messages, nil)
+	}
+	return c.record(ctx, messages, nil, bigmodel.ChatContext(ctx, c.bm, messages))
+}
+
+func (c *Cassette) ChatTools(ctx context.Context, messages []*bigmodel.Message, tools []*bigmodel.Tool) chan bigmodel.Result {
+	if c.bm == nil {
+		return c.replay(ctx, messages, tools)
+	}
+	return c.record(ctx, messages, tools, bigmodel.ChatTools(ctx, c.bm, messages, tools))
+}
+
+// ContextWindow the context window of the recorded big model, so that the replayed prompts are budgeted the same
+func (c *Cassette) ContextWindow() int {
+	return c.tape.ContextWindow
+}
+
+// Embed embed the texts with the recorded big model, embeddings are neither recorded nor replayed
+func (c *Cassette) Embed(ctx context.Context, texts []string) (*bigmodel.Embeddings, error) {
+	if c.bm == nil {
+		return nil, bigmodel.ErrNoEmbeddings
+	}
+	return bigmodel.Embed(ctx, c.bm, texts)
+}
+
+func (c *Cassette) Fingerprint() string {
+	return c.tape.Fingerprint
+}
+
+func (c *Cassette) record(ctx context.Context, messages []*bigmodel.Message, tools []*bigmodel.Tool, in chan bigmodel.Result) chan bigmodel.Result {
+	out := make(chan bigmodel.Result)
+
+	go func() {
+		defer close(out)
+		it := &Interaction{Messages: make([]*bigmodel.Message, len(messages)), Tools: tools}
+		for i, msg := range messages {
+			cp := *msg
+			it.Messages[i] = &cp
+		}
+		last := time.Now()
+		for res := range in {
+			chunk := &Chunk{Delay: time.Since(last), Type: res.Type, Content: res.Content, Usage: res.Usage, ToolCalls: res.ToolCalls}
+			if res.Err != nil {
+				chunk.Error = res.Err.Error()
+				errors.As(res.Err, &chunk.APIError)
+			}
+			last = time.Now()
+			it.Chunks = append(it.Chunks, chunk)
+			if !bigmodel.Send(ctx, out, res) {
+				go bigmodel.Drain(in)
+				return
+			}
+		}
+		if err := c.save(it); err != nil {
+			log.Printf("failed to record the interaction: %v", err)
+		}
+	}()
+
+	return out
+}
+
+func (c *Cassette) save(it *Interaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tape.Interactions = append(c.tape.Interactions, it)
+	data, err := json.MarshalIndent(c.tape, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0o644)
+}
+
+func (c *Cassette) replay(ctx context.Context, messages []*bigmodel.Message, tools []*bigmodel.Tool) chan bigmodel.Result {
+	out := make(chan bigmodel.Result)
+	it := c.find(messages, tools)
+
+	go func() {
+		defer close(out)
+		if it == nil {
+			err := fmt.Errorf("cassette %s: %w", c.path, ErrNoInteraction)
+			bigmodel.Send(ctx, out, bigmodel.Result{Type: bigmodel.TypeError, Content: err.Error(), Err: err})
+			return
+		}
+		for _, chunk := range it.Chunks {
+			if !c.noDelays && chunk.Delay > 0 {
+				select {
+				case <-time.After(chunk.Delay):
+				case <-ctx.Done():
+					return
+				}
+			}
+			res := bigmodel.Result{Type: chunk.Type, Content: chunk.Content, Usage: chunk.Usage, ToolCalls: chunk.ToolCalls}
+			if chunk.APIError != nil {
+				res.Err = &recordedError{msg: chunk.Error, api: chunk.APIError}
+			} else if chunk.Error != "" {
+				res.Err = errors.New(chunk.Error)
+			}
+			if !bigmodel.Send(ctx, out, res) {
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// find the first unused interaction matching the request, or the last used one when all of them were replayed,
+// in sequence the next unused interaction
+func (c *Cassette) find(messages []*bigmodel.Message, tools []*bigmodel.Tool) *Interaction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.match == MatchSequence {
+		for i, it := range c.tape.Interactions {
+			if !c.used[i] {
+				c.used[i] = true
+				return it
+			}
+		}
+		return nil
+	}
+
+	want := c.key(messages, tools)
+	found := -1
+	for i, it := range c.tape.Interactions {
+		if !bytes.Equal(c.key(it.Messages, it.Tools), want) {
+			continue
+		}
+		found = i
+		if !c.used[i] {
+			break
+		}
+	}
+	if found < 0 {
+		return nil
+	}
+	c.used[found] = true
+	return c.tape.Interactions[found]
+}
+
+func (c *Cassette) key(messages []*bigmodel.Message, tools []*bigmodel.Tool) []byte {
+	if c.match == MatchFingerprint {
+		normalized := make([]*bigmodel.Message, len(messages))
+		for i, msg := range messages {
+			cp := *msg
+			cp.Content = normalize(cp.Content)
+			normalized[i] = &cp
+		}
+		return []byte(cache.Key("", normalized, tools))
+	}
+	data, _ := json.Marshal(Interaction{Messages: messages, Tools: tools})
+	return data
+}
+
+var (
+	// sourceRegexp match the path of a go source file, the directory is dropped
+	sourceRegexp = regexp.MustCompile(`(?:[A-Za-z]:)?[\w.\-@+~/\\]*[/\\]([\w.\-@+]+\.go)\b`)
+	// lineRegexp match the line number following the file name, with the pc offset of a stack line
+	lineRegexp = regexp.MustCompile(`(\.go):\d+(?: \+0x[0-9a-fA-F]+)?`)
+)
+
+// normalize drop what changes when the same crash happens on another machine or after the code moved,
+// the directories of the source files and the line numbers, cache.Key masks the rest
+func normalize(content string) string {
+	content = sourceRegexp.ReplaceAllString(content, "$1")
+	return lineRegexp.ReplaceAllString(content, "${1}:?")
+}
@@ -0,0 +1,261 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cassette_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/bigmodel/bigmodeltest"
+	"github.com/ahaostudy/code-diagnostic/cassette"
+	"github.com/ahaostudy/code-diagnostic/diagnostic"
+	"github.com/ahaostudy/code-diagnostic/incident"
+)
+
+const recordedAnswer = "The index `i` is 5 but `values` only has 3 elements.\n\nCheck `i < len(values)` before indexing."
+
+func crash(diag *diagnostic.Diag, values []int, i int) int {
+	defer diag.Diagnostic()
+	return values[i]
+}
+
+// TestReplayDiagnostic diagnose a crash end to end with the answer of the cassette instead of a big model
+func TestReplayDiagnostic(t *testing.T) {
+	bm, err := cassette.Replay("testdata/diagnose.json", cassette.WithMatch(cassette.MatchSequence), cassette.WithoutDelays())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	sent := filepath.Join(dir, "sent.json")
+	incidents := filepath.Join(dir, "incidents.json")
+	diag := diagnostic.NewDiag(cassette.Record(bm, sent), diagnostic.WithoutGitHistory(), diagnostic.WithIncidents(incidents))
+
+	crash(diag, []int{1, 2, 3}, 5)
+
+	// the prompt sent for the crash
+	tape := new(cassette.Tape)
+	readJSON(t, sent, tape)
+	if len(tape.Interactions) != 1 {
+		t.Fatalf("%d requests were sent, want 1", len(tape.Interactions))
+	}
+	messages := tape.Interactions[0].Messages
+	prompt := messages[len(messages)-1].Content
+	for _, want := range []string{"index out of range [5] with length 3", "func crash(", "TestReplayDiagnostic"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("the prompt does not contain %q:\n%s", want, prompt)
+		}
+	}
+
+	// the answer the diagnosis ended with
+	var recorded []*incident.Incident
+	readJSON(t, incidents, &recorded)
+	if len(recorded) != 1 {
+		t.Fatalf("%d incidents were recorded, want 1", len(recorded))
+	}
+	if got := recorded[0]; !strings.Contains(got.Panic, "index out of range") || got.Answer != recordedAnswer {
+		t.Errorf("the incident is %q answered %q, want the answer of the cassette", got.Panic, got.Answer)
+	}
+}
+
+func TestReplayNoInteraction(t *testing.T) {
+	bm, err := cassette.Replay("testdata/diagnose.json", cassette.WithoutDelays())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last bigmodel.Result
+	for res := range bm.Chat(bigmodel.Messages(bigmodel.UserMessage("another crash"))) {
+		last = res
+	}
+	if last.Type != bigmodel.TypeError || !errors.Is(last.Err, cassette.ErrNoInteraction) {
+		t.Fatalf("got %+v, want ErrNoInteraction", last)
+	}
+	if last.Content != last.Err.Error() {
+		t.Errorf("the content of the error is %q", last.Content)
+	}
+}
+
+func TestReplaySequence(t *testing.T) {
+	bm, err := cassette.Replay("testdata/diagnose.json", cassette.WithMatch(cassette.MatchSequence), cassette.WithoutDelays())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content strings.Builder
+	for res := range bm.Chat(bigmodel.Messages(bigmodel.UserMessage("any request"))) {
+		if res.Type == bigmodel.TypeData {
+			content.WriteString(res.Content)
+		}
+	}
+	if content.String() != recordedAnswer {
+		t.Errorf("replayed %q", content.String())
+	}
+	// the only interaction is used up
+	var last bigmodel.Result
+	for res := range bm.Chat(bigmodel.Messages(bigmodel.UserMessage("any request"))) {
+		last = res
+	}
+	if !errors.Is(last.Err, cassette.ErrNoInteraction) {
+		t.Errorf("got %+v after the cassette was used up, want ErrNoInteraction", last)
+	}
+}
+
+// writeTape write the interactions to a cassette file
+func writeTape(t *testing.T, interactions ...*cassette.Interaction) string {
+	t.Helper()
+	data, err := json.Marshal(&cassette.Tape{Fingerprint: "test", Interactions: interactions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func interaction(prompt string, answer string, delay time.Duration) *cassette.Interaction {
+	return &cassette.Interaction{
+		Messages: bigmodel.Messages(bigmodel.UserMessage(prompt)),
+		Chunks: []*cassette.Chunk{
+			{Delay: delay, Type: bigmodel.TypeData, Content: answer},
+			{Delay: delay, Type: bigmodel.TypeDone},
+		},
+	}
+}
+
+// answer the content of the answer to the prompt, or its error
+func answer(ctx context.Context, bm bigmodel.BigModel, prompt string) (string, error) {
+	var content strings.Builder
+	for res := range bigmodel.ChatContext(ctx, bm, bigmodel.Messages(bigmodel.UserMessage(prompt))) {
+		switch res.Type {
+		case bigmodel.TypeData:
+			content.WriteString(res.Content)
+		case bigmodel.TypeError:
+			return content.String(), res.Err
+		}
+	}
+	return content.String(), ctx.Err()
+}
+
+func TestReplayStrict(t *testing.T) {
+	bm, err := cassette.Replay(writeTape(t,
+		interaction("why", "first", 0),
+		interaction("how", "other", 0),
+		interaction("why", "second", 0),
+	), cassette.WithoutDelays())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// identical requests get the interactions in the recorded order, then the last one again
+	for _, want := range []string{"first", "second", "second"} {
+		if got, err := answer(context.Background(), bm, "why"); got != want || err != nil {
+			t.Errorf("got %q and %v, want %q", got, err, want)
+		}
+	}
+	if _, err := answer(context.Background(), bm, "why "); !errors.Is(err, cassette.ErrNoInteraction) {
+		t.Errorf("got %v for another request, want ErrNoInteraction", err)
+	}
+}
+
+func TestReplayFingerprint(t *testing.T) {
+	recorded := "panic: boom\n\ngoroutine 7 [running]:\nmain.divide(0xc000012345)\n\t/home/alice/app/main.go:12 +0x1d\n\n" +
+		"/home/alice/app/main.go:\n```go\nfunc divide() {}\n```"
+	moved := "panic: boom\n\ngoroutine 1 [running]:\nmain.divide(0xc000099999)\n\tC:\\build\\app\\main.go:14 +0x2f\n\n" +
+		"C:\\build\\app\\main.go:\n```go\nfunc divide() {}\n```"
+	path := writeTape(t, interaction(recorded, "answer", 0))
+
+	bm, err := cassette.Replay(path, cassette.WithMatch(cassette.MatchFingerprint), cassette.WithoutDelays())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := answer(context.Background(), bm, moved); got != "answer" || err != nil {
+		t.Errorf("got %q and %v, want the crash on another machine to match", got, err)
+	}
+	if _, err := answer(context.Background(), bm, strings.Replace(moved, "main.divide", "main.multiply", 1)); !errors.Is(err, cassette.ErrNoInteraction) {
+		t.Errorf("got %v for another crash, want ErrNoInteraction", err)
+	}
+
+	bm, err = cassette.Replay(path, cassette.WithoutDelays())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := answer(context.Background(), bm, moved); !errors.Is(err, cassette.ErrNoInteraction) {
+		t.Errorf("got %v, want no strict match of the crash on another machine", err)
+	}
+}
+
+func TestReplayTiming(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	bm, err := cassette.Replay(writeTape(t, interaction("why", "answer", delay)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if got, err := answer(context.Background(), bm, "why"); got != "answer" || err != nil {
+		t.Fatalf("got %q and %v", got, err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Errorf("replayed in %v, want the recorded delays of %v", elapsed, 2*delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), delay/3)
+	defer cancel()
+	if got, err := answer(ctx, bm, "why"); got != "" || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %q and %v, want the replay to stop with the context", got, err)
+	}
+}
+
+func TestReplayAPIError(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Unauthorized())
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	_, recorded := answer(context.Background(), cassette.Record(srv.ChatGPT(), path), "why")
+
+	bm, err := cassette.Replay(path, cassette.WithoutDelays())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, replayed := answer(context.Background(), bm, "why")
+	var apiErr *bigmodel.APIError
+	if !errors.As(replayed, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != "invalid_api_key" {
+		t.Fatalf("replayed %v, want the *bigmodel.APIError", replayed)
+	}
+	if recorded == nil || replayed.Error() != recorded.Error() {
+		t.Errorf("replayed %q, want the recorded %v", replayed, recorded)
+	}
+}
+
+func readJSON(t *testing.T, file string, v interface{}) {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,209 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package classify
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Panic the classified value of a panic
+type Panic struct {
+	// Value the value as text
+	Value string `json:"value"`
+	// GoType the go type of the value, such as runtime.boundsError or *errors.errorString
+	GoType string `json:"go_type"`
+	Kind   string `json:"kind"`
+
+	// Category the category of a runtime error
+	Category string `json:"category,omitempty"`
+
+	// Index and Length of index out of range, Bounds Length and Capacity of slice bounds out of range
+	Index    *int   `json:"index,omitempty"`
+	Bounds   string `json:"bounds,omitempty"`
+	Length   *int   `json:"length,omitempty"`
+	Capacity *int   `json:"capacity,omitempty"`
+
+	// Interface Expected Actual and MissingMethod of a failed type assertion
+	Interface     string `json:"interface,omitempty"`
+	Expected      string `json:"expected,omitempty"`
+	Actual        string `json:"actual,omitempty"`
+	MissingMethod string `json:"missing_method,omitempty"`
+}
+
+const (
+	KindRuntimeError = "runtime_error"
+	KindError        = "error"
+	KindString       = "string"
+	KindValue        = "value"
+	KindNil          = "nil"
+	KindBreakPoint   = "breakpoint"
+)
+
+const (
+	CategoryNilDereference  = "nil_dereference"
+	CategoryIndexOutOfRange = "index_out_of_range"
+	CategorySliceBounds     = "slice_bounds"
+	CategoryDivideByZero    = "divide_by_zero"
+	CategoryNilMapWrite     = "nil_map_write"
+	CategoryTypeAssertion   = "type_assertion"
+	CategoryClosedChannel   = "closed_channel"
+	CategoryNilChannel      = "nil_channel"
+	CategoryOther           = "other"
+)
+
+var (
+	indexRegex          = regexp.MustCompile(`index out of range \[(-?\d+)\](?: with length (\d+))?`)
+	sliceRegex          = regexp.MustCompile(`slice bounds out of range \[([^\]]*)\](?: with (length|capacity) (\d+))?`)
+	assertionRegex      = regexp.MustCompile(`^interface conversion: (.+?) is (.+?), not (.+)$`)
+	missingMethodRegex  = regexp.MustCompile(`^interface conversion: (.+?) is not (.+?): missing method (\S+)$`)
+	nilInterfaceRegex   = regexp.MustCompile(`^interface conversion: (.+?) is nil, not (.+)$`)
+	panicNilErrorGoType = "*runtime.PanicNilError"
+)
+
+// Classify classify the value recovered from a panic
+func Classify(v any) *Panic {
+	if v == nil {
+		return &Panic{Value: "panic(nil)", GoType: "nil", Kind: KindNil}
+	}
+	p := &Panic{GoType: reflect.TypeOf(v).String()}
+	switch val := v.(type) {
+	case runtime.Error:
+		p.Value = val.Error()
+		p.Kind = KindRuntimeError
+		if p.GoType == panicNilErrorGoType {
+			// panic(nil) since go1.21
+			p.Kind = KindNil
+			return p
+		}
+		p.classifyRuntimeError()
+	case error:
+		p.Value = val.Error()
+		p.Kind = KindError
+	case string:
+		p.Value = val
+		p.Kind = KindString
+	case fmt.Stringer:
+		p.Value = val.String()
+		p.Kind = KindValue
+	default:
+		p.Value = fmt.Sprintf("%+v", val)
+		p.Kind = KindValue
+	}
+	return p
+}
+
+// BreakPoint classify the message of a custom breakpoint
+func BreakPoint(msg string) *Panic {
+	return &Panic{Value: msg, GoType: "string", Kind: KindBreakPoint}
+}
+
+func (p *Panic) classifyRuntimeError() {
+	msg := strings.TrimPrefix(p.Value, "runtime error: ")
+	switch {
+	case strings.Contains(msg, "nil pointer dereference"):
+		p.Category = CategoryNilDereference
+	case strings.HasPrefix(msg, "index out of range"):
+		p.Category = CategoryIndexOutOfRange
+		if m := indexRegex.FindStringSubmatch(msg); m != nil {
+			// a negative index is reported without the length
+			p.Index, p.Length = atoi(m[1]), atoi(m[2])
+		}
+	case strings.HasPrefix(msg, "slice bounds out of range"):
+		p.Category = CategorySliceBounds
+		if m := sliceRegex.FindStringSubmatch(msg); m != nil {
+			p.Bounds = m[1]
+			if m[2] == "length" {
+				p.Length = atoi(m[3])
+			} else if m[2] == "capacity" {
+				p.Capacity = atoi(m[3])
+			}
+		}
+	case strings.Contains(msg, "divide by zero"):
+		p.Category = CategoryDivideByZero
+	case strings.Contains(msg, "assignment to entry in nil map"):
+		p.Category = CategoryNilMapWrite
+	case strings.HasPrefix(msg, "interface conversion"):
+		p.Category = CategoryTypeAssertion
+		if m := missingMethodRegex.FindStringSubmatch(msg); m != nil {
+			p.Actual, p.Expected, p.MissingMethod = m[1], m[2], m[3]
+		} else if m := nilInterfaceRegex.FindStringSubmatch(msg); m != nil {
+			p.Interface, p.Actual, p.Expected = m[1], "nil", m[2]
+		} else if m := assertionRegex.FindStringSubmatch(msg); m != nil {
+			p.Interface, p.Actual, p.Expected = m[1], m[2], m[3]
+		}
+	case strings.Contains(msg, "close of closed channel") || strings.Contains(msg, "send on closed channel"):
+		p.Category = CategoryClosedChannel
+	case strings.Contains(msg, "close of nil channel"):
+		p.Category = CategoryNilChannel
+	default:
+		p.Category = CategoryOther
+	}
+}
+
+// String describe the classification in one line
+func (p *Panic) String() string {
+	desc := fmt.Sprintf("%s of type %s", strings.ReplaceAll(p.Kind, "_", " "), p.GoType)
+	if p.Category == "" || p.Category == CategoryOther {
+		return desc
+	}
+	var details []string
+	if p.Index != nil {
+		details = append(details, fmt.Sprintf("index %d", *p.Index))
+	}
+	if p.Bounds != "" {
+		details = append(details, fmt.Sprintf("bounds [%s]", p.Bounds))
+	}
+	if p.Length != nil {
+		details = append(details, fmt.Sprintf("length %d", *p.Length))
+	}
+	if p.Capacity != nil {
+		details = append(details, fmt.Sprintf("capacity %d", *p.Capacity))
+	}
+	if p.Interface != "" {
+		details = append(details, "interface "+p.Interface)
+	}
+	if p.Expected != "" {
+		details = append(details, "expected "+p.Expected)
+	}
+	if p.Actual != "" {
+		details = append(details, "actual "+p.Actual)
+	}
+	if p.MissingMethod != "" {
+		details = append(details, "missing method "+p.MissingMethod)
+	}
+	desc += ", " + strings.ReplaceAll(p.Category, "_", " ")
+	if len(details) > 0 {
+		desc += " (" + strings.Join(details, ", ") + ")"
+	}
+	return desc
+}
+
+func atoi(s string) *int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
@@ -0,0 +1,147 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// panic(nil) panics with a *runtime.PanicNilError as it does since go1.21, whatever the go version of the module
+//
+//go:debug panicnil=0
+
+package classify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// recovered the value recovered from the panic of f
+func recovered(f func()) (v any) {
+	defer func() {
+		v = recover()
+	}()
+	f()
+	return nil
+}
+
+type celsius float64
+
+func (c celsius) String() string { return fmt.Sprintf("%.1f°C", float64(c)) }
+
+type stringer interface{ String() string }
+
+func TestClassify(t *testing.T) {
+	var (
+		values   = []int{1, 2, 3}
+		index    = 5
+		low      = 4
+		m        map[string]int
+		p        *struct{ n int }
+		boxed    any = "text"
+		nilBoxed any
+		zero     = 0
+		closed   = make(chan int)
+		nilChan  chan int
+	)
+	close(closed)
+
+	tests := []struct {
+		name  string
+		panic func()
+		want  Panic
+	}{
+		{name: "index out of range", panic: func() { _ = values[index] },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.boundsError", Category: CategoryIndexOutOfRange,
+				Index: intp(5), Length: intp(3)}},
+		{name: "negative index", panic: func() { i := -1; _ = values[i+zero] },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.boundsError", Category: CategoryIndexOutOfRange,
+				Index: intp(-1)}},
+		{name: "slice beyond the capacity", panic: func() { _ = values[:index] },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.boundsError", Category: CategorySliceBounds,
+				Bounds: ":5", Capacity: intp(3)}},
+		{name: "slice bounds inverted", panic: func() { _ = values[low : index-2] },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.boundsError", Category: CategorySliceBounds, Bounds: "4:3"}},
+		{name: "string beyond the length", panic: func() { _ = "abc"[1:index] },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.boundsError", Category: CategorySliceBounds,
+				Bounds: ":5", Length: intp(3)}},
+		{name: "nil map write", panic: func() { m["a"] = 1 },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.plainError", Category: CategoryNilMapWrite}},
+		{name: "nil dereference", panic: func() { _ = p.n },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.errorString", Category: CategoryNilDereference}},
+		{name: "divide by zero", panic: func() { _ = index / zero },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.errorString", Category: CategoryDivideByZero}},
+		{name: "type assertion", panic: func() { _ = boxed.(int) },
+			want: Panic{Kind: KindRuntimeError, GoType: "*runtime.TypeAssertionError", Category: CategoryTypeAssertion,
+				Interface: "interface {}", Actual: "string", Expected: "int"}},
+		{name: "nil type assertion", panic: func() { _ = nilBoxed.(string) },
+			want: Panic{Kind: KindRuntimeError, GoType: "*runtime.TypeAssertionError", Category: CategoryTypeAssertion,
+				Interface: "interface {}", Actual: "nil", Expected: "string"}},
+		{name: "missing method", panic: func() { _ = boxed.(stringer) },
+			want: Panic{Kind: KindRuntimeError, GoType: "*runtime.TypeAssertionError", Category: CategoryTypeAssertion,
+				Actual: "string", Expected: "classify.stringer", MissingMethod: "String"}},
+		{name: "close of closed channel", panic: func() { close(closed) },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.plainError", Category: CategoryClosedChannel}},
+		{name: "send on closed channel", panic: func() { closed <- 1 },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.plainError", Category: CategoryClosedChannel}},
+		{name: "close of nil channel", panic: func() { close(nilChan) },
+			want: Panic{Kind: KindRuntimeError, GoType: "runtime.plainError", Category: CategoryNilChannel}},
+		{name: "error", panic: func() { panic(io.ErrUnexpectedEOF) },
+			want: Panic{Kind: KindError, GoType: "*errors.errorString", Value: "unexpected EOF"}},
+		{name: "wrapped error", panic: func() { panic(fmt.Errorf("read config: %w", io.EOF)) },
+			want: Panic{Kind: KindError, GoType: "*fmt.wrapError", Value: "read config: EOF"}},
+		{name: "custom error", panic: func() { panic(&customError{code: 7}) },
+			want: Panic{Kind: KindError, GoType: "*classify.customError", Value: "custom error 7"}},
+		{name: "string", panic: func() { panic("unreachable") },
+			want: Panic{Kind: KindString, GoType: "string", Value: "unreachable"}},
+		{name: "stringer", panic: func() { panic(celsius(-3)) },
+			want: Panic{Kind: KindValue, GoType: "classify.celsius", Value: "-3.0°C"}},
+		{name: "value", panic: func() { panic(struct{ Code int }{42}) },
+			want: Panic{Kind: KindValue, GoType: "struct { Code int }", Value: "{Code:42}"}},
+		{name: "panic nil", panic: func() { panic(nil) },
+			want: Panic{Kind: KindNil, GoType: "*runtime.PanicNilError"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := recovered(tt.panic)
+			if tt.want.Value == "" {
+				tt.want.Value = fmt.Sprint(v)
+			}
+			if got := Classify(v); !reflect.DeepEqual(got, &tt.want) {
+				t.Errorf("classified %q as\n%s\nwant\n%s", v, dump(got), dump(&tt.want))
+			}
+		})
+	}
+}
+
+func intp(n int) *int { return &n }
+
+func dump(p *Panic) string {
+	data, _ := json.Marshal(p)
+	return string(data)
+}
+
+type customError struct{ code int }
+
+func (e *customError) Error() string { return fmt.Sprintf("custom error %d", e.code) }
+
+func TestClassifyNil(t *testing.T) {
+	if got := Classify(nil); got.Kind != KindNil || got.Value != "panic(nil)" {
+		t.Errorf("classified nil as %+v", got)
+	}
+}
@@ -0,0 +1,254 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command diagbundle packs the go source files of a module into a bundle,
+// so that binaries deployed without their source tree can still be diagnosed.
+//
+// An embedded bundle is a go package to be embedded into the binary:
+//
+//	diagbundle -root . -out internal/diagsrc
+//	parse.SetSourceProvider(must(parse.NewBundleProvider(diagsrc.Bundle)))
+//
+// A sidecar archive is a zip file shipped next to the binary:
+//
+//	diagbundle -root . -archive app.src.zip
+//	parse.SetSourceProvider(must(parse.NewArchiveProvider("app.src.zip")))
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/parse"
+)
+
+const (
+	bundleDir    = "src"
+	bundleSuffix = ".src"
+)
+
+var (
+	root    = flag.String("root", ".", "root directory of the module")
+	out     = flag.String("out", "", "directory of the generated embedded bundle package")
+	pkg     = flag.String("pkg", "", "package name of the embedded bundle, the base name of -out by default")
+	archive = flag.String("archive", "", "path of the generated sidecar zip archive")
+	include = flag.String("include", "", "comma separated glob patterns of the files to pack, all go files by default")
+	exclude = flag.String("exclude", "", "comma separated glob patterns of the files to skip")
+	tests   = flag.Bool("tests", false, "pack _test.go files as well")
+)
+
+func main() {
+	flag.Parse()
+	if (*out == "") == (*archive == "") {
+		log.Fatalln("exactly one of -out and -archive must be specified")
+	}
+
+	absRoot, err := filepath.Abs(*root)
+	if err != nil {
+		log.Fatalln("resolve root failed:", err)
+	}
+	manifest := &parse.BundleManifest{
+		Module:  readModulePath(absRoot),
+		Root:    absRoot,
+		Dir:     bundleDir,
+		Created: time.Now().UTC(),
+	}
+	files, err := collectFiles(absRoot)
+	if err != nil {
+		log.Fatalln("collect source files failed:", err)
+	}
+
+	if *archive != "" {
+		err = writeArchive(*archive, absRoot, files, manifest)
+	} else {
+		manifest.Suffix = bundleSuffix
+		err = writeEmbedded(*out, absRoot, files, manifest)
+	}
+	if err != nil {
+		log.Fatalln("write bundle failed:", err)
+	}
+	log.Printf("packed %d source files of %s", len(files), absRoot)
+}
+
+// collectFiles the slash separated paths of the matched go files relative to root
+func collectFiles(root string) ([]string, error) {
+	var skip string
+	if *out != "" {
+		skip, _ = filepath.Abs(*out)
+	}
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			name := d.Name()
+			if p != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata" || p == skip) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(rel, ".go") || (!*tests && strings.HasSuffix(rel, "_test.go")) {
+			return nil
+		}
+		if (*include == "" || match(*include, rel)) && !match(*exclude, rel) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// match report whether any of the comma separated patterns matches the path or its base name
+func match(patterns, rel string) bool {
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/...") && strings.HasPrefix(rel, strings.TrimSuffix(pattern, "...")) {
+			return true
+		}
+	}
+	return false
+}
+
+func readModulePath(root string) string {
+	f, err := os.Open(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if module, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "module "); ok {
+			return strings.Trim(strings.TrimSpace(module), `"`)
+		}
+	}
+	return ""
+}
+
+func writeArchive(file, root string, files []string, manifest *parse.BundleManifest) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	if err := writeZipFile(zw, parse.BundleManifestName, manifest); err != nil {
+		return err
+	}
+	for _, rel := range files {
+		w, err := zw.Create(path.Join(manifest.Dir, rel))
+		if err != nil {
+			return err
+		}
+		if err := copyFile(w, filepath.Join(root, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeZipFile(zw *zip.Writer, name string, v any) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+func writeEmbedded(dir, root string, files []string, manifest *parse.BundleManifest) error {
+	if *pkg == "" {
+		abs, _ := filepath.Abs(dir)
+		*pkg = strings.ReplaceAll(filepath.Base(abs), "-", "_")
+	}
+	// remove the sources of the previous generation
+	if err := os.RemoveAll(filepath.Join(dir, manifest.Dir)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, rel := range files {
+		// the suffix keeps the go tool from treating the packed files as part of the build
+		dst := filepath.Join(dir, manifest.Dir, filepath.FromSlash(rel)+manifest.Suffix)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		w, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		err = copyFile(w, filepath.Join(root, filepath.FromSlash(rel)))
+		_ = w.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, parse.BundleManifestName), data, 0o644); err != nil {
+		return err
+	}
+	source := fmt.Sprintf(`// Code generated by diagbundle. DO NOT EDIT.
+
+package %s
+
+import "embed"
+
+// Bundle the packed source files, read them with parse.NewBundleProvider(Bundle)
+//
+//go:embed %s %s
+var Bundle embed.FS
+`, *pkg, parse.BundleManifestName, manifest.Dir)
+	return os.WriteFile(filepath.Join(dir, "bundle.go"), []byte(source), 0o644)
+}
+
+func copyFile(w io.Writer, file string) error {
+	r, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -20,14 +20,27 @@
 package diagnostic
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/ahaostudy/code-diagnostic/agent"
 	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/cache"
+	"github.com/ahaostudy/code-diagnostic/classify"
+	"github.com/ahaostudy/code-diagnostic/heuristic"
+	"github.com/ahaostudy/code-diagnostic/history"
+	"github.com/ahaostudy/code-diagnostic/incident"
 	"github.com/ahaostudy/code-diagnostic/parse"
+	"github.com/ahaostudy/code-diagnostic/prompt"
+	"github.com/ahaostudy/code-diagnostic/redact"
+	"github.com/ahaostudy/code-diagnostic/report"
+	"github.com/ahaostudy/code-diagnostic/structured"
 	"github.com/ahaostudy/code-diagnostic/web"
 )
 
@@ -39,14 +52,33 @@ const (
 type Diag struct {
 	BigModel bigmodel.BigModel
 
-	useChinese bool
-	useWeb     bool
-	webPort    int
+	ctx         context.Context
+	language    string
+	guidance    string
+	systemTmpl  *template.Template
+	userTmpl    *template.Template
+	useWeb      bool
+	webPort     int
+	tokenBudget int
+	noHistory   bool
+	historyOpts []history.Option
+	redactor    *redact.Redactor
+	noRedaction bool
+	detectors   []heuristic.Detector
+	prices      bigmodel.Prices
+	useTools    bool
+	agentOpts   []agent.Option
+	useCache    bool
+	cacheOpts   []cache.Option
+	structured  bool
+	incidents   *incident.Index
 }
 
 func NewDiag(bm bigmodel.BigModel, opts ...Option) *Diag {
 	d := &Diag{
 		BigModel: bm,
+		ctx:      context.Background(),
+		prices:   bigmodel.DefaultPrices,
 	}
 	for _, opt := range opts {
 		opt(d)
@@ -54,12 +86,20 @@ func NewDiag(bm bigmodel.BigModel, opts ...Option) *Diag {
 	if d.webPort == 0 {
 		d.webPort = defaultWebPort
 	}
+	if d.noRedaction {
+		d.redactor = nil
+	} else if d.redactor == nil {
+		d.redactor = redact.New()
+	}
+	if _, ok := bm.(bigmodel.ToolBigModel); d.useTools && !ok {
+		log.Printf("%T cannot call tools, it diagnoses without them", bm)
+	}
 	return d
 }
 
 func (diag *Diag) Diagnostic() {
 	if r := recover(); r != nil {
-		pnc := fmt.Sprintf("%s", r)
+		pnc := classify.Classify(r)
 		stack := string(debug.Stack())
 		frames := getCallersFrames(defaultMaxStack)
 		diag.diagnostic(pnc, stack, frames)
@@ -69,61 +109,255 @@ func (diag *Diag) Diagnostic() {
 func (diag *Diag) BreakPoint(pnc string) {
 	stack := string(debug.Stack())
 	frames := getCallersFrames(defaultMaxStack)
-	diag.diagnostic(pnc, stack, frames)
+	diag.diagnostic(classify.BreakPoint(pnc), stack, frames)
 }
 
-func (diag *Diag) diagnostic(pnc, stack string, frames *runtime.Frames) {
-	log.Printf("diagnostic detected:\n\n\t%v\n\n\t%v",
+func (diag *Diag) diagnostic(pnc *classify.Panic, stack string, frames *runtime.Frames) {
+	log.Printf("diagnostic detected:\n\n\t%v\n\t(%v)\n\n\t%v",
+		pnc.Value,
 		pnc,
 		strings.ReplaceAll(stack, "\n", "\n\t"),
 	)
-	localFuns := parse.GetFuncList(frames)
+	rep := &report.Report{
+		Panic:          pnc.Value,
+		Classification: pnc,
+		Stack:          stack,
+		LocalFunctions: parse.GetFuncList(frames),
+	}
+	stackTraces := parse.StackTraces([]byte(stack))
+	if len(rep.LocalFunctions) > 0 {
+		ctx := heuristic.NewContext(pnc, rep.LocalFunctions[0], stackTraces)
+		rep.Findings = heuristic.Run(ctx, diag.detectors...)
+	}
+	if !diag.noHistory {
+		rep.History = history.Collect(rep.LocalFunctions, diag.historyOpts...)
+	}
+	if diag.useWeb {
+		rep.Functions = parse.GetFuncListWithStackTraces(stackTraces)
+	}
+	diag.redactReport(rep)
+	for _, f := range rep.Findings {
+		log.Printf("finding of %s at %s:%d: %s", f.Detector, f.File, f.Line, f.Message)
+	}
+
+	// usage of this diagnosis, it is added to the process usage as well
+	meter := new(bigmodel.Meter)
+	id, q := diag.similar(rep, meter)
+	budget := diag.budget()
 	if !diag.useWeb {
-		diag.analyze(pnc, stack, localFuns)
+		answer := diag.analyze(rep, meter, budget)
+		diag.record(id, rep, answer, q)
 	} else {
-		stackTraces := parse.StackTraces([]byte(stack))
-		funs := parse.GetFuncListWithStackTraces(stackTraces)
+		var onAnswer func(string)
+		if diag.incidents != nil {
+			onAnswer = func(answer string) {
+				diag.record(id, rep, answer, q)
+			}
+		}
 		web.InitConfig(&web.Config{
-			Panic:          pnc,
-			Stack:          stack,
-			LocalFunctions: localFuns,
-			Functions:      funs,
-			BigModel:       diag.BigModel,
-			UseChinese:     diag.useChinese,
+			Report:        rep,
+			BigModel:      diag.bigModel(meter),
+			Redactor:      diag.redactor,
+			TokenBudget:   budget,
+			PromptOptions: diag.promptOptions(),
+			Meter:         meter,
+			Prices:        diag.prices,
+			Structured:    diag.structured,
+			OnAnswer:      onAnswer,
 		})
-		if err := web.Run(diag.webPort); err != nil {
+		if err := web.RunContext(diag.ctx, diag.webPort); err != nil {
 			log.Fatalln("web run error:", err)
 		}
 	}
 }
 
-func (diag *Diag) analyze(pnc, stack string, funs []*parse.Function) {
-	var msg string
-	msg += "The following error occurred in the current program: \n```\n" + pnc + "\n```\n\n"
-	msg += "Here is its call stack: \n```\n" + stack + "```\n\n"
-	msg += "The source code list is as follows:\n" + parse.BuildFuncListDescription(funs) + "\n"
-	if diag.useChinese {
-		msg += "Please reply in Chinese to help analyze the cause of the error and solve it!"
+// similar search the incidents similar to the report and set them on it,
+// it returns the id and the embedding the report is recorded with once it is answered
+func (diag *Diag) similar(rep *report.Report, meter *bigmodel.Meter) (string, *incident.Vector) {
+	if diag.incidents == nil {
+		return "", nil
+	}
+	id := fmt.Sprint(time.Now().UnixNano())
+	q := incident.Embed(diag.ctx, diag.bigModel(meter), incident.Text(rep))
+	rep.Similar = diag.incidents.Search(q, id)
+	for _, s := range rep.Similar {
+		log.Printf("similar incident of %s (%.0f%%): %s", s.Time.Format("2006-01-02"), s.Score*100, s.Panic)
+	}
+	return id, q
+}
+
+// record add the answered report to the incidents, so that later similar crashes find it
+func (diag *Diag) record(id string, rep *report.Report, answer string, q *incident.Vector) {
+	if diag.incidents == nil || strings.TrimSpace(answer) == "" {
+		return
+	}
+	if err := diag.incidents.Add(id, rep, answer, q); err != nil {
+		log.Println("record incident error:", err)
+	}
+}
+
+// budget the token budget of the prompt, derived from the context window of the big model unless specified.
+// The big model is checked first, local models only know their context window once they are checked.
+func (diag *Diag) budget() int {
+	if diag.tokenBudget > 0 {
+		return diag.tokenBudget
+	}
+	if err := bigmodel.Check(diag.ctx, diag.BigModel); err != nil {
+		log.Println("big model check error:", err)
+	}
+	return prompt.BudgetFor(bigmodel.ContextWindow(diag.BigModel))
+}
+
+// analyze print the answer of the big model and return it
+func (diag *Diag) analyze(rep *report.Report, meter *bigmodel.Meter, budget int) string {
+	messages, omitted, err := diag.promptBuilder(budget).Build(rep)
+	if err != nil {
+		log.Println("build prompt error:", err)
+		return ""
+	}
+	rep.Omitted = omitted
+	for _, o := range rep.Omitted {
+		log.Printf("prompt %s %s %s: %d tokens omitted", o.Action, o.Section, o.Name, o.Tokens)
+	}
+
+	// the redactions of this conversation, the redactor counts those of the whole process
+	before := diag.redactor.Summary()
+	bm := diag.bigModel(meter)
+	ctx := bigmodel.WithCrash(diag.ctx, rep.Crash())
+	var answer string
+	if diag.structured {
+		d, text, err := structured.Diagnose(ctx, bm, messages, func(ans bigmodel.Result) {
+			diag.observe(rep, ans)
+		})
+		if err != nil {
+			log.Println("big model response error:", err)
+		}
+		answer = text
+		rep.Diagnosis = d
+		if d != nil {
+			answer = d.Markdown()
+		}
+		print(answer)
 	} else {
-		msg += "Please help analyze the cause of the error and solve it!"
-	}
-
-	answer := diag.BigModel.Chat(bigmodel.Messages(bigmodel.UserMessage(msg)))
-	for finish := false; !finish; {
-		ans := <-answer
-		switch ans.Type {
-		case bigmodel.TypeData:
-			print(ans.Content)
-		case bigmodel.TypeDone:
-			finish = true
-		case bigmodel.TypeError:
-			log.Fatalln("chatgpt response error:", ans.Content)
-		default:
-			log.Fatalln("chatgpt response unknown type:", ans.Type)
+		var buf strings.Builder
+		for ans := range bigmodel.ChatContext(ctx, bm, messages) {
+			if ans.Type == bigmodel.TypeData {
+				print(ans.Content)
+				buf.WriteString(ans.Content)
+				continue
+			}
+			diag.observe(rep, ans)
 		}
+		answer = buf.String()
 	}
-	close(answer)
 	println()
+
+	rep.Redactions = redact.Merge(rep.Redactions, diag.redactor.Since(before))
+	for _, r := range rep.Redactions {
+		log.Printf("redacted %d %s before sending", r.Count, r.Rule)
+	}
+
+	if usage := meter.Usage(); len(usage) > 0 {
+		rep.Usage = diag.prices.Bill(usage)
+		log.Printf("token usage: %v, process total: %v", rep.Usage, diag.prices.Bill(bigmodel.ProcessMeter.Usage()))
+	}
+	return answer
+}
+
+// observe log the results of the big model other than the answer
+func (diag *Diag) observe(rep *report.Report, ans bigmodel.Result) {
+	switch ans.Type {
+	case bigmodel.TypeRoute:
+		rep.Backend = ans.Content
+		log.Println("answered by", ans.Content)
+	case bigmodel.TypeToolCall:
+		for _, call := range ans.ToolCalls {
+			log.Printf("tool call %s(%s): %d bytes", call.Name, call.Arguments, len(ans.Content))
+		}
+	case bigmodel.TypeDone, bigmodel.TypeUsage:
+	case bigmodel.TypeError:
+		log.Println("big model response error:", ans.Err)
+	default:
+		log.Println("big model response unknown type:", ans.Type)
+	}
+}
+
+// bigModel the big model that only ever receives redacted messages, including the tool output,
+// its token usage is added to the meter and the process meter, the answers replayed from the cache cost nothing
+func (diag *Diag) bigModel(meter *bigmodel.Meter) bigmodel.BigModel {
+	bm := diag.BigModel
+	if diag.useCache {
+		bm = cache.New(bm, diag.cacheOpts...)
+	}
+	if diag.redactor != nil {
+		bm = diag.redactor.Wrap(bm)
+	}
+	bm = bigmodel.Metered(bm, meter, bigmodel.ProcessMeter)
+	if diag.useTools {
+		bm = agent.New(bm, diag.agentOpts...)
+	}
+	return bm
+}
+
+// redactReport redact the report in place, so that neither the prompt nor the web ever see the original content
+func (diag *Diag) redactReport(rep *report.Report) {
+	if diag.redactor == nil {
+		return
+	}
+	before := diag.redactor.Summary()
+	r := diag.redactor.Redact
+	rep.Panic = r(rep.Panic)
+	rep.Classification.Value = rep.Panic
+	for _, f := range rep.Findings {
+		f.Message = r(f.Message)
+	}
+	rep.Stack = r(rep.Stack)
+	for _, f := range append(rep.LocalFunctions[:len(rep.LocalFunctions):len(rep.LocalFunctions)], rep.Functions...) {
+		f.Source = r(f.Source)
+	}
+	if h := rep.History; h != nil {
+		for _, b := range h.Blames {
+			b.Code = r(b.Code)
+			b.Commit.Author = r(b.Commit.Author)
+			b.Commit.Subject = r(b.Commit.Subject)
+		}
+		for _, l := range h.Logs {
+			for _, c := range l.Commits {
+				c.Author = r(c.Author)
+				c.Subject = r(c.Subject)
+			}
+		}
+		for _, d := range h.Diffs {
+			d.Patch = r(d.Patch)
+		}
+	}
+	rep.Redactions = diag.redactor.Since(before)
+}
+
+func (diag *Diag) promptBuilder(budget int) *prompt.Builder {
+	opts := append(diag.promptOptions(), prompt.WithBudget(budget))
+	if diag.structured {
+		opts = append(opts, prompt.WithStructured())
+	}
+	return prompt.NewBuilder(opts...)
+}
+
+// promptOptions the options of the prompt shared by the diagnosis and the web chat
+func (diag *Diag) promptOptions() []prompt.Option {
+	var opts []prompt.Option
+	if diag.language != "" {
+		opts = append(opts, prompt.WithLanguage(diag.language))
+	}
+	if diag.guidance != "" {
+		opts = append(opts, prompt.WithGuidance(diag.guidance))
+	}
+	if diag.systemTmpl != nil {
+		opts = append(opts, prompt.WithSystemTemplate(diag.systemTmpl))
+	}
+	if diag.userTmpl != nil {
+		opts = append(opts, prompt.WithUserTemplate(diag.userTmpl))
+	}
+	return opts
 }
 
 func getCallersFrames(max int) *runtime.Frames {
@@ -19,12 +19,69 @@
 
 package diagnostic
 
+import (
+	"context"
+	"log"
+	"text/template"
+
+	"github.com/ahaostudy/code-diagnostic/agent"
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/cache"
+	"github.com/ahaostudy/code-diagnostic/heuristic"
+	"github.com/ahaostudy/code-diagnostic/history"
+	"github.com/ahaostudy/code-diagnostic/incident"
+	"github.com/ahaostudy/code-diagnostic/parse"
+	"github.com/ahaostudy/code-diagnostic/prompt"
+	"github.com/ahaostudy/code-diagnostic/redact"
+)
+
 type Option func(*Diag)
 
 // WithUseChinese use chinese to output analysis results
+//
+// Deprecated: use WithLanguage("zh")
 func WithUseChinese() Option {
+	return WithLanguage("zh")
+}
+
+// WithLanguage output the analysis results in the language of the BCP 47 tag, such as "ja" or "pt-BR",
+// a malformed tag is ignored
+func WithLanguage(tag string) Option {
 	return func(diag *Diag) {
-		diag.useChinese = true
+		if !prompt.ValidLanguage(tag) {
+			log.Printf("ignoring the malformed language tag %q", tag)
+			return
+		}
+		diag.language = tag
+	}
+}
+
+// WithGuidance add the guidance of the project to the system message of the big model,
+// such as its conventions or the usual causes of its errors
+func WithGuidance(guidance string) Option {
+	return func(diag *Diag) {
+		diag.guidance = guidance
+	}
+}
+
+// WithProjectGuidance add the DIAGNOSTIC.md of the working directory or of its closest parent
+// in the repository to the system message of the big model
+func WithProjectGuidance() Option {
+	return func(diag *Diag) {
+		guidance, err := prompt.FindGuidance(".")
+		if err != nil {
+			log.Println("read project guidance error:", err)
+			return
+		}
+		diag.guidance = guidance
+	}
+}
+
+// WithPromptTemplates replace the templates of the system and user messages, nil keeps the default one,
+// see prompt.DefaultSystemTemplate and prompt.DefaultUserTemplate for the data they are executed with
+func WithPromptTemplates(system, user *template.Template) Option {
+	return func(diag *Diag) {
+		diag.systemTmpl, diag.userTmpl = system, user
 	}
 }
 
@@ -39,3 +96,118 @@ func WithSpecifyWebPort(port int) Option {
 		diag.webPort = port
 	}
 }
+
+// WithTokenBudget specify the most tokens the prompt can take,
+// by default it is derived from the context window of the big model
+func WithTokenBudget(tokens int) Option {
+	return func(diag *Diag) {
+		diag.tokenBudget = tokens
+	}
+}
+
+// WithGitHistoryLimit specify how many commits are listed for each function
+// and the most bytes of git history added to the diagnosis
+func WithGitHistoryLimit(commits, bytes int) Option {
+	return func(diag *Diag) {
+		diag.historyOpts = append(diag.historyOpts, history.WithMaxCommits(commits), history.WithMaxBytes(bytes))
+	}
+}
+
+// WithoutGitHistory do not add the git history of the failing code to the diagnosis
+func WithoutGitHistory() Option {
+	return func(diag *Diag) {
+		diag.noHistory = true
+	}
+}
+
+// WithSourceProvider specify where the source files of the stack are read from,
+// such as a bundle packed by the diagbundle command for binaries deployed without their source tree,
+// the provider is shared by every Diag of the process
+func WithSourceProvider(p parse.SourceProvider) Option {
+	return func(diag *Diag) {
+		parse.SetSourceProvider(p)
+	}
+}
+
+// WithRedactor specify the redactor applied to everything sent to the big model or served by the web,
+// by default only the builtin rules are applied
+func WithRedactor(r *redact.Redactor) Option {
+	return func(diag *Diag) {
+		diag.redactor = r
+	}
+}
+
+// WithoutRedaction send the source and the panic as they are
+func WithoutRedaction() Option {
+	return func(diag *Diag) {
+		diag.noRedaction = true
+	}
+}
+
+// WithDetectors add detectors run before the big model, in addition to the builtin and registered ones
+func WithDetectors(detectors ...heuristic.Detector) Option {
+	return func(diag *Diag) {
+		diag.detectors = append(diag.detectors, detectors...)
+	}
+}
+
+// WithContext specify the context of the diagnosis, the big model request is aborted
+// and the web service is shut down when it is done
+func WithContext(ctx context.Context) Option {
+	return func(diag *Diag) {
+		diag.ctx = ctx
+	}
+}
+
+// WithPrices add or override the prices of bigmodel.DefaultPrices used to report the cost of the diagnosis
+func WithPrices(prices bigmodel.Prices) Option {
+	return func(diag *Diag) {
+		merged := make(bigmodel.Prices, len(diag.prices)+len(prices))
+		for model, price := range diag.prices {
+			merged[model] = price
+		}
+		for model, price := range prices {
+			merged[model] = price
+		}
+		diag.prices = merged
+	}
+}
+
+// WithTools let the big model read functions, files, declarations, callers and git logs of the project
+// while it diagnoses, the tools are served locally and their output is redacted like the prompt
+func WithTools(opts ...agent.Option) Option {
+	return func(diag *Diag) {
+		diag.useTools = true
+		diag.agentOpts = append(diag.agentOpts, opts...)
+	}
+}
+
+// WithCache replay the answer of an identical earlier diagnosis from disk instead of asking the big model again,
+// the answers are cached after redaction so no secret is written to disk
+func WithCache(opts ...cache.Option) Option {
+	return func(diag *Diag) {
+		diag.useCache = true
+		diag.cacheOpts = append(diag.cacheOpts, opts...)
+	}
+}
+
+// WithStructuredOutput ask the big model for a diagnosis matching report.DiagnosisSchema,
+// which is set on the report and rendered instead of the free-form answer
+func WithStructuredOutput() Option {
+	return func(diag *Diag) {
+		diag.structured = true
+	}
+}
+
+// WithIncidents keep the diagnosed incidents in an index at the path, and tell the big model and the web page
+// about the past incidents most similar to a new one, embedded by the big model or locally if it has no embeddings
+func WithIncidents(path string, opts ...incident.Option) Option {
+	return func(diag *Diag) {
+		idx, err := incident.Open(path, opts...)
+		if err != nil {
+			log.Println("open incidents error:", err)
+			return
+		}
+		diag.incidents = idx
+	}
+}
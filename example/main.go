@@ -30,8 +30,9 @@ import (
 )
 
 var (
-	baseURL string
-	apiKey  string
+	baseURL     string
+	apiKey      string
+	ollamaModel string
 )
 
 func init() {
@@ -40,15 +41,24 @@ func init() {
 	// set the base_url and api_key of ChatGPT
 	baseURL = os.Getenv("BASE_URL")
 	apiKey = os.Getenv("API_KEY")
+	// or the model of a local Ollama server
+	ollamaModel = os.Getenv("OLLAMA_MODEL")
 }
 
 func main() {
+	// use the ChatGPT model, a local Ollama model, or the offline model when neither is set
+	bm := bigmodel.NewOffline()
+	if apiKey != "" {
+		bm = bigmodel.NewChatGPT(apiKey, bigmodel.WithSpecifyBaseURL(baseURL))
+	} else if ollamaModel != "" {
+		bm = bigmodel.NewOllama(ollamaModel, bigmodel.WithOllamaPull())
+	}
+
 	// initialize a diagnostic tool
 	diag := diagnostic.NewDiag(
-		// use the ChatGPT model
-		bigmodel.NewChatGPT(apiKey, bigmodel.WithSpecifyBaseURL(baseURL)),
-		// use chinese
-		diagnostic.WithUseChinese(),
+		bm,
+		// reply in chinese, any BCP 47 language tag can be used
+		diagnostic.WithLanguage("zh"),
 		// use web
 		diagnostic.WithUseWeb(),
 	)
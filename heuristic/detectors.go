@@ -0,0 +1,328 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package heuristic
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/ahaostudy/code-diagnostic/classify"
+)
+
+func init() {
+	Register(
+		divideByZero{},
+		nilMapWrite{},
+		outOfRange{},
+		nilDereference{},
+		typeAssertion{},
+		closedChannel{},
+	)
+}
+
+// origin describe where the value of the expression comes from
+func (ctx *Context) origin(e ast.Expr) string {
+	ident, ok := e.(*ast.Ident)
+	if !ok {
+		return ""
+	}
+	if ctx.Param(ident.Name) {
+		desc := fmt.Sprintf(" comes from parameter `%s` of %s", ident.Name, ctx.Function.Name)
+		if arg := ctx.Arg(ident.Name); arg != nil && arg.Value != "" && !arg.Inaccurate {
+			desc += fmt.Sprintf(", which is %s in this call", arg.Value)
+		}
+		return desc
+	}
+	if def := ctx.Definition(ident.Name); def != nil {
+		if assign, ok := def.(*ast.AssignStmt); ok && len(assign.Rhs) == 1 {
+			if _, ok := assign.Rhs[0].(*ast.CallExpr); ok && hasIdent(assign.Lhs, "_") {
+				return fmt.Sprintf(" is returned by `%s` at line %d, whose error is ignored", types.ExprString(assign.Rhs[0]), ctx.Line(def))
+			}
+		}
+		return fmt.Sprintf(" is declared at line %d", ctx.Line(def))
+	}
+	return ""
+}
+
+type divideByZero struct{}
+
+func (divideByZero) Name() string {
+	return "divide_by_zero"
+}
+
+func (divideByZero) Detect(ctx *Context) []*Finding {
+	if ctx.Panic.Category != classify.CategoryDivideByZero {
+		return nil
+	}
+	var findings []*Finding
+	for _, n := range ctx.Nodes {
+		var divisor ast.Expr
+		switch x := n.(type) {
+		case *ast.BinaryExpr:
+			if x.Op == token.QUO || x.Op == token.REM {
+				divisor = x.Y
+			}
+		case *ast.AssignStmt:
+			if (x.Tok == token.QUO_ASSIGN || x.Tok == token.REM_ASSIGN) && len(x.Rhs) == 1 {
+				divisor = x.Rhs[0]
+			}
+		}
+		if divisor == nil {
+			continue
+		}
+		name := types.ExprString(divisor)
+		msg := fmt.Sprintf("divisor `%s`%s", name, ctx.origin(divisor))
+		if !ctx.Compared(name, "0") {
+			msg += "; no zero check"
+		}
+		findings = append(findings, &Finding{Message: msg})
+	}
+	return findings
+}
+
+type nilMapWrite struct{}
+
+func (nilMapWrite) Name() string {
+	return "nil_map_write"
+}
+
+func (nilMapWrite) Detect(ctx *Context) []*Finding {
+	if ctx.Panic.Category != classify.CategoryNilMapWrite {
+		return nil
+	}
+	var findings []*Finding
+	for _, n := range ctx.Nodes {
+		var lhs []ast.Expr
+		switch x := n.(type) {
+		case *ast.AssignStmt:
+			lhs = x.Lhs
+		case *ast.IncDecStmt:
+			lhs = []ast.Expr{x.X}
+		}
+		for _, e := range lhs {
+			index, ok := e.(*ast.IndexExpr)
+			if !ok {
+				continue
+			}
+			name := types.ExprString(index.X)
+			var msg string
+			switch m := index.X.(type) {
+			case *ast.Ident:
+				msg = fmt.Sprintf("map `%s`%s", name, ctx.origin(m))
+				if spec, ok := ctx.Definition(m.Name).(*ast.ValueSpec); ok && len(spec.Values) == 0 {
+					msg = fmt.Sprintf("map `%s` is declared with var at line %d but never initialized with make", name, ctx.Line(spec))
+				}
+			case *ast.SelectorExpr:
+				msg = fmt.Sprintf("map field `%s` is nil; initialize it with make where its struct is created", name)
+			default:
+				msg = fmt.Sprintf("map `%s` is nil when written", name)
+			}
+			findings = append(findings, &Finding{Message: msg})
+		}
+	}
+	return findings
+}
+
+type outOfRange struct{}
+
+func (outOfRange) Name() string {
+	return "out_of_range"
+}
+
+func (outOfRange) Detect(ctx *Context) []*Finding {
+	if ctx.Panic.Category != classify.CategoryIndexOutOfRange && ctx.Panic.Category != classify.CategorySliceBounds {
+		return nil
+	}
+	var findings []*Finding
+	for _, n := range ctx.Nodes {
+		var x, index ast.Expr
+		switch e := n.(type) {
+		case *ast.IndexExpr:
+			if ctx.Panic.Category == classify.CategoryIndexOutOfRange {
+				x, index = e.X, e.Index
+			}
+		case *ast.SliceExpr:
+			if ctx.Panic.Category == classify.CategorySliceBounds {
+				x = e.X
+				for _, bound := range []ast.Expr{e.Max, e.High, e.Low} {
+					if bound != nil {
+						index = bound
+						break
+					}
+				}
+			}
+		}
+		if x == nil || index == nil {
+			continue
+		}
+		if _, ok := index.(*ast.BasicLit); ok && len(findings) > 0 {
+			continue
+		}
+		name, seq := types.ExprString(index), types.ExprString(x)
+		msg := fmt.Sprintf("index `%s` of `%s`%s", name, seq, ctx.origin(index))
+		if p := ctx.Panic; p.Index != nil && p.Length != nil {
+			msg += fmt.Sprintf("; it is %d but the length is %d", *p.Index, *p.Length)
+		}
+		if !ctx.Compared(name, "len("+seq+")") {
+			msg += fmt.Sprintf("; no bounds check against `len(%s)`", seq)
+		}
+		findings = append(findings, &Finding{Message: msg})
+	}
+	return findings
+}
+
+type nilDereference struct{}
+
+func (nilDereference) Name() string {
+	return "nil_dereference"
+}
+
+func (nilDereference) Detect(ctx *Context) []*Finding {
+	if ctx.Panic.Category != classify.CategoryNilDereference {
+		return nil
+	}
+	var findings []*Finding
+	seen := make(map[string]struct{})
+	for _, n := range ctx.Nodes {
+		var x ast.Expr
+		switch e := n.(type) {
+		case *ast.SelectorExpr:
+			x = e.X
+		case *ast.StarExpr:
+			x = e.X
+		}
+		ident, ok := x.(*ast.Ident)
+		if !ok {
+			continue
+		}
+		if _, ok := seen[ident.Name]; ok {
+			continue
+		}
+		seen[ident.Name] = struct{}{}
+		// skip package names and anything else that is not a local variable
+		if !ctx.Param(ident.Name) && ctx.Definition(ident.Name) == nil {
+			continue
+		}
+		msg := fmt.Sprintf("pointer `%s`%s", ident.Name, ctx.origin(ident))
+		if !ctx.Compared(ident.Name, "nil") {
+			msg += "; no nil check"
+		}
+		findings = append(findings, &Finding{Message: msg})
+	}
+	return findings
+}
+
+type typeAssertion struct{}
+
+func (typeAssertion) Name() string {
+	return "type_assertion"
+}
+
+func (typeAssertion) Detect(ctx *Context) []*Finding {
+	if ctx.Panic.Category != classify.CategoryTypeAssertion {
+		return nil
+	}
+	// the assertions in the two-value form never panic
+	checked := make(map[ast.Node]struct{})
+	for _, n := range ctx.Nodes {
+		if assign, ok := n.(*ast.AssignStmt); ok && len(assign.Lhs) == 2 && len(assign.Rhs) == 1 {
+			checked[assign.Rhs[0]] = struct{}{}
+		}
+	}
+	var findings []*Finding
+	for _, n := range ctx.Nodes {
+		assert, ok := n.(*ast.TypeAssertExpr)
+		if _, isChecked := checked[n]; !ok || assert.Type == nil || isChecked {
+			continue
+		}
+		expr := types.ExprString(assert)
+		msg := fmt.Sprintf("type assertion `%s` uses the single-value form", expr)
+		if ctx.Panic.Actual != "" {
+			msg += fmt.Sprintf(" but the dynamic type is %s", ctx.Panic.Actual)
+		}
+		if ctx.Panic.MissingMethod != "" {
+			msg += fmt.Sprintf(", which has no method %s", ctx.Panic.MissingMethod)
+		}
+		msg += fmt.Sprintf("; use `v, ok := %s` or a type switch", expr)
+		findings = append(findings, &Finding{Message: msg})
+	}
+	return findings
+}
+
+type closedChannel struct{}
+
+func (closedChannel) Name() string {
+	return "closed_channel"
+}
+
+func (closedChannel) Detect(ctx *Context) []*Finding {
+	if ctx.Panic.Category != classify.CategoryClosedChannel && ctx.Panic.Category != classify.CategoryNilChannel {
+		return nil
+	}
+	var findings []*Finding
+	for _, n := range ctx.Nodes {
+		var ch ast.Expr
+		op := "sent to"
+		switch x := n.(type) {
+		case *ast.SendStmt:
+			ch = x.Chan
+		case *ast.CallExpr:
+			if fun, ok := x.Fun.(*ast.Ident); ok && fun.Name == "close" && len(x.Args) == 1 {
+				ch, op = x.Args[0], "closed"
+			}
+		}
+		if ch == nil {
+			continue
+		}
+		name := types.ExprString(ch)
+		if ctx.Panic.Category == classify.CategoryNilChannel {
+			msg := fmt.Sprintf("channel `%s` is nil when %s", name, op)
+			if origin := ctx.origin(ch); origin != "" {
+				msg += "; it" + origin
+			}
+			findings = append(findings, &Finding{Message: msg})
+			continue
+		}
+		msg := fmt.Sprintf("channel `%s` is %s after it was closed", name, op)
+		for _, line := range ctx.closeCalls(name) {
+			if line != ctx.Function.Line {
+				msg += fmt.Sprintf("; `close(%s)` at line %d", name, line)
+			}
+		}
+		findings = append(findings, &Finding{Message: msg + "; only the sender should close a channel, and only once"})
+	}
+	return findings
+}
+
+// closeCalls the lines of the function closing the channel
+func (ctx *Context) closeCalls(name string) []int {
+	var lines []int
+	ast.Inspect(ctx.Decl.Body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			if fun, ok := call.Fun.(*ast.Ident); ok && fun.Name == "close" && len(call.Args) == 1 && types.ExprString(call.Args[0]) == name {
+				lines = append(lines, ctx.Line(call))
+			}
+		}
+		return true
+	})
+	return lines
+}
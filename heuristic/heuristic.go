@@ -0,0 +1,202 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package heuristic
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sync"
+
+	"github.com/ahaostudy/code-diagnostic/classify"
+	"github.com/ahaostudy/code-diagnostic/parse"
+)
+
+// Finding a deterministic explanation of the panic found without the big model
+type Finding struct {
+	Detector string `json:"detector"`
+	Message  string `json:"message"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// Detector inspect the failing code and explain the panic
+type Detector interface {
+	Name() string
+	Detect(ctx *Context) []*Finding
+}
+
+var (
+	mu        sync.RWMutex
+	detectors []Detector
+)
+
+// Register register detectors run for every diagnosis
+func Register(ds ...Detector) {
+	mu.Lock()
+	defer mu.Unlock()
+	detectors = append(detectors, ds...)
+}
+
+// Run run the registered detectors and the extra ones
+func Run(ctx *Context, extra ...Detector) []*Finding {
+	if ctx == nil {
+		return nil
+	}
+	mu.RLock()
+	ds := append(detectors[:len(detectors):len(detectors)], extra...)
+	mu.RUnlock()
+
+	var findings []*Finding
+	for _, d := range ds {
+		for _, f := range d.Detect(ctx) {
+			if f.Detector == "" {
+				f.Detector = d.Name()
+			}
+			if f.File == "" {
+				f.File, f.Line = ctx.Function.File, ctx.Function.Line
+			}
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// Context what the detectors know about the panic
+type Context struct {
+	Panic *classify.Panic
+	// Function the local function closest to the panic
+	Function *parse.Function
+	Decl     *ast.FuncDecl
+	Fset     *token.FileSet
+	// Nodes the nodes starting on the failing line, outermost first
+	Nodes []ast.Node
+	// Args the arguments of the failing function decoded from the stack
+	Args []*parse.Arg
+}
+
+// NewContext build the context of the panic in the function, nil if the function cannot be parsed
+func NewContext(pnc *classify.Panic, fun *parse.Function, traces []*parse.StackTrace) *Context {
+	if pnc == nil || fun == nil {
+		return nil
+	}
+	decl, fset, err := parse.FuncDecl(fun.File, fun.Name)
+	if err != nil || decl.Body == nil {
+		return nil
+	}
+	ctx := &Context{Panic: pnc, Function: fun, Decl: decl, Fset: fset}
+	ast.Inspect(decl.Body, func(n ast.Node) bool {
+		if n != nil && fset.Position(n.Pos()).Line == fun.Line {
+			ctx.Nodes = append(ctx.Nodes, n)
+		}
+		return true
+	})
+	for _, trace := range traces {
+		if trace.File == fun.File && trace.Line == fun.Line {
+			ctx.Args = parse.DecodeArgs(fun, trace)
+			break
+		}
+	}
+	return ctx
+}
+
+// Line the line of the node
+func (ctx *Context) Line(n ast.Node) int {
+	return ctx.Fset.Position(n.Pos()).Line
+}
+
+// Param the parameter or receiver of the function with the name
+func (ctx *Context) Param(name string) bool {
+	for _, fields := range []*ast.FieldList{ctx.Decl.Recv, ctx.Decl.Type.Params} {
+		if fields == nil {
+			continue
+		}
+		for _, field := range fields.List {
+			for _, ident := range field.Names {
+				if ident.Name == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Arg the decoded argument of the parameter, nil if unknown
+func (ctx *Context) Arg(name string) *parse.Arg {
+	for _, arg := range ctx.Args {
+		if arg.Name == name {
+			return arg
+		}
+	}
+	return nil
+}
+
+// Definition the statement declaring the local variable before the failing line, nil if not found
+func (ctx *Context) Definition(name string) ast.Node {
+	var def ast.Node
+	ast.Inspect(ctx.Decl.Body, func(n ast.Node) bool {
+		if n == nil || def != nil || ctx.Line(n) > ctx.Function.Line {
+			return false
+		}
+		switch x := n.(type) {
+		case *ast.AssignStmt:
+			if x.Tok == token.DEFINE && hasIdent(x.Lhs, name) {
+				def = x
+			}
+		case *ast.ValueSpec:
+			for _, ident := range x.Names {
+				if ident.Name == name {
+					def = x
+				}
+			}
+		}
+		return true
+	})
+	return def
+}
+
+// Compared report whether the identifier is compared with the operand anywhere in the function,
+// any operand matches if it is empty
+func (ctx *Context) Compared(name, operand string) bool {
+	var found bool
+	ast.Inspect(ctx.Decl.Body, func(n ast.Node) bool {
+		x, ok := n.(*ast.BinaryExpr)
+		if !ok || found {
+			return !found
+		}
+		switch x.Op {
+		case token.EQL, token.NEQ, token.LSS, token.GTR, token.LEQ, token.GEQ:
+			l, r := types.ExprString(x.X), types.ExprString(x.Y)
+			found = (l == name && (operand == "" || r == operand)) || (r == name && (operand == "" || l == operand))
+		}
+		return !found
+	})
+	return found
+}
+
+func hasIdent(exprs []ast.Expr, name string) bool {
+	for _, e := range exprs {
+		if ident, ok := e.(*ast.Ident); ok && ident.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package heuristic
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/ahaostudy/code-diagnostic/classify"
+	"github.com/ahaostudy/code-diagnostic/parse"
+)
+
+// the crashing functions, not inlined so that they keep their frame and arguments in the stack
+
+type point struct{ x int }
+
+//go:noinline
+func divide(a, b int) int {
+	return a / b
+}
+
+//go:noinline
+func checkedDivide(a, b int) int {
+	if b == 0 {
+		println("dividing by zero")
+	}
+	return a / b
+}
+
+//go:noinline
+func count(word string) {
+	var counts map[string]int
+	counts[word]++
+}
+
+//go:noinline
+func pick(values []int, i int) int {
+	return values[i]
+}
+
+//go:noinline
+func head(values []int, n int) []int {
+	return values[:n]
+}
+
+//go:noinline
+func coordinate(p *point) int {
+	return p.x
+}
+
+//go:noinline
+func text(v any) string {
+	return v.(string)
+}
+
+//go:noinline
+func closeTwice(ch chan int) {
+	close(ch)
+	close(ch)
+}
+
+//go:noinline
+func send(ch chan int) {
+	ch <- 1
+}
+
+// diagnose run the detectors on the panic of f as the diagnosis does, with the stack printed by debug.Stack
+func diagnose(t *testing.T, f func()) []*Finding {
+	t.Helper()
+	var pnc *classify.Panic
+	var stack []byte
+	var funs []*parse.Function
+	func() {
+		defer func() {
+			pnc, stack = classify.Classify(recover()), debug.Stack()
+			pc := make([]uintptr, 32)
+			funs = parse.GetFuncList(runtime.CallersFrames(pc[:runtime.Callers(1, pc)]))
+		}()
+		f()
+	}()
+	traces := parse.StackTraces(stack)
+	if len(funs) == 0 {
+		t.Fatalf("no function in the stack\n%s", stack)
+	}
+	ctx := NewContext(pnc, funs[0], traces)
+	if ctx == nil {
+		t.Fatalf("no context of %s at %s:%d", funs[0].Name, funs[0].File, funs[0].Line)
+	}
+	return Run(ctx)
+}
+
+func TestDetectors(t *testing.T) {
+	var nilChan chan int
+	closed := make(chan int)
+	close(closed)
+
+	tests := []struct {
+		name     string
+		panic    func()
+		detector string
+		want     []string
+		unwanted string
+	}{
+		{name: "divide by zero", panic: func() { divide(1, 0) }, detector: "divide_by_zero",
+			want: []string{"divisor `b` comes from parameter `b` of divide", "; no zero check"}},
+		{name: "checked divisor", panic: func() { checkedDivide(1, 0) }, detector: "divide_by_zero",
+			want: []string{"divisor `b` comes from parameter `b` of checkedDivide"}, unwanted: "no zero check"},
+		{name: "nil map write", panic: func() { count("go") }, detector: "nil_map_write",
+			want: []string{"map `counts` is declared with var at line ", "but never initialized with make"}},
+		{name: "index out of range", panic: func() { pick([]int{1, 2, 3}, 5) }, detector: "out_of_range",
+			want: []string{"index `i` of `values` comes from parameter `i` of pick", "; it is 5 but the length is 3", "; no bounds check against `len(values)`"}},
+		{name: "slice bounds", panic: func() { head([]int{1, 2, 3}, 5) }, detector: "out_of_range",
+			want: []string{"index `n` of `values` comes from parameter `n` of head", "; no bounds check against `len(values)`"}},
+		{name: "nil dereference", panic: func() { coordinate(nil) }, detector: "nil_dereference",
+			want: []string{"pointer `p` comes from parameter `p` of coordinate", "; no nil check"}},
+		{name: "type assertion", panic: func() { text(42) }, detector: "type_assertion",
+			want: []string{"type assertion `v.(string)` uses the single-value form but the dynamic type is int", "; use `v, ok := v.(string)` or a type switch"}},
+		{name: "close of closed channel", panic: func() { closeTwice(make(chan int)) }, detector: "closed_channel",
+			want: []string{"channel `ch` is closed after it was closed; `close(ch)` at line ", "only the sender should close a channel"}},
+		{name: "send on closed channel", panic: func() { send(closed) }, detector: "closed_channel",
+			want: []string{"channel `ch` is sent to after it was closed; only the sender should close a channel"}},
+		{name: "close of nil channel", panic: func() { closeTwice(nilChan) }, detector: "closed_channel",
+			want: []string{"channel `ch` is nil when closed; it comes from parameter `ch` of closeTwice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := diagnose(t, tt.panic)
+			if len(findings) != 1 {
+				t.Fatalf("got %d findings, want 1: %+v", len(findings), findings)
+			}
+			f := findings[0]
+			if f.Detector != tt.detector || !strings.HasSuffix(f.File, "heuristic_test.go") || f.Line == 0 {
+				t.Errorf("found by %s at %s:%d, want %s at the failing line", f.Detector, f.File, f.Line, tt.detector)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(f.Message, want) {
+					t.Errorf("the finding %q misses %q", f.Message, want)
+				}
+			}
+			if tt.unwanted != "" && strings.Contains(f.Message, tt.unwanted) {
+				t.Errorf("the finding %q says %q", f.Message, tt.unwanted)
+			}
+		})
+	}
+}
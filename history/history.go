@@ -0,0 +1,301 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/parse"
+	"github.com/ahaostudy/code-diagnostic/utils"
+)
+
+const (
+	defaultMaxCommits = 3
+	defaultMaxBytes   = 8 << 10
+)
+
+// History recent git changes of the code in the stack
+type History struct {
+	Blames    []*Blame       `json:"blames"`
+	Logs      []*FunctionLog `json:"logs"`
+	Diffs     []*Diff        `json:"diffs"`
+	Truncated bool           `json:"truncated"`
+}
+
+// Blame the last commit that touched a failing line
+type Blame struct {
+	File     string  `json:"file"`
+	Line     int     `json:"line"`
+	Code     string  `json:"code"`
+	Commit   *Commit `json:"commit"`
+	Modified bool    `json:"modified"`
+}
+
+// FunctionLog the last commits that touched a function
+type FunctionLog struct {
+	Function string    `json:"function"`
+	File     string    `json:"file"`
+	Commits  []*Commit `json:"commits"`
+}
+
+type Commit struct {
+	Hash    string `json:"hash"`
+	Author  string `json:"author"`
+	Date    string `json:"date"`
+	Subject string `json:"subject"`
+}
+
+// Diff uncommitted changes of a file in the working tree
+type Diff struct {
+	File  string `json:"file"`
+	Patch string `json:"patch"`
+}
+
+type collector struct {
+	maxCommits int
+	maxBytes   int
+
+	size    int
+	history *History
+}
+
+type Option func(*collector)
+
+// WithMaxCommits specify how many commits are listed for each function
+func WithMaxCommits(n int) Option {
+	return func(c *collector) {
+		c.maxCommits = n
+	}
+}
+
+// WithMaxBytes specify the most bytes of history collected in total
+func WithMaxBytes(n int) Option {
+	return func(c *collector) {
+		c.maxBytes = n
+	}
+}
+
+// Collect collect the git history of the functions, nil if they are not in a git repository
+func Collect(funs []*parse.Function, opts ...Option) *History {
+	c := &collector{
+		maxCommits: defaultMaxCommits,
+		maxBytes:   defaultMaxBytes,
+		history:    new(History),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	var inRepo bool
+	files := make(map[string]struct{})
+	for _, f := range funs {
+		if _, err := git(filepath.Dir(f.File), "rev-parse", "--is-inside-work-tree"); err != nil {
+			continue
+		}
+		inRepo = true
+		c.blame(f)
+		c.log(f)
+		files[f.File] = struct{}{}
+	}
+	if !inRepo {
+		return nil
+	}
+	for _, f := range funs {
+		if _, ok := files[f.File]; ok {
+			c.diff(f.File)
+			delete(files, f.File)
+		}
+	}
+	return c.history
+}
+
+// fit check whether n more bytes still fit into the limit
+func (c *collector) fit(n int) bool {
+	if c.size+n > c.maxBytes {
+		c.history.Truncated = true
+		return false
+	}
+	c.size += n
+	return true
+}
+
+func (c *collector) blame(f *parse.Function) {
+	if f.Line <= 0 {
+		return
+	}
+	out, err := git(filepath.Dir(f.File), "blame", "--porcelain", "-L", fmt.Sprintf("%d,%d", f.Line, f.Line), "--", filepath.Base(f.File))
+	if err != nil {
+		return
+	}
+	b := &Blame{File: f.File, Line: f.Line, Commit: new(Commit)}
+	for i, line := range strings.Split(out, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch {
+		case i == 0:
+			b.Commit.Hash = shortHash(key)
+			b.Modified = strings.Trim(key, "0") == ""
+		case key == "author":
+			b.Commit.Author = value
+		case key == "author-time":
+			if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+				b.Commit.Date = time.Unix(sec, 0).Format("2006-01-02")
+			}
+		case key == "summary":
+			b.Commit.Subject = value
+		case strings.HasPrefix(line, "\t"):
+			b.Code = strings.TrimPrefix(line, "\t")
+		}
+	}
+	if c.fit(len(b.Code) + len(b.Commit.Subject) + len(b.Commit.Author)) {
+		c.history.Blames = append(c.history.Blames, b)
+	}
+}
+
+func (c *collector) log(f *parse.Function) {
+	if f.StartLine <= 0 || c.maxCommits <= 0 {
+		return
+	}
+	end := f.StartLine + strings.Count(f.Source, "\n")
+	commits, err := Log(f.File, f.StartLine, end, c.maxCommits)
+	if err != nil {
+		return
+	}
+	fl := &FunctionLog{Function: f.Name, File: f.File}
+	for _, commit := range commits {
+		if c.fit(len(commit.Hash) + len(commit.Author) + len(commit.Date) + len(commit.Subject)) {
+			fl.Commits = append(fl.Commits, commit)
+		}
+	}
+	if len(fl.Commits) > 0 {
+		c.history.Logs = append(c.history.Logs, fl)
+	}
+}
+
+// Log the last n commits changing the lines start to end of the file, or the whole file if start is 0
+func Log(file string, start, end, n int) ([]*Commit, error) {
+	args := []string{"log", "-n", strconv.Itoa(n), "-s", "--date=short", "--format=%h%x1f%an%x1f%ad%x1f%s"}
+	if start > 0 {
+		args = append(args, "-L", fmt.Sprintf("%d,%d:%s", start, end, filepath.Base(file)))
+	} else {
+		args = append(args, "--", filepath.Base(file))
+	}
+	out, err := git(filepath.Dir(file), args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseLog(out), nil
+}
+
+// parseLog parse the commits of the log, old versions of git ignore -s with -L and print the diffs in between
+func parseLog(out string) []*Commit {
+	var commits []*Commit
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		commits = append(commits, &Commit{Hash: fields[0], Author: fields[1], Date: fields[2], Subject: fields[3]})
+	}
+	return commits
+}
+
+func (c *collector) diff(file string) {
+	dir := filepath.Dir(file)
+	out, err := git(dir, "diff", "HEAD", "--", filepath.Base(file))
+	if err != nil {
+		// the repository has no commits yet
+		out, err = git(dir, "diff", "--", filepath.Base(file))
+	}
+	if err != nil || out == "" {
+		return
+	}
+	if !c.fit(len(out)) {
+		// keep whatever part of the patch still fits
+		n := c.maxBytes - c.size
+		if n <= 0 {
+			return
+		}
+		out = utils.Truncate(out, n) + "\n... truncated\n"
+		c.size = c.maxBytes
+	}
+	c.history.Diffs = append(c.history.Diffs, &Diff{File: file, Patch: out})
+}
+
+// String describe the history as plain text for the prompt
+func (h *History) String() string {
+	var buf strings.Builder
+	if len(h.Blames) > 0 {
+		buf.WriteString("Blame of the failing lines:\n")
+		for _, b := range h.Blames {
+			if b.Modified {
+				fmt.Fprintf(&buf, "%s:%d `%s` modified in the working tree, not committed yet\n", b.File, b.Line, b.Code)
+				continue
+			}
+			fmt.Fprintf(&buf, "%s:%d `%s` last changed in %s\n", b.File, b.Line, b.Code, b.Commit)
+		}
+		buf.WriteString("\n")
+	}
+	if len(h.Logs) > 0 {
+		buf.WriteString("Recent commits of the functions:\n")
+		for _, l := range h.Logs {
+			fmt.Fprintf(&buf, "%s (%s):\n", l.Function, l.File)
+			for _, c := range l.Commits {
+				fmt.Fprintf(&buf, "  %s\n", c)
+			}
+		}
+		buf.WriteString("\n")
+	}
+	for _, d := range h.Diffs {
+		fmt.Fprintf(&buf, "Uncommitted changes of %s:\n```diff\n%s```\n\n", d.File, d.Patch)
+	}
+	if h.Truncated {
+		buf.WriteString("The history was truncated.\n")
+	}
+	return buf.String()
+}
+
+func (c *Commit) String() string {
+	return fmt.Sprintf("%s %s by %s: %s", c.Hash, c.Date, c.Author, c.Subject)
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
@@ -0,0 +1,212 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package history
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/ahaostudy/code-diagnostic/parse"
+)
+
+const source = `package demo
+
+func Div(a, b int) int {
+	return a / b
+}
+`
+
+// repo a temporary git repository with one commit of demo.go
+func repo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	dir := t.TempDir()
+	run(t, dir, "init", "-q")
+	write(t, filepath.Join(dir, "demo.go"), source)
+	run(t, dir, "add", "demo.go")
+	run(t, dir, "-c", "user.name=Ada", "-c", "user.email=ada@example.com", "commit", "-q", "-m", "add Div")
+	return dir
+}
+
+func run(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	if _, err := git(dir, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func write(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// div the function Div of the repository failing at line
+func div(dir string, line int) *parse.Function {
+	f := parse.NewFunction("Div", nil, nil, filepath.Join(dir, "demo.go"), "func Div(a, b int) int {\n\treturn a / b\n}")
+	f.StartLine = 3
+	f.Line = line
+	return f
+}
+
+func TestCollect(t *testing.T) {
+	dir := repo(t)
+	h := Collect([]*parse.Function{div(dir, 4)})
+	if h == nil {
+		t.Fatal("no history collected in a git repository")
+	}
+	if len(h.Blames) != 1 {
+		t.Fatalf("%d blames, want 1", len(h.Blames))
+	}
+	b := h.Blames[0]
+	if b.Modified || b.Code != "\treturn a / b" || b.Commit.Author != "Ada" || b.Commit.Subject != "add Div" || len(b.Commit.Hash) != 7 {
+		t.Errorf("blame = %+v of %+v", b, b.Commit)
+	}
+	if len(h.Logs) != 1 || len(h.Logs[0].Commits) != 1 || h.Logs[0].Commits[0].Subject != "add Div" {
+		t.Errorf("logs = %+v", h.Logs)
+	}
+	if len(h.Diffs) != 0 || h.Truncated {
+		t.Errorf("diffs = %+v, truncated = %v of a clean tree", h.Diffs, h.Truncated)
+	}
+}
+
+func TestCollectModified(t *testing.T) {
+	dir := repo(t)
+	write(t, filepath.Join(dir, "demo.go"), strings.Replace(source, "a / b", "a / (b - 1)", 1))
+	h := Collect([]*parse.Function{div(dir, 4)})
+	if len(h.Blames) != 1 || !h.Blames[0].Modified {
+		t.Fatalf("blames = %+v, want the line modified", h.Blames)
+	}
+	if len(h.Diffs) != 1 || !strings.Contains(h.Diffs[0].Patch, "+\treturn a / (b - 1)") {
+		t.Fatalf("diffs = %+v", h.Diffs)
+	}
+	if !strings.Contains(h.String(), "modified in the working tree") {
+		t.Errorf("String() = %q", h.String())
+	}
+}
+
+func TestCollectOutsideRepository(t *testing.T) {
+	if h := Collect([]*parse.Function{div(t.TempDir(), 4)}); h != nil {
+		t.Errorf("Collect() = %+v outside a git repository, want nil", h)
+	}
+}
+
+func TestCollectMaxBytes(t *testing.T) {
+	dir := repo(t)
+	write(t, filepath.Join(dir, "demo.go"), source+"\n// "+strings.Repeat("界", 200)+"\n")
+	full := Collect([]*parse.Function{div(dir, 4)})
+	b, l := full.Blames[0], full.Logs[0].Commits[0]
+	used := len(b.Code) + len(b.Commit.Subject) + len(b.Commit.Author) + len(l.Hash) + len(l.Author) + len(l.Date) + len(l.Subject)
+	// cut the patch right after, inside and in the middle of the first wide rune
+	at := used + strings.Index(full.Diffs[0].Patch, "界")
+	for _, max := range []int{at, at + 1, at + 2, at + 4} {
+		h := Collect([]*parse.Function{div(dir, 4)}, WithMaxBytes(max))
+		if !h.Truncated {
+			t.Fatalf("WithMaxBytes(%d) not truncated", max)
+		}
+		if len(h.Blames) != 1 || len(h.Logs) != 1 || len(h.Diffs) != 1 {
+			t.Fatalf("WithMaxBytes(%d) = %+v, want the blame, the log and part of the diff", max, h)
+		}
+		patch := strings.TrimSuffix(h.Diffs[0].Patch, "\n... truncated\n")
+		if patch == h.Diffs[0].Patch || !utf8.ValidString(patch) {
+			t.Errorf("WithMaxBytes(%d) patch %q not truncated on a rune boundary", max, h.Diffs[0].Patch)
+		}
+		if used+len(patch) > max || used+len(patch) < max-2 {
+			t.Errorf("WithMaxBytes(%d) collected %d bytes", max, used+len(patch))
+		}
+	}
+	if h := Collect([]*parse.Function{div(dir, 4)}, WithMaxBytes(used)); len(h.Diffs) != 0 || !h.Truncated {
+		t.Errorf("WithMaxBytes(%d) diffs = %+v, want none once the budget is spent", used, h.Diffs)
+	}
+}
+
+func TestParseLog(t *testing.T) {
+	// old versions of git print the diff of -L even with -s
+	out := "a1b2c3d\x1fAda\x1f2026-10-01\x1ffix Div\n" +
+		"\n" +
+		"diff --git a/demo.go b/demo.go\n" +
+		"--- a/demo.go\n" +
+		"+++ b/demo.go\n" +
+		"@@ -3,3 +3,3 @@\n" +
+		"-\treturn a * b\n" +
+		"+\treturn a / b\n" +
+		"e4f5a6b\x1fGrace\x1f2026-09-30\x1fadd Div\n"
+	commits := parseLog(out)
+	if len(commits) != 2 {
+		t.Fatalf("parseLog() = %d commits, want 2", len(commits))
+	}
+	want := []Commit{
+		{Hash: "a1b2c3d", Author: "Ada", Date: "2026-10-01", Subject: "fix Div"},
+		{Hash: "e4f5a6b", Author: "Grace", Date: "2026-09-30", Subject: "add Div"},
+	}
+	for i, c := range commits {
+		if *c != want[i] {
+			t.Errorf("commit %d = %+v, want %+v", i, *c, want[i])
+		}
+	}
+}
+
+func TestCollectMaxCommits(t *testing.T) {
+	dir := repo(t)
+	for _, subject := range []string{"second", "third", "fourth"} {
+		write(t, filepath.Join(dir, "demo.go"), strings.Replace(source, "a / b", "a / b // "+subject, 1))
+		run(t, dir, "-c", "user.name=Ada", "-c", "user.email=ada@example.com", "commit", "-q", "-am", subject)
+	}
+	h := Collect([]*parse.Function{div(dir, 4)}, WithMaxCommits(2))
+	if len(h.Logs) != 1 {
+		t.Fatalf("logs = %+v", h.Logs)
+	}
+	commits := h.Logs[0].Commits
+	if len(commits) != 2 || commits[0].Subject != "fourth" || commits[1].Subject != "third" {
+		t.Errorf("commits = %+v, want the last two", commits)
+	}
+}
+
+func TestLogMaxCommits(t *testing.T) {
+	dir := repo(t)
+	for _, subject := range []string{"second", "third"} {
+		write(t, filepath.Join(dir, "demo.go"), source+"// "+subject+"\n")
+		run(t, dir, "-c", "user.name=Ada", "-c", "user.email=ada@example.com", "commit", "-q", "-am", subject)
+	}
+	commits, err := Log(filepath.Join(dir, "demo.go"), 0, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 2 || commits[0].Subject != "third" || commits[1].Subject != "second" {
+		t.Errorf("Log() = %+v", commits)
+	}
+	// the commits after the first one do not touch Div
+	commits, err = Log(filepath.Join(dir, "demo.go"), 3, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || commits[0].Subject != "add Div" {
+		t.Errorf("Log() of Div = %+v", commits)
+	}
+}
@@ -0,0 +1,288 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package incident
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/report"
+)
+
+const (
+	defaultTopK         = 3
+	defaultMinScore     = 0.75
+	defaultMaxIncidents = 500
+	// maxFrames the most frames of the stack stored and embedded
+	maxFrames = 5
+	// localDimensions the dimensions of the local embedding
+	localDimensions = 256
+	localModel      = "local/hash-256"
+)
+
+// Incident a diagnosed crash stored in the index
+type Incident struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Panic  string    `json:"panic"`
+	Frames []string  `json:"frames"`
+	Answer string    `json:"answer"`
+	// Model and Vector the embedding of the panic and the frames
+	Model  string    `json:"model"`
+	Vector []float32 `json:"vector"`
+}
+
+// Vector the embedding of an incident
+type Vector struct {
+	Model  string
+	Values []float32
+}
+
+// Index incidents stored in a json file, searched by the cosine similarity of their embedding
+type Index struct {
+	path         string
+	topK         int
+	minScore     float64
+	maxIncidents int
+
+	mu        sync.Mutex
+	incidents []*Incident
+}
+
+// Open open the index stored in the file, it is created by the first Add
+func Open(path string, opts ...Option) (*Index, error) {
+	x := &Index{path: path, topK: defaultTopK, minScore: defaultMinScore, maxIncidents: defaultMaxIncidents}
+	for _, opt := range opts {
+		opt(x)
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &x.incidents); err != nil {
+		return nil, fmt.Errorf("incident index %s: %w", path, err)
+	}
+	return x, nil
+}
+
+type Option func(*Index)
+
+// WithTopK specify the most similar incidents returned by Search
+func WithTopK(k int) Option {
+	return func(x *Index) {
+		x.topK = k
+	}
+}
+
+// WithMinScore specify the least cosine similarity of the incidents returned by Search, 0.75 by default
+func WithMinScore(score float64) Option {
+	return func(x *Index) {
+		x.minScore = score
+	}
+}
+
+// WithMaxIncidents specify the most incidents kept, the oldest ones are dropped first
+func WithMaxIncidents(n int) Option {
+	return func(x *Index) {
+		x.maxIncidents = n
+	}
+}
+
+// Frames the top frames of the report, such as "main.Div (/app/math/math.go:12)"
+func Frames(rep *report.Report) []string {
+	var frames []string
+	for _, f := range rep.LocalFunctions {
+		if len(frames) == maxFrames {
+			break
+		}
+		frames = append(frames, fmt.Sprintf("%s (%s:%d)", f.Name, f.File, f.Line))
+	}
+	return frames
+}
+
+var (
+	addressRegexp = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+	// locationRegexp the location of a frame, which changes whenever the code above it does
+	locationRegexp = regexp.MustCompile(` \([^()]*:\d+\)$`)
+)
+
+// Text the text of the report that is embedded, the panic and the functions of the top frames
+func Text(rep *report.Report) string {
+	text := addressRegexp.ReplaceAllString(rep.Panic, "0x?")
+	for _, frame := range Frames(rep) {
+		text += "\n" + locationRegexp.ReplaceAllString(frame, "")
+	}
+	return text
+}
+
+// Embed embed the text with the big model, or locally if it does not provide embeddings or fails to
+func Embed(ctx context.Context, bm bigmodel.BigModel, text string) *Vector {
+	e, err := bigmodel.Embed(ctx, bm, []string{text})
+	if err == nil && len(e.Vectors) == 1 && len(e.Vectors[0]) > 0 {
+		return &Vector{Model: e.Model, Values: e.Vectors[0]}
+	}
+	if err != nil && !errors.Is(err, bigmodel.ErrNoEmbeddings) {
+		log.Printf("embedding error, using the local embedding instead: %v", err)
+	}
+	return LocalEmbed(text)
+}
+
+// LocalEmbed embed the text by hashing its words and pairs of words, which finds incidents with the same panic and functions
+func LocalEmbed(text string) *Vector {
+	values := make([]float32, localDimensions)
+	add := func(feature string) {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(feature))
+		values[h.Sum32()%localDimensions]++
+	}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '_'
+	})
+	for i, word := range words {
+		add(word)
+		if i > 0 {
+			add(words[i-1] + " " + word)
+		}
+	}
+	var norm float64
+	for _, v := range values {
+		norm += float64(v * v)
+	}
+	if norm > 0 {
+		for i := range values {
+			values[i] /= float32(math.Sqrt(norm))
+		}
+	}
+	return &Vector{Model: localModel, Values: values}
+}
+
+// Search the incidents most similar to the vector embedded by the same model, except the incident with the id
+func (x *Index) Search(q *Vector, except string) []*report.SimilarIncident {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var similar []*report.SimilarIncident
+	for _, inc := range x.incidents {
+		if inc.ID == except || inc.Model != q.Model || len(inc.Vector) != len(q.Values) {
+			continue
+		}
+		score := cosine(inc.Vector, q.Values)
+		if score < x.minScore {
+			continue
+		}
+		similar = append(similar, &report.SimilarIncident{
+			Time:   inc.Time,
+			Panic:  inc.Panic,
+			Frames: inc.Frames,
+			Answer: inc.Answer,
+			Score:  score,
+		})
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Score > similar[j].Score
+	})
+	if len(similar) > x.topK {
+		similar = similar[:x.topK]
+	}
+	return similar
+}
+
+func cosine(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// Add add the incident of the report and its answer to the index and save it,
+// it replaces the incident with the same id, such as a regenerated answer
+func (x *Index) Add(id string, rep *report.Report, answer string, v *Vector) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	inc := &Incident{
+		ID:     id,
+		Time:   time.Now(),
+		Panic:  rep.Panic,
+		Frames: Frames(rep),
+		Answer: strings.TrimSpace(answer),
+		Model:  v.Model,
+		Vector: v.Values,
+	}
+	incidents := make([]*Incident, 0, len(x.incidents)+1)
+	for _, old := range x.incidents {
+		if old.ID != id {
+			incidents = append(incidents, old)
+		}
+	}
+	incidents = append(incidents, inc)
+	if x.maxIncidents > 0 && len(incidents) > x.maxIncidents {
+		incidents = incidents[len(incidents)-x.maxIncidents:]
+	}
+	x.incidents = incidents
+	return x.save()
+}
+
+func (x *Index) save() error {
+	data, err := json.Marshal(x.incidents)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(x.path), 0o700); err != nil {
+		return err
+	}
+	// a temporary file of its own, so that the indexes of two processes saving at once are not mixed
+	tmp, err := os.CreateTemp(filepath.Dir(x.path), filepath.Base(x.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), x.path)
+}
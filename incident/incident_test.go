@@ -0,0 +1,169 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package incident
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/parse"
+	"github.com/ahaostudy/code-diagnostic/report"
+)
+
+func testReport(panic string, funcs ...string) *report.Report {
+	rep := &report.Report{Panic: panic}
+	for i, name := range funcs {
+		rep.LocalFunctions = append(rep.LocalFunctions, &parse.Function{Name: name, File: "/app/main.go", Line: 10 + i})
+	}
+	return rep
+}
+
+func TestLocalEmbed(t *testing.T) {
+	divide := Text(testReport("runtime error: integer divide by zero", "main.divide", "main.run"))
+	v := LocalEmbed(divide)
+	if v.Model != localModel || len(v.Values) != localDimensions {
+		t.Fatalf("embedded by %s into %d dimensions", v.Model, len(v.Values))
+	}
+	var norm float64
+	for _, x := range v.Values {
+		norm += float64(x * x)
+	}
+	if math.Abs(norm-1) > 1e-5 {
+		t.Errorf("the norm is %v, want a unit vector", math.Sqrt(norm))
+	}
+
+	tests := []struct {
+		name    string
+		rep     *report.Report
+		similar bool
+	}{
+		{name: "moved", rep: &report.Report{Panic: "runtime error: integer divide by zero", LocalFunctions: []*parse.Function{
+			{Name: "main.divide", File: "/build/main.go", Line: 40}, {Name: "main.run", File: "/build/main.go", Line: 52},
+		}}, similar: true},
+		{name: "another caller", rep: testReport("runtime error: integer divide by zero", "main.divide", "main.serve"), similar: true},
+		{name: "another panic", rep: testReport("assignment to entry in nil map", "cache.(*Store).Put", "main.main")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score := cosine(v.Values, LocalEmbed(Text(tt.rep)).Values)
+			if similar := score >= defaultMinScore; similar != tt.similar {
+				t.Errorf("the score is %.2f, want similar %v", score, tt.similar)
+			}
+		})
+	}
+
+	if got := LocalEmbed("").Values; cosine(got, got) != 0 {
+		t.Error("the empty text is similar to itself")
+	}
+}
+
+func TestText(t *testing.T) {
+	a := Text(testReport("invalid memory address or nil pointer dereference [addr=0x18 pc=0x4a3f2c]", "main.(*T).Run"))
+	b := Text(&report.Report{Panic: "invalid memory address or nil pointer dereference [addr=0x20 pc=0x4a5d10]", LocalFunctions: []*parse.Function{
+		{Name: "main.(*T).Run", File: "/other/main.go", Line: 99},
+	}})
+	if a != b {
+		t.Errorf("the text of the same crash differs:\n%s\n---\n%s", a, b)
+	}
+}
+
+func vector(model string, values ...float32) *Vector {
+	return &Vector{Model: model, Values: values}
+}
+
+func TestSearch(t *testing.T) {
+	x, err := Open(filepath.Join(t.TempDir(), "incidents.json"), WithTopK(2), WithMinScore(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(id string, v *Vector) {
+		t.Helper()
+		if err := x.Add(id, testReport("panic "+id), "answer "+id, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("close", vector("openai/text-embedding-3-small", 1, 0.1, 0))
+	add("closest", vector("openai/text-embedding-3-small", 1, 0, 0))
+	add("orthogonal", vector("openai/text-embedding-3-small", 0, 1, 0))
+	add("diagonal", vector("openai/text-embedding-3-small", 1, 1, 0))
+	add("other model", vector(localModel, 1, 0, 0))
+	add("other dimensions", vector("openai/text-embedding-3-small", 1, 0))
+
+	got := x.Search(vector("openai/text-embedding-3-small", 1, 0, 0), "")
+	if len(got) != 2 || got[0].Panic != "panic closest" || got[1].Panic != "panic close" {
+		t.Fatalf("found %+v, want the two closest incidents of the model", got)
+	}
+	if got[0].Score < got[1].Score || got[0].Answer != "answer closest" {
+		t.Errorf("found %+v", got)
+	}
+
+	got = x.Search(vector("openai/text-embedding-3-small", 1, 0, 0), "closest")
+	if len(got) != 2 || got[0].Panic != "panic close" || got[1].Panic != "panic diagonal" {
+		t.Errorf("found %+v, want the incident itself left out", got)
+	}
+	if got := x.Search(vector("openai/text-embedding-3-small", 0, 0, 1), ""); len(got) != 0 {
+		t.Errorf("found %+v, want none over the min score", got)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index", "incidents.json")
+	x, err := Open(path, WithMaxIncidents(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := vector(localModel, 1, 0)
+	for i, id := range []string{"a", "b", "a", "c"} {
+		if err := x.Add(id, testReport("panic "+id), fmt.Sprintf("answer %d", i), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.incidents) != 2 || reopened.incidents[0].ID != "a" || reopened.incidents[1].ID != "c" {
+		t.Fatalf("kept %+v, want the replaced incident and the newest one", reopened.incidents)
+	}
+	if reopened.incidents[0].Answer != "answer 2" {
+		t.Errorf("the answer of the replaced incident is %q", reopened.incidents[0].Answer)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("the index directory holds %d files, want no temporary file left", len(entries))
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	text := Text(testReport("runtime error: integer divide by zero", "main.divide"))
+	got := Embed(context.Background(), bigmodel.NewOffline(), text)
+	if want := LocalEmbed(text); got.Model != want.Model || cosine(got.Values, want.Values) < 0.999 {
+		t.Errorf("embedded by %s, want the local embedding of a big model without embeddings", got.Model)
+	}
+}
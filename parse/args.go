@@ -0,0 +1,134 @@
+/**
+ * copyright ahaostudy
+ *
+ * licensed to the apache software foundation (asf) under one or more
+ * contributor license agreements.  see the notice file distributed with
+ * this work for additional information regarding copyright ownership.
+ * the asf licenses this file to you under the apache license, version 2.0
+ * (the "license"); you may not use this file except in compliance with
+ * the license.  you may obtain a copy of the license at
+ *
+ *     http://www.apache.org/licenses/license-2.0
+ *
+ * unless required by applicable law or agreed to in writing, software
+ * distributed under the license is distributed on an "as is" basis,
+ * without warranties or conditions of any kind, either express or implied.
+ * see the license for the specific language governing permissions and
+ * limitations under the license.
+ */
+
+package parse
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Arg an argument of a function decoded from the words printed in the stack
+type Arg struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Raw  string `json:"raw"`
+	// Value the decoded value, empty if it could not be decoded
+	Value string `json:"value,omitempty"`
+	// Inaccurate the word may be stale because the argument was passed in a register
+	Inaccurate bool `json:"inaccurate,omitempty"`
+}
+
+// splitArgs split the arguments of a stack frame into one group per argument,
+// the words of a multi-word argument such as a string or a slice are grouped in braces
+func splitArgs(args string) []string {
+	var groups []string
+	var depth, start int
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				groups = append(groups, strings.TrimSpace(args[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if last := strings.TrimSpace(args[start:]); last != "" {
+		groups = append(groups, last)
+	}
+	return groups
+}
+
+// DecodeArgs decode the arguments of the stack frame according to the parameters of the function,
+// the receiver of a method is the first argument of the frame
+func DecodeArgs(fun *Function, trace *StackTrace) []*Arg {
+	offset := 0
+	if decl, _, err := FuncDecl(fun.File, fun.Name); err == nil && decl.Recv != nil {
+		offset = 1
+	}
+	var args []*Arg
+	for i, param := range fun.Params {
+		if i+offset >= len(trace.Args) || trace.Args[i+offset] == "..." {
+			break
+		}
+		raw := trace.Args[i+offset]
+		arg := &Arg{Name: param.Name, Type: param.Type, Raw: raw, Inaccurate: strings.Contains(raw, "?")}
+		words := strings.Split(strings.Trim(raw, "{}"), ",")
+		for j := range words {
+			words[j] = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(words[j]), "?"))
+		}
+		arg.Value = decodeValue(param.Type, words)
+		args = append(args, arg)
+	}
+	return args
+}
+
+func decodeValue(typ string, words []string) string {
+	word := func(i int) (uint64, bool) {
+		if i >= len(words) {
+			return 0, false
+		}
+		v, err := strconv.ParseUint(strings.TrimPrefix(words[i], "0x"), 16, 64)
+		return v, err == nil
+	}
+	v, ok := word(0)
+	if !ok {
+		return ""
+	}
+	switch {
+	case typ == "int" || typ == "int64":
+		return strconv.FormatInt(int64(v), 10)
+	case typ == "int32" || typ == "rune":
+		return strconv.FormatInt(int64(int32(v)), 10)
+	case typ == "int16":
+		return strconv.FormatInt(int64(int16(v)), 10)
+	case typ == "int8":
+		return strconv.FormatInt(int64(int8(v)), 10)
+	case strings.HasPrefix(typ, "uint") || typ == "byte":
+		return strconv.FormatUint(v, 10)
+	case typ == "bool":
+		return strconv.FormatBool(v != 0)
+	case typ == "string":
+		if n, ok := word(1); ok {
+			return "string of length " + strconv.FormatUint(n, 10)
+		}
+	case strings.HasPrefix(typ, "[]"):
+		if n, ok := word(1); ok {
+			if v == 0 && n == 0 {
+				return "nil"
+			}
+			return "slice of length " + strconv.FormatUint(n, 10)
+		}
+	case strings.HasPrefix(typ, "*") || strings.HasPrefix(typ, "map[") || strings.HasPrefix(typ, "chan ") || strings.HasPrefix(typ, "func("):
+		if v == 0 {
+			return "nil"
+		}
+		return "non-nil"
+	case typ == "error" || typ == "any" || strings.HasPrefix(typ, "interface"):
+		if v == 0 {
+			return "nil"
+		}
+		return "non-nil"
+	}
+	return ""
+}
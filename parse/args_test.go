@@ -0,0 +1,175 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package parse
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+type counter struct{ n int }
+
+// framed capture the stack and keep every argument live after the call, so that the words printed are accurate
+//
+//go:noinline
+func framed(n int, p *int, m map[string]int, ok bool, err error, s string) ([]byte, string) {
+	stack := debug.Stack()
+	return stack, fmt.Sprint(n, p, m, ok, err, s)
+}
+
+//go:noinline
+func sliced(xs, none []int) ([]byte, string) {
+	stack := debug.Stack()
+	return stack, fmt.Sprint(xs, none)
+}
+
+//go:noinline
+func (c *counter) framed(n int) ([]byte, string) {
+	stack := debug.Stack()
+	return stack, fmt.Sprint(c.n, n)
+}
+
+// stale capture the stack without using the argument afterwards, so that its register is not spilled
+//
+//go:noinline
+func stale(n int) []byte {
+	return debug.Stack()
+}
+
+//go:noinline
+func crowded(a, b, c, d, e, f, g string) ([]byte, string) {
+	stack := debug.Stack()
+	return stack, a + b + c + d + e + f + g
+}
+
+// frame the stack trace and the function of the frame named name
+func frame(t *testing.T, stack []byte, name string) (*Function, *StackTrace) {
+	t.Helper()
+	for _, trace := range StackTraces(stack) {
+		if strings.HasSuffix(trace.Func, name) {
+			fun, err := ReadFuncSource(trace.File, trace.Func, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fun, trace
+		}
+	}
+	t.Fatalf("no frame of %s in\n%s", name, stack)
+	return nil, nil
+}
+
+func TestDecodeArgs(t *testing.T) {
+	stack, _ := framed(-3, nil, map[string]int{}, true, errors.New("boom"), "héllo")
+	sliceStack, _ := sliced([]int{1, 2}, nil)
+	tests := []struct {
+		stack []byte
+		name  string
+		want  map[string]string
+	}{
+		{stack, "parse.framed", map[string]string{
+			"n":   "-3",
+			"p":   "nil",
+			"m":   "non-nil",
+			"ok":  "true",
+			"err": "non-nil",
+			"s":   "string of length 6",
+		}},
+		{sliceStack, "parse.sliced", map[string]string{
+			"xs":   "slice of length 2",
+			"none": "nil",
+		}},
+	}
+	for _, tt := range tests {
+		fun, trace := frame(t, tt.stack, tt.name)
+		args := DecodeArgs(fun, trace)
+		if len(args) != len(tt.want) {
+			t.Fatalf("%d arguments decoded from %q, want %d", len(args), trace.Args, len(tt.want))
+		}
+		for _, arg := range args {
+			if arg.Value != tt.want[arg.Name] {
+				t.Errorf("argument %s %s = %q decoded from %q, want %q", arg.Name, arg.Type, arg.Value, arg.Raw, tt.want[arg.Name])
+			}
+			if arg.Inaccurate {
+				t.Errorf("argument %s decoded from %q is inaccurate", arg.Name, arg.Raw)
+			}
+		}
+	}
+}
+
+func TestDecodeArgsReceiver(t *testing.T) {
+	stack, _ := (&counter{n: 7}).framed(42)
+	fun, trace := frame(t, stack, "(*counter).framed")
+	args := DecodeArgs(fun, trace)
+	if len(args) != 1 || args[0].Name != "n" || args[0].Value != "42" {
+		t.Fatalf("DecodeArgs(%q) = %+v, want n = 42 after the receiver", trace.Args, args)
+	}
+}
+
+func TestDecodeArgsInaccurate(t *testing.T) {
+	fun, trace := frame(t, stale(5), "parse.stale")
+	args := DecodeArgs(fun, trace)
+	if len(args) != 1 || !args[0].Inaccurate {
+		t.Fatalf("DecodeArgs(%q) = %+v, want one inaccurate argument", trace.Args, args)
+	}
+}
+
+func TestDecodeArgsTruncated(t *testing.T) {
+	stack, _ := crowded("a", "b", "c", "d", "e", "f", "g")
+	fun, trace := frame(t, stack, "parse.crowded")
+	if trace.Args[len(trace.Args)-1] != "..." {
+		t.Fatalf("the arguments %q are not truncated", trace.Args)
+	}
+	args := DecodeArgs(fun, trace)
+	if len(args) == 0 || len(args) >= len(fun.Params) {
+		t.Fatalf("%d of %d arguments decoded from %q, want the ones before ...", len(args), len(fun.Params), trace.Args)
+	}
+	for _, arg := range args {
+		if arg.Value != "string of length 1" {
+			t.Errorf("argument %s = %q decoded from %q, want string of length 1", arg.Name, arg.Value, arg.Raw)
+		}
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	tests := []struct {
+		typ   string
+		words []string
+		want  string
+	}{
+		{"int8", []string{"0xff"}, "-1"},
+		{"int32", []string{"0xfffffffe"}, "-2"},
+		{"uint16", []string{"0xffff"}, "65535"},
+		{"bool", []string{"0x0"}, "false"},
+		{"chan int", []string{"0x0"}, "nil"},
+		{"func()", []string{"0xc000012345"}, "non-nil"},
+		{"any", []string{"0x0", "0x0"}, "nil"},
+		{"string", []string{"0xc000012345"}, ""},
+		{"struct{}", []string{"0x1"}, ""},
+		{"int", []string{"garbage"}, ""},
+	}
+	for _, tt := range tests {
+		if got := decodeValue(tt.typ, tt.words); got != tt.want {
+			t.Errorf("decodeValue(%q, %q) = %q, want %q", tt.typ, tt.words, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/**
+ * copyright ahaostudy
+ *
+ * licensed to the apache software foundation (asf) under one or more
+ * contributor license agreements.  see the notice file distributed with
+ * this work for additional information regarding copyright ownership.
+ * the asf licenses this file to you under the apache license, version 2.0
+ * (the "license"); you may not use this file except in compliance with
+ * the license.  you may obtain a copy of the license at
+ *
+ *     http://www.apache.org/licenses/license-2.0
+ *
+ * unless required by applicable law or agreed to in writing, software
+ * distributed under the license is distributed on an "as is" basis,
+ * without warranties or conditions of any kind, either express or implied.
+ * see the license for the specific language governing permissions and
+ * limitations under the license.
+ */
+
+package parse
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxCachedFiles the most parsed files kept, the least recently used ones are dropped first
+const maxCachedFiles = 512
+
+// cache parsed files shared by every frame and every diagnosis of the process
+var cache = &fileCache{files: make(map[string]*parsedFile), max: maxCachedFiles}
+
+type fileCache struct {
+	mu    sync.RWMutex
+	files map[string]*parsedFile
+	max   int
+	// clock orders the uses of the files
+	clock atomic.Int64
+}
+
+// parsedFile a parsed source file with an index of its functions
+type parsedFile struct {
+	modTime time.Time
+	size    int64
+	used    atomic.Int64
+
+	fset   *token.FileSet
+	node   *ast.File
+	source []byte
+	funcs  map[string]*ast.FuncDecl
+}
+
+// get return the parsed file, parse it again only if it changed since the last time
+func (c *fileCache) get(file string) (*parsedFile, error) {
+	src := sourceOf(file)
+	info, err := src.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	pf, ok := c.files[file]
+	c.mu.RUnlock()
+	if ok && pf.modTime.Equal(info.ModTime()) && pf.size == info.Size() {
+		pf.used.Store(c.clock.Add(1))
+		return pf, nil
+	}
+
+	source, err := src.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pf, err = parseFile(file, source)
+	if err != nil {
+		return nil, err
+	}
+	pf.modTime, pf.size = info.ModTime(), info.Size()
+	pf.used.Store(c.clock.Add(1))
+
+	c.mu.Lock()
+	if _, ok := c.files[file]; !ok && len(c.files) >= c.max {
+		c.evict()
+	}
+	c.files[file] = pf
+	c.mu.Unlock()
+	return pf, nil
+}
+
+// evict drop the least recently used file, the lock must be held
+func (c *fileCache) evict() {
+	var oldest string
+	var used int64
+	for file, pf := range c.files {
+		if u := pf.used.Load(); oldest == "" || u < used {
+			oldest, used = file, u
+		}
+	}
+	delete(c.files, oldest)
+}
+
+func (c *fileCache) reset() {
+	c.mu.Lock()
+	c.files = make(map[string]*parsedFile)
+	c.mu.Unlock()
+}
+
+func parseFile(file string, source []byte) (*parsedFile, error) {
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, file, source, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	pf := &parsedFile{
+		fset:   fset,
+		node:   node,
+		source: source,
+		funcs:  make(map[string]*ast.FuncDecl),
+	}
+	for _, decl := range node.Decls {
+		if f, ok := decl.(*ast.FuncDecl); ok {
+			pf.funcs[funcDeclName(f)] = f
+		}
+	}
+	return pf, nil
+}
+
+// funcDeclName the name of the function as it appears in the stack, such as Div, T.Method or (*T).Method
+func funcDeclName(f *ast.FuncDecl) string {
+	funcName := f.Name.Name
+	if f.Recv != nil && len(f.Recv.List) > 0 {
+		switch typ := f.Recv.List[0].Type.(type) {
+		case *ast.Ident:
+			funcName = typ.Name + "." + funcName
+		case *ast.StarExpr:
+			if ident, ok := typ.X.(*ast.Ident); ok {
+				funcName = "(*" + ident.Name + ")." + funcName
+			}
+		}
+	}
+	return funcName
+}
+
+// FuncDecl the declaration of the function in the file and the file set it was parsed with,
+// fun is the name of the function as in Function.Name
+func FuncDecl(file, fun string) (*ast.FuncDecl, *token.FileSet, error) {
+	pf, err := cache.get(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, ok := pf.funcs[fun]
+	if !ok {
+		return nil, nil, fmt.Errorf("the declaration of %s cannot be found in %s", fun, file)
+	}
+	return f, pf.fset, nil
+}
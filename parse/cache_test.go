@@ -0,0 +1,123 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package parse
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// deepStack the program counters of a stack recursing depth times
+func deepStack(depth int) []uintptr {
+	if depth > 0 {
+		return deepStack(depth - 1)
+	}
+	pc := make([]uintptr, 4096)
+	return pc[:runtime.Callers(1, pc)]
+}
+
+func BenchmarkGetFuncList(b *testing.B) {
+	pc := deepStack(1000)
+	b.Run("cold", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			cache.reset()
+			if funs := GetFuncList(runtime.CallersFrames(pc)); len(funs) == 0 {
+				b.Fatal("no function found")
+			}
+		}
+	})
+	b.Run("warm", func(b *testing.B) {
+		GetFuncList(runtime.CallersFrames(pc))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if funs := GetFuncList(runtime.CallersFrames(pc)); len(funs) == 0 {
+				b.Fatal("no function found")
+			}
+		}
+	})
+}
+
+func TestFileCacheInvalidation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "main.go")
+	write := func(source string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// the same modification time every time, only the size tells the versions apart
+		mtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("package main\n\nfunc A() {}\n")
+	if _, err := ReadFuncSource(file, "A", true); err != nil {
+		t.Fatal(err)
+	}
+	write("package main\n\nfunc A() {}\n\nfunc Bb() {}\n")
+	if _, err := ReadFuncSource(file, "Bb", true); err != nil {
+		t.Fatalf("the file was not parsed again after its size changed: %v", err)
+	}
+}
+
+func TestFileCacheEviction(t *testing.T) {
+	c := &fileCache{files: make(map[string]*parsedFile), max: 3}
+	dir := t.TempDir()
+	files := make([]string, 5)
+	for i := range files {
+		files[i] = filepath.Join(dir, strconv.Itoa(i)+".go")
+		if err := os.WriteFile(files[i], []byte("package main\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(i int) *parsedFile {
+		t.Helper()
+		pf, err := c.get(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pf
+	}
+
+	first := get(0)
+	get(1)
+	get(2)
+	// file 0 is used again, so file 1 is the least recently used one
+	get(0)
+	get(3)
+	if len(c.files) != 3 {
+		t.Fatalf("%d files are cached, want 3", len(c.files))
+	}
+	if _, ok := c.files[files[1]]; ok {
+		t.Error("the least recently used file was not evicted")
+	}
+	if get(0) != first {
+		t.Error("the recently used file was parsed again")
+	}
+	get(4)
+	if len(c.files) != 3 {
+		t.Fatalf("%d files are cached, want 3", len(c.files))
+	}
+}
@@ -22,15 +22,12 @@ package parse
 import (
 	"fmt"
 	"go/ast"
-	"go/parser"
-	"go/token"
+	"go/types"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
-
-	"github.com/ahaostudy/code-diagnostic/utils"
 )
 
 var root string
@@ -42,6 +39,7 @@ func init() {
 		return
 	}
 	root = wd
+	provider = NewFSProvider(root)
 }
 
 type Function struct {
@@ -52,6 +50,9 @@ type Function struct {
 	Type    string   `json:"type"`
 	Source  string   `json:"source"`
 	Line    int      `json:"line"`
+
+	// StartLine the line of the file where the source starts
+	StartLine int `json:"start_line"`
 }
 
 func NewFunction(name string, params, results []*Field, file, source string) *Function {
@@ -89,56 +90,35 @@ func ReadFuncSource(file, fun string, strict bool) (*Function, error) {
 		}
 	}
 
-	fset := token.NewFileSet()
-	node, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+	pf, err := cache.get(file)
 	if err != nil {
-		log.Fatalln("read parse source code failed:", err.Error())
-		return nil, err
+		return nil, fmt.Errorf("read parse source code failed: %w", err)
 	}
 
-	for _, decl := range node.Decls {
-		var f *ast.FuncDecl
-		var ok bool
-		if f, ok = decl.(*ast.FuncDecl); !ok {
-			continue
-		}
-		funcName := f.Name.Name
-		if f.Recv != nil && len(f.Recv.List) > 0 {
-			switch typ := f.Recv.List[0].Type.(type) {
-			case *ast.Ident:
-				funcName = typ.Name + "." + funcName
-			case *ast.StarExpr:
-				if ident, ok := typ.X.(*ast.Ident); ok {
-					funcName = "(*" + ident.Name + ")." + funcName
+	if f, ok := pf.funcs[fun]; ok {
+		start := pf.fset.Position(f.Pos()).Offset
+		end := pf.fset.Position(f.End()).Offset
+
+		var params []*Field
+		for _, param := range f.Type.Params.List {
+			for _, name := range param.Names {
+				p := &Field{Name: name.Name}
+				if decl, ok := name.Obj.Decl.(*ast.Field); ok {
+					p.Type = GetTypeStr(decl.Type)
 				}
+				params = append(params, p)
 			}
 		}
-		if fun == funcName {
-			start := fset.Position(f.Pos()).Offset
-			end := fset.Position(f.End()).Offset
-			// read source code
-			// TODO: handle index out of range
-			source := utils.ReadFile(file)
-
-			var params []*Field
-			for _, param := range f.Type.Params.List {
-				for _, name := range param.Names {
-					p := &Field{Name: name.Name}
-					if decl, ok := name.Obj.Decl.(*ast.Field); ok {
-						p.Type = GetTypeStr(decl.Type)
-					}
-					params = append(params, p)
-				}
-			}
-			var results []*Field
-			if f.Type.Results != nil {
-				for _, result := range f.Type.Results.List {
-					r := &Field{Type: GetTypeStr(result.Type)}
-					results = append(results, r)
-				}
+		var results []*Field
+		if f.Type.Results != nil {
+			for _, result := range f.Type.Results.List {
+				r := &Field{Type: GetTypeStr(result.Type)}
+				results = append(results, r)
 			}
-			return NewFunction(fun, params, results, file, string(source[start:end])), nil
 		}
+		function := NewFunction(fun, params, results, file, string(pf.source[start:end]))
+		function.StartLine = pf.fset.Position(f.Pos()).Line
+		return function, nil
 	}
 	if strings.Contains(fun, ".") && !strict {
 		return ReadFuncSource(file, strings.TrimRight(fun, filepath.Ext(fun)), strict)
@@ -147,35 +127,21 @@ func ReadFuncSource(file, fun string, strict bool) (*Function, error) {
 	return nil, fmt.Errorf("the source code of parse %s cannot be found in %s", fun, file)
 }
 
+// GetTypeStr the type as written in the source, such as *report.Report or chan<- int
 func GetTypeStr(t ast.Expr) string {
-	switch typ := t.(type) {
-	case *ast.Ident:
-		return typ.Name
-	case *ast.StarExpr:
-		if ident, ok := typ.X.(*ast.Ident); ok {
-			return "*" + ident.Name
-		}
-	case *ast.ArrayType:
-		if ident, ok := typ.Elt.(*ast.Ident); ok {
-			return "[]" + ident.Name
-		}
-	case *ast.MapType:
-		if key, ok := typ.Key.(*ast.Ident); ok {
-			if value, ok := typ.Value.(*ast.Ident); ok {
-				return "map[" + key.Name + "]" + value.Name
-			}
-		}
-	default:
-		log.Fatalln("unsupported type:", typ)
-	}
-	return ""
+	return types.ExprString(t)
 }
 
 func GetFuncList(frames *runtime.Frames) (funs []*Function) {
 	set := map[string]struct{}{}
 	for {
 		frame, more := frames.Next()
-		if strings.HasPrefix(frame.File, root) {
+		if frame.Function == "runtime.gopanic" {
+			// the frames above the panic belong to the deferred recovery
+			funs = funs[:0]
+			set = map[string]struct{}{}
+		}
+		if sourceProvider().Contains(frame.File) {
 			if _, ok := set[frame.Function]; !ok {
 				fun, err := ReadFuncSource(frame.File, frame.Function, true)
 				if err != nil {
@@ -0,0 +1,185 @@
+/**
+ * copyright ahaostudy
+ *
+ * licensed to the apache software foundation (asf) under one or more
+ * contributor license agreements.  see the notice file distributed with
+ * this work for additional information regarding copyright ownership.
+ * the asf licenses this file to you under the apache license, version 2.0
+ * (the "license"); you may not use this file except in compliance with
+ * the license.  you may obtain a copy of the license at
+ *
+ *     http://www.apache.org/licenses/license-2.0
+ *
+ * unless required by applicable law or agreed to in writing, software
+ * distributed under the license is distributed on an "as is" basis,
+ * without warranties or conditions of any kind, either express or implied.
+ * see the license for the specific language governing permissions and
+ * limitations under the license.
+ */
+
+package parse
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SourceProvider where the source files of the stack are read from
+type SourceProvider interface {
+	// Contains report whether the file belongs to the provided sources
+	Contains(file string) bool
+	// Stat the information of the file, its modification time and size invalidate parsed files
+	Stat(file string) (fs.FileInfo, error)
+	ReadFile(file string) ([]byte, error)
+}
+
+var (
+	providerMu sync.RWMutex
+	provider   SourceProvider
+
+	// osProvider read the files the source provider does not contain from the file system
+	osProvider = &fsProvider{}
+)
+
+// SetSourceProvider specify where the source files are read from, the working directory by default,
+// it is shared by the whole process
+func SetSourceProvider(p SourceProvider) {
+	providerMu.Lock()
+	provider = p
+	providerMu.Unlock()
+	cache.reset()
+}
+
+func sourceProvider() SourceProvider {
+	providerMu.RLock()
+	defer providerMu.RUnlock()
+	return provider
+}
+
+// sourceOf the provider of the file, the file system if the source provider does not contain it,
+// such as the files of GOROOT
+func sourceOf(file string) SourceProvider {
+	if p := sourceProvider(); p.Contains(file) {
+		return p
+	}
+	return osProvider
+}
+
+// ReadSourceFile read the file from the source provider,
+// or from the file system if it is not provided, such as the files of GOROOT
+func ReadSourceFile(file string) ([]byte, error) {
+	return sourceOf(file).ReadFile(file)
+}
+
+type fsProvider struct {
+	root string
+}
+
+// NewFSProvider provide the source files under root from the file system
+func NewFSProvider(root string) SourceProvider {
+	return &fsProvider{root: root}
+}
+
+func (p *fsProvider) Contains(file string) bool {
+	dir := strings.TrimSuffix(p.root, string(filepath.Separator)) + string(filepath.Separator)
+	return file == p.root || strings.HasPrefix(file, dir)
+}
+
+func (p *fsProvider) Stat(file string) (fs.FileInfo, error) {
+	return os.Stat(file)
+}
+
+func (p *fsProvider) ReadFile(file string) ([]byte, error) {
+	return os.ReadFile(file)
+}
+
+// BundleManifest the manifest stored as bundle.json at the top of a source bundle
+type BundleManifest struct {
+	// Module the module path, it prefixes the files of binaries built with -trimpath
+	Module string `json:"module"`
+	// Root the directory of the module on the machine the binary was built on
+	Root string `json:"root"`
+	// Dir the directory of the bundle holding the source files
+	Dir string `json:"dir"`
+	// Suffix appended to the name of every source file in the bundle
+	Suffix  string    `json:"suffix,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+const BundleManifestName = "bundle.json"
+
+type bundleProvider struct {
+	fsys     fs.FS
+	manifest *BundleManifest
+}
+
+// NewBundleProvider provide the source files from a bundle generated by the diagbundle command,
+// such as the embed.FS of an embedded bundle
+func NewBundleProvider(fsys fs.FS) (SourceProvider, error) {
+	data, err := fs.ReadFile(fsys, BundleManifestName)
+	if err != nil {
+		return nil, fmt.Errorf("read bundle manifest failed: %w", err)
+	}
+	manifest := new(BundleManifest)
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("parse bundle manifest failed: %w", err)
+	}
+	return &bundleProvider{fsys: fsys, manifest: manifest}, nil
+}
+
+// NewArchiveProvider provide the source files from a sidecar zip archive generated by the diagbundle command
+func NewArchiveProvider(file string) (SourceProvider, error) {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewBundleProvider(r)
+}
+
+// name the name of the file in the bundle
+func (p *bundleProvider) name(file string) (string, bool) {
+	file = filepath.ToSlash(file)
+	for _, prefix := range []string{p.manifest.Root, p.manifest.Module} {
+		if prefix == "" {
+			continue
+		}
+		prefix = strings.TrimSuffix(filepath.ToSlash(prefix), "/") + "/"
+		if rel, ok := strings.CutPrefix(file, prefix); ok {
+			return path.Join(p.manifest.Dir, rel) + p.manifest.Suffix, true
+		}
+	}
+	return "", false
+}
+
+func (p *bundleProvider) Contains(file string) bool {
+	name, ok := p.name(file)
+	if !ok {
+		return false
+	}
+	_, err := fs.Stat(p.fsys, name)
+	return err == nil
+}
+
+func (p *bundleProvider) Stat(file string) (fs.FileInfo, error) {
+	name, ok := p.name(file)
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the source bundle: %w", file, fs.ErrNotExist)
+	}
+	return fs.Stat(p.fsys, name)
+}
+
+func (p *bundleProvider) ReadFile(file string) ([]byte, error) {
+	name, ok := p.name(file)
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the source bundle: %w", file, fs.ErrNotExist)
+	}
+	return fs.ReadFile(p.fsys, name)
+}
@@ -0,0 +1,259 @@
+/**
+ * copyright ahaostudy
+ *
+ * licensed to the apache software foundation (asf) under one or more
+ * contributor license agreements.  see the notice file distributed with
+ * this work for additional information regarding copyright ownership.
+ * the asf licenses this file to you under the apache license, version 2.0
+ * (the "license"); you may not use this file except in compliance with
+ * the license.  you may obtain a copy of the license at
+ *
+ *     http://www.apache.org/licenses/license-2.0
+ *
+ * unless required by applicable law or agreed to in writing, software
+ * distributed under the license is distributed on an "as is" basis,
+ * without warranties or conditions of any kind, either express or implied.
+ * see the license for the specific language governing permissions and
+ * limitations under the license.
+ */
+
+package parse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SourceLister optional interface of SourceProvider listing the go files it provides
+type SourceLister interface {
+	Files() ([]string, error)
+}
+
+// SourceFiles list the go files of the source provider
+func SourceFiles() ([]string, error) {
+	lister, ok := sourceProvider().(SourceLister)
+	if !ok {
+		return nil, errors.New("the source provider cannot list its files")
+	}
+	return lister.Files()
+}
+
+func (p *fsProvider) Files() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(p.root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if file != p.root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(name, ".go") {
+			files = append(files, file)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (p *bundleProvider) Files() ([]string, error) {
+	prefix := p.manifest.Root
+	if prefix == "" {
+		prefix = p.manifest.Module
+	}
+	var files []string
+	err := fs.WalkDir(p.fsys, p.manifest.Dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(name, ".go"+p.manifest.Suffix) {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimSuffix(name, p.manifest.Suffix), p.manifest.Dir+"/")
+		files = append(files, path.Join(filepath.ToSlash(prefix), rel))
+		return nil
+	})
+	return files, err
+}
+
+// ResolveFile find the provided go file by its path or the end of it, such as math/math.go,
+// only the listed files are resolved so that nothing outside of the sources can be read
+func ResolveFile(name string) (string, error) {
+	files, err := SourceFiles()
+	if err != nil {
+		return "", err
+	}
+	name = path.Clean(filepath.ToSlash(name))
+	suffix := "/" + strings.TrimPrefix(name, "/")
+	var matches []string
+	for _, file := range files {
+		slashed := filepath.ToSlash(file)
+		if slashed == name {
+			return file, nil
+		}
+		if strings.HasSuffix(slashed, suffix) {
+			matches = append(matches, file)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%s is not a source file of the project", name)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("%s is ambiguous: %s", name, strings.Join(matches, ", "))
+}
+
+// Declaration a top-level declaration of the source
+type Declaration struct {
+	// Kind func, method, type, var or const
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Source string `json:"source"`
+}
+
+// FindDeclarations find the top-level declarations named name in the provided files,
+// methods are matched by T.Method, (*T).Method or by the method name alone
+func FindDeclarations(name string) ([]*Declaration, error) {
+	var decls []*Declaration
+	err := walkSources(func(file string, pf *parsedFile) {
+		for _, decl := range pf.node.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if funcDeclName(d) != name && d.Name.Name != name {
+					continue
+				}
+				kind := "func"
+				if d.Recv != nil {
+					kind = "method"
+				}
+				decls = append(decls, pf.declaration(kind, funcDeclName(d), file, d))
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					var node ast.Node = spec
+					// a declaration of a single spec keeps its keyword and doc
+					if len(d.Specs) == 1 {
+						node = d
+					}
+					switch sp := spec.(type) {
+					case *ast.TypeSpec:
+						if sp.Name.Name == name {
+							decls = append(decls, pf.declaration("type", name, file, node))
+						}
+					case *ast.ValueSpec:
+						for _, n := range sp.Names {
+							if n.Name == name {
+								decls = append(decls, pf.declaration(d.Tok.String(), name, file, node))
+							}
+						}
+					}
+				}
+			}
+		}
+	})
+	return decls, err
+}
+
+func (pf *parsedFile) declaration(kind, name, file string, node ast.Node) *Declaration {
+	start := pf.fset.Position(node.Pos())
+	if gd, ok := node.(*ast.GenDecl); ok && gd.Doc != nil {
+		start = pf.fset.Position(gd.Doc.Pos())
+	}
+	end := pf.fset.Position(node.End())
+	return &Declaration{
+		Kind:   kind,
+		Name:   name,
+		File:   file,
+		Line:   start.Line,
+		Source: string(pf.source[start.Offset:end.Offset]),
+	}
+}
+
+// Call a call expression of the source
+type Call struct {
+	// Caller the function the call is made in, empty for package-level calls
+	Caller string `json:"caller"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Code   string `json:"code"`
+}
+
+// FindCallers find the calls of the function in the provided files. The calls are matched by name
+// without type information, so that the calls of other functions and methods with the same name are included.
+func FindCallers(name string) ([]*Call, error) {
+	// the name as it is called, Div of math.Div, Method of (*T).Method
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	var calls []*Call
+	err := walkSources(func(file string, pf *parsedFile) {
+		for _, decl := range pf.node.Decls {
+			caller := ""
+			if f, ok := decl.(*ast.FuncDecl); ok {
+				caller = funcDeclName(f)
+			}
+			ast.Inspect(decl, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok || callName(call.Fun) != name {
+					return true
+				}
+				pos := pf.fset.Position(call.Pos())
+				calls = append(calls, &Call{Caller: caller, File: file, Line: pos.Line, Code: pf.line(pos)})
+				return true
+			})
+		}
+	})
+	return calls, err
+}
+
+func callName(fun ast.Expr) string {
+	switch f := fun.(type) {
+	case *ast.Ident:
+		return f.Name
+	case *ast.SelectorExpr:
+		return f.Sel.Name
+	case *ast.IndexExpr:
+		// generic function with explicit type arguments
+		return callName(f.X)
+	case *ast.IndexListExpr:
+		return callName(f.X)
+	}
+	return ""
+}
+
+// line the source line of the position without indentation
+func (pf *parsedFile) line(pos token.Position) string {
+	start := bytes.LastIndexByte(pf.source[:pos.Offset], '\n') + 1
+	end := bytes.IndexByte(pf.source[pos.Offset:], '\n')
+	if end < 0 {
+		end = len(pf.source) - pos.Offset
+	}
+	return strings.TrimSpace(string(pf.source[start : pos.Offset+end]))
+}
+
+// walkSources parse every provided file in order, the files that cannot be parsed are skipped
+func walkSources(fn func(file string, pf *parsedFile)) error {
+	files, err := SourceFiles()
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		pf, err := cache.get(file)
+		if err != nil {
+			continue
+		}
+		fn(file, pf)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package parse
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sourceTree write the files under a temporary root and provide them for the test
+func sourceTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "project")
+	for name, source := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := sourceProvider()
+	SetSourceProvider(NewFSProvider(root))
+	t.Cleanup(func() { SetSourceProvider(previous) })
+	return root
+}
+
+func TestResolveFile(t *testing.T) {
+	root := sourceTree(t, map[string]string{
+		"project/main.go":              "package main\n",
+		"project/a/math/math.go":       "package math\n",
+		"project/b/math/math.go":       "package math\n",
+		"project/util/util.go":         "package util\n",
+		"project/vendor/dep/dep.go":    "package dep\n",
+		"project/testdata/fixture.go":  "package fixture\n",
+		"project/.hidden/secret.go":    "package hidden\n",
+		"outside.go":                   "package outside\n",
+		"project-other/neighbour/n.go": "package neighbour\n",
+	})
+
+	tests := []struct {
+		name string
+		want string
+		err  string
+	}{
+		{name: filepath.Join(root, "util", "util.go"), want: "util/util.go"},
+		{name: "util/util.go", want: "util/util.go"},
+		{name: "util.go", want: "util/util.go"},
+		{name: "./a/math/math.go", want: "a/math/math.go"},
+		{name: "a/math/../math/math.go", want: "a/math/math.go"},
+		{name: "math/math.go", err: "ambiguous"},
+		{name: "missing.go", err: "not a source file"},
+		{name: "vendor/dep/dep.go", err: "not a source file"},
+		{name: "testdata/fixture.go", err: "not a source file"},
+		{name: ".hidden/secret.go", err: "not a source file"},
+		{name: "../outside.go", err: "not a source file"},
+		{name: "util/../../outside.go", err: "not a source file"},
+		{name: filepath.Join(root, "..", "outside.go"), err: "not a source file"},
+		{name: "../project-other/neighbour/n.go", err: "not a source file"},
+	}
+	for _, tt := range tests {
+		got, err := ResolveFile(tt.name)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ResolveFile(%q) = %q, %v, want an error containing %q", tt.name, got, err, tt.err)
+			}
+			continue
+		}
+		if want := filepath.Join(root, filepath.FromSlash(tt.want)); err != nil || got != want {
+			t.Errorf("ResolveFile(%q) = %q, %v, want %q", tt.name, got, err, want)
+		}
+	}
+}
+
+const searchSource = `package shop
+
+// Cart the items of a customer
+type Cart struct {
+	Items []int
+}
+
+// limit the most items of a cart
+const limit = 10
+
+var (
+	empty = Cart{}
+	total = Sum(empty.Items)
+)
+
+func Sum(items []int) int {
+	n := 0
+	for _, i := range items {
+		n += i
+	}
+	return n
+}
+
+func (c Cart) Total() int {
+	return Sum(c.Items)
+}
+
+func (c *Cart) Add(item int) {
+	c.Items = append(c.Items, item)
+	_ = c.Total()
+}
+`
+
+func TestFindDeclarations(t *testing.T) {
+	root := sourceTree(t, map[string]string{
+		"project/shop/shop.go":  searchSource,
+		"project/other/cart.go": "package other\n\nfunc Add(a, b int) int { return a + b }\n",
+	})
+	shop := filepath.Join(root, "shop", "shop.go")
+
+	tests := []struct {
+		name  string
+		kinds []string
+		line  int
+		has   string
+	}{
+		{name: "Cart", kinds: []string{"type"}, line: 3, has: "// Cart the items of a customer\ntype Cart struct"},
+		{name: "limit", kinds: []string{"const"}, line: 8, has: "const limit = 10"},
+		{name: "total", kinds: []string{"var"}, line: 13, has: "total = Sum(empty.Items)"},
+		{name: "Sum", kinds: []string{"func"}, line: 16, has: "func Sum(items []int) int {"},
+		{name: "Cart.Total", kinds: []string{"method"}, line: 24, has: "func (c Cart) Total() int {"},
+		{name: "(*Cart).Add", kinds: []string{"method"}, line: 28, has: "func (c *Cart) Add(item int) {"},
+		{name: "Total", kinds: []string{"method"}, line: 24},
+		// the method name alone matches the functions of the same name too
+		{name: "Add", kinds: []string{"func", "method"}},
+		{name: "Missing"},
+	}
+	for _, tt := range tests {
+		decls, err := FindDeclarations(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kinds []string
+		for _, d := range decls {
+			kinds = append(kinds, d.Kind)
+		}
+		if strings.Join(kinds, ",") != strings.Join(tt.kinds, ",") {
+			t.Errorf("FindDeclarations(%q) found %v, want %v", tt.name, kinds, tt.kinds)
+			continue
+		}
+		if tt.line == 0 {
+			continue
+		}
+		d := decls[0]
+		if d.File != shop || d.Line != tt.line || !strings.Contains(d.Source, tt.has) {
+			t.Errorf("FindDeclarations(%q) = %s:%d %q, want %s:%d containing %q", tt.name, d.File, d.Line, d.Source, shop, tt.line, tt.has)
+		}
+	}
+}
+
+func TestFindCallers(t *testing.T) {
+	root := sourceTree(t, map[string]string{
+		"project/shop/shop.go": searchSource,
+		"project/main.go":      "package main\n\nimport \"shop\"\n\nfunc main() {\n\tprintln(shop.Sum(nil))\n}\n",
+	})
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{name: "Sum", want: []string{
+			"main.go:6 in main: println(shop.Sum(nil))",
+			"shop/shop.go:13 in package scope: total = Sum(empty.Items)",
+			"shop/shop.go:25 in Cart.Total: return Sum(c.Items)",
+		}},
+		{name: "shop.Sum", want: []string{
+			"main.go:6 in main: println(shop.Sum(nil))",
+			"shop/shop.go:13 in package scope: total = Sum(empty.Items)",
+			"shop/shop.go:25 in Cart.Total: return Sum(c.Items)",
+		}},
+		{name: "Cart.Total", want: []string{"shop/shop.go:30 in (*Cart).Add: _ = c.Total()"}},
+		{name: "Add"},
+	}
+	for _, tt := range tests {
+		calls, err := FindCallers(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range calls {
+			rel, _ := filepath.Rel(root, c.File)
+			caller := c.Caller
+			if caller == "" {
+				caller = "package scope"
+			}
+			got = append(got, filepath.ToSlash(rel)+":"+strconv.Itoa(c.Line)+" in "+caller+": "+c.Code)
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("FindCallers(%q) =\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
@@ -28,10 +28,13 @@ type StackTrace struct {
 	Func string `json:"func"`
 	File string `json:"file"`
 	Line int    `json:"line"`
+
+	// Args the argument words printed in the stack, one group per argument
+	Args []string `json:"args"`
 }
 
 func StackTraces(stack []byte) []*StackTrace {
-	regex := regexp.MustCompile(`(?m)(.*?)\((.*?)\)\n\s+(.*?):(\d+)`)
+	regex := regexp.MustCompile(`(?m)^(.*)\((.*)\)\n\s+(.*?):(\d+)`)
 	matches := regex.FindAllSubmatch(stack, -1)
 	var stackTraces []*StackTrace
 	for _, match := range matches {
@@ -40,6 +43,7 @@ func StackTraces(stack []byte) []*StackTrace {
 			Func: string(match[1]),
 			File: string(match[3]),
 			Line: line,
+			Args: splitArgs(string(match[2])),
 		})
 	}
 	return stackTraces
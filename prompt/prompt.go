@@ -0,0 +1,389 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package prompt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/parse"
+	"github.com/ahaostudy/code-diagnostic/report"
+)
+
+const (
+	// defaultBudget used when the context window of the model is unknown
+	defaultBudget = 3072
+	// maxAnswerReserve the most tokens kept free for the answer of the model
+	maxAnswerReserve = 4096
+	// maxWindowRadius the most lines kept around the failing line of a trimmed function
+	maxWindowRadius = 12
+)
+
+// Builder assemble the diagnosis prompt within a token budget
+type Builder struct {
+	budget     int
+	language   string
+	structured bool
+	guidance   string
+	system     *template.Template
+	user       *template.Template
+}
+
+func NewBuilder(opts ...Option) *Builder {
+	b := &Builder{budget: defaultBudget, system: defaultSystemTemplate, user: defaultUserTemplate}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+type Option func(*Builder)
+
+// WithBudget specify the most tokens the prompt can take
+func WithBudget(tokens int) Option {
+	return func(b *Builder) {
+		b.budget = tokens
+	}
+}
+
+// WithLanguage ask the model to reply in the language of the BCP 47 tag, such as "ja" or "pt-BR",
+// malformed tags are ignored
+func WithLanguage(tag string) Option {
+	return func(b *Builder) {
+		if !ValidLanguage(tag) {
+			log.Printf("ignoring the malformed language tag %q", tag)
+			return
+		}
+		b.language = tag
+	}
+}
+
+// WithUseChinese ask the model to reply in chinese
+//
+// Deprecated: use WithLanguage("zh")
+func WithUseChinese() Option {
+	return WithLanguage("zh")
+}
+
+// WithStructured ask the model to reply with a JSON object matching report.DiagnosisSchema
+func WithStructured() Option {
+	return func(b *Builder) {
+		b.structured = true
+	}
+}
+
+// WithGuidance add the guidance of the project to the system message, such as the content of its DIAGNOSTIC.md
+func WithGuidance(guidance string) Option {
+	return func(b *Builder) {
+		b.guidance = strings.TrimSpace(guidance)
+	}
+}
+
+// WithSystemTemplate replace DefaultSystemTemplate, the template is executed with Data
+func WithSystemTemplate(tmpl *template.Template) Option {
+	return func(b *Builder) {
+		b.system = tmpl
+	}
+}
+
+// WithUserTemplate replace DefaultUserTemplate, the template is executed with Data
+func WithUserTemplate(tmpl *template.Template) Option {
+	return func(b *Builder) {
+		b.user = tmpl
+	}
+}
+
+// BudgetFor the prompt budget of a model with the given context window, the rest is left for the answer
+func BudgetFor(contextWindow int) int {
+	if contextWindow <= 0 {
+		return defaultBudget
+	}
+	reserve := contextWindow / 4
+	if reserve > maxAnswerReserve {
+		reserve = maxAnswerReserve
+	}
+	return contextWindow - reserve
+}
+
+// Build build the messages of the report and return them with the content left out of them.
+// Functions are ranked by the proximity of their frame to the panic, the ones that do not fit are trimmed
+// to the lines around the failing line or dropped.
+func (b *Builder) Build(rep *report.Report) ([]*bigmodel.Message, []*report.Omission, error) {
+	var omitted omissions
+	data := &Data{Report: rep, Structured: b.structured}
+	if b.language != "" {
+		data.Language, data.LanguageName = b.language, LanguageName(b.language)
+	}
+	if b.structured {
+		schema, _ := json.MarshalIndent(report.DiagnosisSchema.Schema, "", "  ")
+		data.Schema = string(schema)
+	}
+	// the guidance gets at most a quarter of the budget
+	data.Guidance = omitted.fitText(report.SectionGuidance, "project guidance", b.guidance, b.budget/4)
+	// the similar incidents get at most a fifth of the budget
+	data.Similar = omitted.fitText(report.SectionSimilar, "similar incidents", similarText(rep.Similar), b.budget/5)
+
+	// the templates without the fitted content, as if some of it was trimmed
+	data.Trimmed = true
+	if rep.History != nil {
+		data.History = "\n"
+	}
+	system, user, err := b.execute(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	remaining := b.budget - CountTokens(system) - CountTokens(user)
+
+	// the function closest to the panic gets at most half of the budget
+	funs := make([]string, len(rep.LocalFunctions))
+	if len(rep.LocalFunctions) > 0 {
+		funs[0] = omitted.fit(rep.LocalFunctions[0], remaining/2-fileTokens(rep.LocalFunctions[0]))
+		remaining -= sourceTokens(rep.LocalFunctions[0], funs[0])
+	}
+
+	// the stack gets at most half of what is left
+	data.Stack = omitted.fitStack(rep.Stack, remaining/2)
+	remaining -= CountTokens(data.Stack)
+
+	// the recent changes get at most a third of what is left
+	data.History = ""
+	if rep.History != nil {
+		data.History = omitted.fitText(report.SectionHistory, "recent changes", rep.History.String(), remaining/3)
+		remaining -= CountTokens(data.History)
+	}
+
+	for i := 1; i < len(rep.LocalFunctions); i++ {
+		funs[i] = omitted.fit(rep.LocalFunctions[i], remaining-fileTokens(rep.LocalFunctions[i]))
+		remaining -= sourceTokens(rep.LocalFunctions[i], funs[i])
+	}
+	data.Sources = buildSourceList(rep.LocalFunctions, funs)
+	data.Trimmed = len(omitted) > 0
+
+	system, user, err = b.execute(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var messages []*bigmodel.Message
+	if strings.TrimSpace(system) != "" {
+		messages = append(messages, bigmodel.SystemMessage(system))
+	}
+	messages = append(messages, bigmodel.UserMessage(user))
+	return messages, omitted, nil
+}
+
+// execute the system and user templates
+func (b *Builder) execute(data *Data) (string, string, error) {
+	var system, user strings.Builder
+	if err := b.system.Execute(&system, data); err != nil {
+		return "", "", fmt.Errorf("system prompt template: %w", err)
+	}
+	if err := b.user.Execute(&user, data); err != nil {
+		return "", "", fmt.Errorf("user prompt template: %w", err)
+	}
+	return system.String(), user.String(), nil
+}
+
+// Repair ask the model to correct its structured answer that could not be parsed
+func Repair(err error) string {
+	return fmt.Sprintf("Your reply could not be used: %v. Reply again with only the JSON object matching the schema.", err)
+}
+
+type omissions []*report.Omission
+
+// fileTokens the tokens of the file heading and code fences of a function in the source list
+func fileTokens(fun *parse.Function) int {
+	return CountTokens(fun.File + ":\n```go\n\n```\n")
+}
+
+// sourceTokens the tokens a function takes in the source list
+func sourceTokens(fun *parse.Function, source string) int {
+	if source == "" {
+		return 0
+	}
+	return fileTokens(fun) + CountTokens(source)
+}
+
+// fit return the source of the function that fits into max tokens, or an empty string if dropped
+func (o *omissions) fit(fun *parse.Function, max int) string {
+	tokens := CountTokens(fun.Source)
+	if tokens <= max {
+		return fun.Source
+	}
+	lines := strings.Split(fun.Source, "\n")
+	failing := fun.Line - fun.StartLine
+	if fun.StartLine == 0 || failing < 0 || failing >= len(lines) {
+		failing = 0
+	}
+	for radius := maxWindowRadius; radius >= 0; radius-- {
+		source := sourceWindow(lines, failing, radius)
+		if CountTokens(source) <= max {
+			*o = append(*o, &report.Omission{
+				Section: report.SectionFunction,
+				Name:    fun.Name,
+				Action:  report.ActionTrimmed,
+				Tokens:  tokens - CountTokens(source),
+			})
+			return source
+		}
+	}
+	*o = append(*o, &report.Omission{
+		Section: report.SectionFunction,
+		Name:    fun.Name,
+		Action:  report.ActionDropped,
+		Tokens:  tokens,
+	})
+	return ""
+}
+
+// sourceWindow keep the signature and the lines around the failing line
+func sourceWindow(lines []string, failing, radius int) string {
+	start, end := failing-radius, failing+radius+1
+	if start < 1 {
+		start = 1
+	}
+	if end > len(lines) {
+		end = len(lines)
+	}
+	window := []string{lines[0]}
+	if start > 1 {
+		window = append(window, fmt.Sprintf("\t// ... %d lines omitted", start-1))
+	}
+	if start < end {
+		window = append(window, lines[start:end]...)
+	}
+	if end < len(lines)-1 {
+		window = append(window, fmt.Sprintf("\t// ... %d lines omitted", len(lines)-1-end), lines[len(lines)-1])
+	} else if end == len(lines)-1 {
+		window = append(window, lines[end])
+	}
+	return strings.Join(window, "\n")
+}
+
+// fitStack keep the frames from the panic on and cut the tail of the stack until it fits into max tokens
+func (o *omissions) fitStack(stack string, max int) string {
+	tokens := CountTokens(stack)
+	if tokens <= max {
+		return stack
+	}
+	lines := strings.Split(strings.TrimSuffix(stack, "\n"), "\n")
+
+	// drop the frames of the diagnostic itself, the ones above the panic
+	kept := lines[:1]
+	frames := lines[1:]
+	for i := 0; i+1 < len(frames); i += 2 {
+		if strings.HasPrefix(frames[i], "panic(") {
+			frames = frames[i:]
+			break
+		}
+	}
+
+	var result string
+	for n := len(frames) / 2; n >= 0; n-- {
+		lines := append(append([]string{}, kept...), frames[:n*2]...)
+		if n*2 < len(frames) {
+			lines = append(lines, fmt.Sprintf("... %d more frames omitted", (len(frames)-n*2+1)/2))
+		}
+		result = strings.Join(lines, "\n") + "\n"
+		if CountTokens(result) <= max {
+			break
+		}
+	}
+	action := report.ActionTrimmed
+	if CountTokens(result) > max {
+		result, action = "", report.ActionDropped
+	}
+	*o = append(*o, &report.Omission{
+		Section: report.SectionStack,
+		Name:    "call stack",
+		Action:  action,
+		Tokens:  tokens - CountTokens(result),
+	})
+	return result
+}
+
+// fitText keep the leading lines of the text until it fits into max tokens
+func (o *omissions) fitText(section, name, text string, max int) string {
+	tokens := CountTokens(text)
+	if tokens <= max {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	for n := len(lines) - 1; n > 0; n-- {
+		result := strings.Join(lines[:n], "\n") + "\n...\n"
+		if strings.Count(result, "```")%2 == 1 {
+			// close the code block that was cut
+			result += "```\n"
+		}
+		if CountTokens(result) <= max {
+			*o = append(*o, &report.Omission{
+				Section: section,
+				Name:    name,
+				Action:  report.ActionTrimmed,
+				Tokens:  tokens - CountTokens(result),
+			})
+			return result
+		}
+	}
+	*o = append(*o, &report.Omission{
+		Section: section,
+		Name:    name,
+		Action:  report.ActionDropped,
+		Tokens:  tokens,
+	})
+	return ""
+}
+
+// similarText the similar incidents with their resolutions
+func similarText(similar []*report.SimilarIncident) string {
+	var buf strings.Builder
+	for i, s := range similar {
+		fmt.Fprintf(&buf, "Incident %d of %s, %.0f%% similar:\n```\n%s\n```\n", i+1, s.Time.Format("2006-01-02"), s.Score*100, s.Panic)
+		if len(s.Frames) > 0 {
+			buf.WriteString("In " + strings.Join(s.Frames, ", ") + "\n")
+		}
+		buf.WriteString("Resolution:\n" + s.Answer + "\n\n")
+	}
+	return buf.String()
+}
+
+// buildSourceList group the kept sources by file in the order of proximity to the panic
+func buildSourceList(funs []*parse.Function, sources []string) string {
+	var files []string
+	fileSources := make(map[string][]string)
+	for i, f := range funs {
+		if sources[i] == "" {
+			continue
+		}
+		if _, ok := fileSources[f.File]; !ok {
+			files = append(files, f.File)
+		}
+		fileSources[f.File] = append(fileSources[f.File], sources[i])
+	}
+
+	var desc string
+	for _, file := range files {
+		desc += file + ":\n```go\n" + strings.Join(fileSources[file], "\n") + "\n```\n"
+	}
+	return desc
+}
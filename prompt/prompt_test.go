@@ -0,0 +1,217 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package prompt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/parse"
+	"github.com/ahaostudy/code-diagnostic/report"
+)
+
+const testStack = `goroutine 1 [running]:
+runtime/debug.Stack()
+	/usr/local/go/src/runtime/debug/stack.go:24 +0x5e
+github.com/ahaostudy/code-diagnostic/diagnostic.(*Diag).Diagnose(0xc000010000)
+	/src/diagnostic/diagnostic.go:120 +0x45
+panic({0x4a1f20?, 0x5a8c30?})
+	/usr/local/go/src/runtime/panic.go:770 +0x132
+main.divide(0x1, 0x0)
+	/app/main.go:12 +0x1d
+main.compute(...)
+	/app/main.go:18
+main.run(0xc000012345)
+	/app/main.go:25 +0x3f
+main.main()
+	/app/main.go:30 +0x25
+`
+
+// testFunction a function of n statements failing on the statement at the line
+func testFunction(name string, n, line int) *parse.Function {
+	lines := []string{fmt.Sprintf("func %s() {", name)}
+	for i := 1; i <= n; i++ {
+		lines = append(lines, fmt.Sprintf("\tstep%d := compute(%d)", i, i))
+	}
+	lines = append(lines, "}")
+	return &parse.Function{Name: "main." + name, File: "/app/main.go", Source: strings.Join(lines, "\n"), StartLine: 10, Line: line}
+}
+
+func TestSourceWindow(t *testing.T) {
+	lines := strings.Split(testFunction("divide", 8, 0).Source, "\n")
+	tests := []struct {
+		name            string
+		failing, radius int
+		want            []string
+	}{
+		{name: "middle", failing: 4, radius: 1, want: []string{
+			lines[0], "\t// ... 2 lines omitted", lines[3], lines[4], lines[5], "\t// ... 3 lines omitted", lines[9],
+		}},
+		{name: "first statement", failing: 1, radius: 1, want: []string{
+			lines[0], lines[1], lines[2], "\t// ... 6 lines omitted", lines[9],
+		}},
+		{name: "last statement", failing: 8, radius: 1, want: []string{
+			lines[0], "\t// ... 6 lines omitted", lines[7], lines[8], lines[9],
+		}},
+		{name: "signature only", failing: 0, radius: 0, want: []string{
+			lines[0], "\t// ... 8 lines omitted", lines[9],
+		}},
+		{name: "whole function", failing: 4, radius: 12, want: lines},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := sourceWindow(lines, tt.failing, tt.radius), strings.Join(tt.want, "\n"); got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestFit(t *testing.T) {
+	fun := testFunction("divide", 40, 30)
+	var o omissions
+	if got := o.fit(fun, CountTokens(fun.Source)); got != fun.Source || len(o) != 0 {
+		t.Fatalf("the function that fits was changed to\n%s\nwith %+v", got, o)
+	}
+
+	got := o.fit(fun, CountTokens(fun.Source)/2)
+	if !strings.Contains(got, "step20 := compute(20)") || strings.Contains(got, "step1 :=") || CountTokens(got) > CountTokens(fun.Source)/2 {
+		t.Errorf("trimmed to\n%s\nwant the lines around the failing line", got)
+	}
+	if len(o) != 1 || o[0].Action != report.ActionTrimmed || o[0].Tokens != CountTokens(fun.Source)-CountTokens(got) {
+		t.Errorf("omissions %+v", o)
+	}
+
+	o = nil
+	if got := o.fit(fun, 3); got != "" || len(o) != 1 || o[0].Action != report.ActionDropped || o[0].Tokens != CountTokens(fun.Source) {
+		t.Errorf("got %q and %+v, want the function dropped", got, o)
+	}
+}
+
+func TestFitStack(t *testing.T) {
+	var o omissions
+	if got := o.fitStack(testStack, CountTokens(testStack)); got != testStack || len(o) != 0 {
+		t.Fatalf("the stack that fits was changed to\n%s\nwith %+v", got, o)
+	}
+
+	lines := strings.Split(testStack, "\n")
+	want := strings.Join(append(append([]string{lines[0]}, lines[5:9]...), "... 3 more frames omitted"), "\n") + "\n"
+	got := o.fitStack(testStack, CountTokens(want))
+	if got != want {
+		t.Errorf("got\n%s\nwant the frames from the panic on\n%s", got, want)
+	}
+	if len(o) != 1 || o[0].Section != report.SectionStack || o[0].Action != report.ActionTrimmed {
+		t.Errorf("omissions %+v", o)
+	}
+
+	o = nil
+	if got := o.fitStack(testStack, 5); got != "" || len(o) != 1 || o[0].Action != report.ActionDropped || o[0].Tokens != CountTokens(testStack) {
+		t.Errorf("got %q and %+v, want the stack dropped", got, o)
+	}
+}
+
+func TestFitText(t *testing.T) {
+	text := "Check the errors:\n```go\nif err != nil {\n\treturn err\n}\n```\nNever ignore them.\n"
+	var o omissions
+	if got := o.fitText(report.SectionGuidance, "project guidance", text, CountTokens(text)); got != text || len(o) != 0 {
+		t.Fatalf("the text that fits was changed to %q with %+v", got, o)
+	}
+
+	want := "Check the errors:\n```go\nif err != nil {\n...\n```\n"
+	if got := o.fitText(report.SectionGuidance, "project guidance", text, CountTokens(want)); got != want {
+		t.Errorf("got %q, want the leading lines with the code block closed %q", got, want)
+	}
+	if len(o) != 1 || o[0].Section != report.SectionGuidance || o[0].Name != "project guidance" || o[0].Action != report.ActionTrimmed {
+		t.Errorf("omissions %+v", o)
+	}
+
+	o = nil
+	if got := o.fitText(report.SectionHistory, "recent changes", text, 2); got != "" || len(o) != 1 || o[0].Action != report.ActionDropped {
+		t.Errorf("got %q and %+v, want the text dropped", got, o)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	rep := &report.Report{
+		Panic:          "runtime error: integer divide by zero",
+		Stack:          testStack,
+		LocalFunctions: []*parse.Function{testFunction("divide", 60, 40), testFunction("run", 60, 20), testFunction("main", 60, 20)},
+	}
+	tokens := func(messages []*bigmodel.Message) int {
+		var n int
+		for _, m := range messages {
+			n += CountTokens(m.Content)
+		}
+		return n
+	}
+
+	messages, omitted, err := NewBuilder(WithBudget(100000), WithGuidance("Wrap the errors.")).Build(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(omitted) != 0 || len(messages) != 2 || messages[0].Role != bigmodel.RoleSystem || messages[1].Role != bigmodel.RoleUser {
+		t.Fatalf("got %+v with the omissions %+v, want the system and user messages in full", messages, omitted)
+	}
+	if !strings.Contains(messages[0].Content, "Wrap the errors.") {
+		t.Errorf("the system message is %q, want the guidance", messages[0].Content)
+	}
+	user := messages[1].Content
+	for _, want := range []string{rep.Panic, testStack, rep.LocalFunctions[0].Source, rep.LocalFunctions[2].Source} {
+		if !strings.Contains(user, want) {
+			t.Errorf("the user message misses %q", want)
+		}
+	}
+	if strings.Contains(user, "Some content was trimmed") {
+		t.Error("the user message says that content was trimmed")
+	}
+
+	const budget = 1000
+	messages, omitted, err = NewBuilder(WithBudget(budget)).Build(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want no system message without guidance", len(messages))
+	}
+	if n := tokens(messages); n > budget {
+		t.Errorf("the prompt takes %d tokens, over the budget of %d", n, budget)
+	}
+	if len(omitted) == 0 || !strings.Contains(messages[0].Content, "Some content was trimmed") {
+		t.Errorf("got the omissions %+v, want the trimmed content reported", omitted)
+	}
+	if !strings.Contains(messages[0].Content, "step40 := compute(40)") {
+		t.Error("the failing line of the function closest to the panic was trimmed")
+	}
+}
+
+func TestBuildStructured(t *testing.T) {
+	messages, _, err := NewBuilder(WithStructured(), WithLanguage("ja")).Build(&report.Report{Panic: "boom", Stack: testStack})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := messages[len(messages)-1].Content
+	for _, want := range []string{"Reply with a single JSON object", `"culprit"`, "Write the text fields in Japanese"} {
+		if !strings.Contains(user, want) {
+			t.Errorf("the user message misses %q:\n%s", want, user)
+		}
+	}
+}
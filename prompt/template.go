@@ -0,0 +1,159 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package prompt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/ahaostudy/code-diagnostic/report"
+)
+
+// GuidanceFile the file of a repository guiding the diagnosis of its errors, see FindGuidance
+const GuidanceFile = "DIAGNOSTIC.md"
+
+// DefaultSystemTemplate the system message, no system message is sent if it renders empty
+const DefaultSystemTemplate = `{{if .Guidance}}Follow the guidance of the project when diagnosing its errors:
+
+{{.Guidance}}{{end}}`
+
+// DefaultUserTemplate the message asking for the diagnosis
+const DefaultUserTemplate = "The following error occurred in the current program: \n```\n{{.Panic}}\n```\n\n" +
+	"{{if .Classification}}The panic value is a {{.Classification}}.\n\n{{end}}" +
+	"{{if .Findings}}Local analysis of the failing code found the following, use them as hints:\n" +
+	"{{range .Findings}}- {{.File}}:{{.Line}}: {{.Message}}\n{{end}}\n{{end}}" +
+	"{{if .Similar}}Similar incidents were diagnosed before, use their resolutions if they apply:\n\n{{.Similar}}{{end}}" +
+	"Here is its call stack: \n```\n{{.Stack}}```\n\n" +
+	"{{if .History}}Here are the recent git changes of the code in the stack:\n{{.History}}\n{{end}}" +
+	"The source code list is as follows:\n{{.Sources}}\n" +
+	"{{if .Trimmed}}Some content was trimmed to fit the context window, ask for it if needed.\n\n{{end}}" +
+	"{{if .Structured}}Please help analyze the cause of the error and how to fix it. " +
+	"Reply with a single JSON object and nothing else, matching this JSON schema:\n```json\n{{.Schema}}\n```\n" +
+	"{{if .Language}}Write the text fields in {{.LanguageName}}.\n{{end}}" +
+	"{{else}}Please {{if .Language}}reply in {{.LanguageName}} to {{end}}help analyze the cause of the error and solve it!{{end}}"
+
+var (
+	defaultSystemTemplate = template.Must(template.New("system").Parse(DefaultSystemTemplate))
+	defaultUserTemplate   = template.Must(template.New("user").Parse(DefaultUserTemplate))
+)
+
+// Data what the templates are executed with, every field of the report is available.
+// Stack, History, Sources and Similar are the parts of the report fitted into the token budget,
+// the full ones are .Report.Stack, .Report.History, .Report.LocalFunctions and .Report.Similar.
+type Data struct {
+	*report.Report
+
+	Stack   string
+	History string
+	// Sources the source of the local functions grouped by file in code blocks
+	Sources string
+	// Similar the similar past incidents and their resolutions
+	Similar string
+	// Trimmed whether some content was trimmed or dropped to fit into the budget
+	Trimmed bool
+
+	// Language the BCP 47 tag of the language to reply in, empty for the default
+	Language     string
+	LanguageName string
+
+	// Structured whether the reply must be a JSON object matching Schema
+	Structured bool
+	Schema     string
+
+	// Guidance the guidance of the project, such as its DIAGNOSTIC.md
+	Guidance string
+}
+
+// languageTag a BCP 47 language tag, such as en, zh-Hans or pt-BR
+var languageTag = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// ValidLanguage report whether the tag is a well-formed BCP 47 language tag
+func ValidLanguage(tag string) bool {
+	return languageTag.MatchString(tag)
+}
+
+// languageNames the english names of common languages and scripts, the model is told the tag of the others
+var languageNames = map[string]string{
+	"ar":      "Arabic",
+	"de":      "German",
+	"en":      "English",
+	"es":      "Spanish",
+	"fr":      "French",
+	"hi":      "Hindi",
+	"id":      "Indonesian",
+	"it":      "Italian",
+	"ja":      "Japanese",
+	"ko":      "Korean",
+	"nl":      "Dutch",
+	"pl":      "Polish",
+	"pt":      "Portuguese",
+	"ru":      "Russian",
+	"sv":      "Swedish",
+	"th":      "Thai",
+	"tr":      "Turkish",
+	"uk":      "Ukrainian",
+	"vi":      "Vietnamese",
+	"zh":      "Chinese",
+	"zh-hans": "Simplified Chinese",
+	"zh-hant": "Traditional Chinese",
+}
+
+// LanguageName the name of the language of the tag to put in the prompt, such as "Portuguese (pt-BR)"
+func LanguageName(tag string) string {
+	if name, ok := languageNames[strings.ToLower(tag)]; ok {
+		return name
+	}
+	base := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+	if name, ok := languageNames[base]; ok {
+		return name + " (" + tag + ")"
+	}
+	return "the language of the BCP 47 tag " + tag
+}
+
+// FindGuidance read the GuidanceFile of the directory or of its closest parent,
+// up to the root of the repository, it is empty if there is none
+func FindGuidance(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		data, err := os.ReadFile(filepath.Join(dir, GuidanceFile))
+		if err == nil {
+			return string(data), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		// the guidance of the repository does not apply above it
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return "", nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,65 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package prompt
+
+import (
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+// pieceRegex pre-tokenization pattern modeled on the one used by the OpenAI BPE encoders
+var pieceRegex = regexp.MustCompile(`'(?:s|t|re|ve|m|ll|d)| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+`)
+
+// CountTokens estimate the number of tokens of the text offline.
+// It splits the text the same way BPE encoders do and then estimates the number of merges of each piece,
+// the result is deliberately a little pessimistic so that the budget is not exceeded.
+func CountTokens(text string) int {
+	var n int
+	for _, piece := range pieceRegex.FindAllString(text, -1) {
+		n += countPieceTokens(piece)
+	}
+	return n
+}
+
+func countPieceTokens(piece string) int {
+	r, _ := utf8.DecodeRuneInString(piece)
+	if r == ' ' && len(piece) > 1 {
+		// the leading space is merged into the word
+		piece = piece[1:]
+		r, _ = utf8.DecodeRuneInString(piece)
+	}
+	size := utf8.RuneCountInString(piece)
+	switch {
+	case unicode.IsSpace(r):
+		return 1
+	case unicode.IsNumber(r):
+		// numbers are split into groups of at most three digits
+		return (size + 2) / 3
+	case unicode.IsLetter(r):
+		if len(piece) != size {
+			// non-ascii text such as chinese rarely merges beyond a single rune
+			return size
+		}
+		return (size + 5) / 6
+	default:
+		return (size + 1) / 2
+	}
+}
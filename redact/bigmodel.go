@@ -0,0 +1,70 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redact
+
+import (
+	"context"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+)
+
+type redactedModel struct {
+	bigmodel.BigModel
+	redactor *Redactor
+}
+
+// Wrap redact every message before it is sent to the big model
+func (r *Redactor) Wrap(bm bigmodel.BigModel) bigmodel.BigModel {
+	return &redactedModel{BigModel: bm, redactor: r}
+}
+
+func (m *redactedModel) Chat(messages []*bigmodel.Message) chan bigmodel.Result {
+	return m.BigModel.Chat(m.redact(messages))
+}
+
+func (m *redactedModel) ChatContext(ctx context.Context, messages []*bigmodel.Message) chan bigmodel.Result {
+	return bigmodel.ChatContext(ctx, m.BigModel, m.redact(messages))
+}
+
+func (m *redactedModel) ChatTools(ctx context.Context, messages []*bigmodel.Message, tools []*bigmodel.Tool) chan bigmodel.Result {
+	return bigmodel.ChatTools(ctx, m.BigModel, m.redact(messages), tools)
+}
+
+func (m *redactedModel) redact(messages []*bigmodel.Message) []*bigmodel.Message {
+	redacted := make([]*bigmodel.Message, len(messages))
+	for i, msg := range messages {
+		cp := *msg
+		cp.Content = m.redactor.Redact(msg.Content)
+		redacted[i] = &cp
+	}
+	return redacted
+}
+
+func (m *redactedModel) ContextWindow() int {
+	return bigmodel.ContextWindow(m.BigModel)
+}
+
+func (m *redactedModel) Embed(ctx context.Context, texts []string) (*bigmodel.Embeddings, error) {
+	redacted := make([]string, len(texts))
+	for i, text := range texts {
+		redacted[i] = m.redactor.Redact(text)
+	}
+	return bigmodel.Embed(ctx, m.BigModel, redacted)
+}
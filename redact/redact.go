@@ -0,0 +1,199 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redact
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const placeholderPrefix = "[REDACTED:"
+
+// Rule a pattern of sensitive content, only the submatch Group is replaced if it is not 0
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Group   int
+	// MaxLen the longest text the pattern matches, DefaultMaxLen if 0, a Stream holds back as much of its end
+	MaxLen int
+	// Start the start of a match that is not complete yet, a Stream holds back the text from it,
+	// such as the header of a private key
+	Start *regexp.Regexp
+}
+
+// DefaultMaxLen the longest match of the rules that do not specify it
+const DefaultMaxLen = 256
+
+// Builtins the rules applied by default
+var Builtins = []*Rule{
+	{
+		Name:    "private_key",
+		Pattern: regexp.MustCompile(`-----BEGIN[A-Z ]*PRIVATE KEY-----[\s\S]*?-----END[A-Z ]*PRIVATE KEY-----`),
+		Start:   regexp.MustCompile(`-----BEGIN[A-Z ]*PRIVATE KEY-----`),
+	},
+	{Name: "bearer_token", Pattern: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{8,}=*)`), Group: 1},
+	{Name: "api_key", Pattern: regexp.MustCompile(`\b(?:sk-[A-Za-z0-9_\-]{20,}|AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|AIza[0-9A-Za-z\-_]{35}|xox[abprs]-[A-Za-z0-9\-]{10,})`)},
+	{Name: "api_key", Pattern: regexp.MustCompile(`(?i)\b(?:api[_-]?key|secret|access[_-]?token|auth[_-]?token)\b["']?\s*[:=]\s*["']?([^\s"',;]{8,})`), Group: 1},
+	{Name: "dsn_password", Pattern: regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.\-]*://[^:/\s@]+:([^\s/"']+)@`), Group: 1},
+	{Name: "dsn_password", Pattern: regexp.MustCompile(`\b[\w.\-]+:([^@\s/:]+)@(?:tcp|unix|udp)\(`), Group: 1},
+	{Name: "password", Pattern: regexp.MustCompile(`(?i)\b(?:password|passwd|pwd)\b["']?\s*[:=]\s*["']?([^\s"',;]+)`), Group: 1},
+	{Name: "email", Pattern: regexp.MustCompile(`\b[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}\b`)},
+}
+
+// Redactor replace sensitive content of text with placeholders and count what was replaced
+type Redactor struct {
+	rules []*Rule
+
+	mu      sync.Mutex
+	summary map[string]int
+}
+
+func New(opts ...Option) *Redactor {
+	r := &Redactor{
+		rules:   Builtins,
+		summary: make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+type Option func(*Redactor)
+
+// WithoutBuiltins do not apply the builtin rules
+func WithoutBuiltins() Option {
+	return func(r *Redactor) {
+		r.rules = nil
+	}
+}
+
+// WithRule add a rule
+func WithRule(rule *Rule) Option {
+	return func(r *Redactor) {
+		r.rules = append(r.rules[:len(r.rules):len(r.rules)], rule)
+	}
+}
+
+// WithRegexRule add a rule replacing every match of the pattern, it panics if the pattern is invalid
+func WithRegexRule(name, pattern string) Option {
+	return WithRule(&Rule{Name: name, Pattern: regexp.MustCompile(pattern)})
+}
+
+// WithLiteralRule add a rule replacing every occurrence of the literal text
+func WithLiteralRule(name, literal string) Option {
+	return WithRule(&Rule{Name: name, Pattern: regexp.MustCompile(regexp.QuoteMeta(literal)), MaxLen: len(literal)})
+}
+
+// Redact replace the sensitive content of the text
+func (r *Redactor) Redact(text string) string {
+	if r == nil {
+		return text
+	}
+	counts := make(map[string]int)
+	for _, rule := range r.rules {
+		text = rule.apply(text, counts)
+	}
+	if len(counts) > 0 {
+		r.mu.Lock()
+		for name, n := range counts {
+			r.summary[name] += n
+		}
+		r.mu.Unlock()
+	}
+	return text
+}
+
+func (rule *Rule) apply(text string, counts map[string]int) string {
+	matches := rule.Pattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text
+	}
+	placeholder := placeholderPrefix + rule.Name + "]"
+	var buf []byte
+	var last int
+	for _, m := range matches {
+		start, end := m[2*rule.Group], m[2*rule.Group+1]
+		if start < 0 || start < last || strings.HasPrefix(text[start:], placeholderPrefix) {
+			continue
+		}
+		buf = append(buf, text[last:start]...)
+		buf = append(buf, placeholder...)
+		last = end
+		counts[rule.Name]++
+	}
+	buf = append(buf, text[last:]...)
+	return string(buf)
+}
+
+// Since the replacements made since the summary was taken
+func (r *Redactor) Since(before []*Redaction) []*Redaction {
+	counts := make(map[string]int)
+	for _, s := range r.Summary() {
+		counts[s.Rule] += s.Count
+	}
+	for _, s := range before {
+		counts[s.Rule] -= s.Count
+	}
+	return sorted(counts)
+}
+
+// Merge add up the summaries
+func Merge(summaries ...[]*Redaction) []*Redaction {
+	counts := make(map[string]int)
+	for _, summary := range summaries {
+		for _, s := range summary {
+			counts[s.Rule] += s.Count
+		}
+	}
+	return sorted(counts)
+}
+
+// sorted the replacements of the counts sorted by rule name, without the rules of no replacement
+func sorted(counts map[string]int) []*Redaction {
+	var summary []*Redaction
+	for name, n := range counts {
+		if n > 0 {
+			summary = append(summary, &Redaction{Rule: name, Count: n})
+		}
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		return summary[i].Rule < summary[j].Rule
+	})
+	return summary
+}
+
+// Redaction the number of replacements of a rule
+type Redaction struct {
+	Rule  string `json:"rule"`
+	Count int    `json:"count"`
+}
+
+// Summary the replacements made so far, sorted by rule name
+func (r *Redactor) Summary() []*Redaction {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sorted(r.summary)
+}
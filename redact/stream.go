@@ -0,0 +1,101 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redact
+
+import "unicode/utf8"
+
+// Stream redact a text streamed in pieces, such as the answer of a big model,
+// a secret split across pieces is redacted as a whole because the end of the text is held back until it cannot be part of one
+type Stream struct {
+	r *Redactor
+	// hold how much of the end of the text is held back
+	hold    int
+	pending string
+}
+
+// Stream a stream redacted by the rules of the redactor, the text passes through unchanged if the redactor is nil
+func (r *Redactor) Stream() *Stream {
+	s := &Stream{r: r}
+	if r == nil {
+		return s
+	}
+	for _, rule := range r.rules {
+		n := rule.MaxLen
+		if n == 0 {
+			n = DefaultMaxLen
+		}
+		if n > s.hold {
+			s.hold = n
+		}
+	}
+	return s
+}
+
+// Write add the piece to the stream and return the redacted text that is safe to send, which may be empty
+func (s *Stream) Write(piece string) string {
+	s.pending += piece
+	cut := s.cut()
+	text := s.pending[:cut]
+	s.pending = s.pending[cut:]
+	return s.r.Redact(text)
+}
+
+// Flush return the redacted text held back, at the end of the stream
+func (s *Stream) Flush() string {
+	text := s.pending
+	s.pending = ""
+	return s.r.Redact(text)
+}
+
+// cut the end of the text that can be sent, it is before any match that may still grow with the next pieces
+func (s *Stream) cut() int {
+	text := s.pending
+	if s.r == nil {
+		return len(text)
+	}
+	cut := len(text) - s.hold
+	if cut <= 0 {
+		return 0
+	}
+	for _, rule := range s.r.rules {
+		// a match across the cut is sent as a whole later
+		for _, m := range rule.Pattern.FindAllStringIndex(text, -1) {
+			if m[0] < cut && cut < m[1] {
+				cut = m[0]
+			}
+		}
+		// so is a match that has started but not ended yet
+		if rule.Start != nil {
+			for _, m := range rule.Start.FindAllStringIndex(text, -1) {
+				if m[0] >= cut {
+					break
+				}
+				if loc := rule.Pattern.FindStringIndex(text[m[0]:]); loc == nil || loc[0] != 0 {
+					cut = m[0]
+					break
+				}
+			}
+		}
+	}
+	for cut > 0 && cut < len(text) && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return cut
+}
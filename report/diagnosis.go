@@ -0,0 +1,124 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+)
+
+// Diagnosis the structured answer of the big model
+type Diagnosis struct {
+	RootCause string `json:"root_cause"`
+	// Confidence how sure the big model is of the root cause, between 0 and 1
+	Confidence  float64   `json:"confidence"`
+	Culprit     *Location `json:"culprit"`
+	Explanation string    `json:"explanation"`
+	// Patch the suggested fix as a unified diff, empty if there is none
+	Patch string `json:"patch"`
+	// FollowUp what to check to confirm the root cause or the fix
+	FollowUp []string `json:"follow_up"`
+}
+
+// Location the code the root cause is in
+type Location struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Function string `json:"function"`
+}
+
+// DiagnosisSchema the JSON schema of Diagnosis, every field is required as structured output apis demand
+var DiagnosisSchema = &bigmodel.Schema{
+	Name: "diagnosis",
+	Schema: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"root_cause": map[string]interface{}{"type": "string", "description": "the root cause of the error in one sentence"},
+			"confidence": map[string]interface{}{"type": "number", "description": "how sure you are of the root cause, from 0 to 1"},
+			"culprit": map[string]interface{}{
+				"type":        "object",
+				"description": "the code the root cause is in",
+				"properties": map[string]interface{}{
+					"file":     map[string]interface{}{"type": "string"},
+					"line":     map[string]interface{}{"type": "integer"},
+					"function": map[string]interface{}{"type": "string"},
+				},
+				"required":             []string{"file", "line", "function"},
+				"additionalProperties": false,
+			},
+			"explanation": map[string]interface{}{"type": "string", "description": "why the error occurs, in markdown"},
+			"patch":       map[string]interface{}{"type": "string", "description": "the fix as a unified diff, empty if there is none"},
+			"follow_up": map[string]interface{}{
+				"type":        "array",
+				"description": "what to check to confirm the root cause or the fix",
+				"items":       map[string]interface{}{"type": "string"},
+			},
+		},
+		"required":             []string{"root_cause", "confidence", "culprit", "explanation", "patch", "follow_up"},
+		"additionalProperties": false,
+	},
+}
+
+// ParseDiagnosis parse the answer of the big model, the JSON object may be wrapped in a code block or text
+func ParseDiagnosis(answer string) (*Diagnosis, error) {
+	start, end := strings.Index(answer, "{"), strings.LastIndex(answer, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("the answer contains no JSON object")
+	}
+	d := new(Diagnosis)
+	if err := json.Unmarshal([]byte(answer[start:end+1]), d); err != nil {
+		return nil, fmt.Errorf("the answer is not valid JSON: %w", err)
+	}
+	switch {
+	case strings.TrimSpace(d.RootCause) == "":
+		return nil, errors.New("root_cause is missing")
+	case d.Confidence < 0 || d.Confidence > 1:
+		return nil, fmt.Errorf("confidence %v is not between 0 and 1", d.Confidence)
+	case d.Culprit == nil:
+		return nil, errors.New("culprit is missing")
+	}
+	return d, nil
+}
+
+// Markdown render the diagnosis for people
+func (d *Diagnosis) Markdown() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "**Root cause** (%.0f%% confident): %s\n\n", d.Confidence*100, d.RootCause)
+	if c := d.Culprit; c != nil && c.File != "" {
+		fmt.Fprintf(&buf, "**Culprit**: `%s` at %s:%d\n\n", c.Function, c.File, c.Line)
+	}
+	if d.Explanation != "" {
+		buf.WriteString(d.Explanation + "\n\n")
+	}
+	if d.Patch != "" {
+		buf.WriteString("**Suggested patch**:\n\n```diff\n" + strings.TrimSuffix(d.Patch, "\n") + "\n```\n\n")
+	}
+	if len(d.FollowUp) > 0 {
+		buf.WriteString("**Follow-up checks**:\n\n")
+		for _, check := range d.FollowUp {
+			buf.WriteString("- " + check + "\n")
+		}
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
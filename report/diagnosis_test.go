@@ -0,0 +1,83 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package report
+
+import (
+	"strings"
+	"testing"
+)
+
+const validDiagnosis = `{"root_cause":"the index is not checked","confidence":0.9,` +
+	`"culprit":{"file":"main.go","line":12,"function":"main.divide"},"explanation":"` + "`i`" + ` is 5.",` +
+	`"patch":"--- a/main.go\n+++ b/main.go\n","follow_up":["check the callers"]}`
+
+func TestParseDiagnosis(t *testing.T) {
+	tests := []struct {
+		name, answer, err string
+	}{
+		{name: "plain", answer: validDiagnosis},
+		{name: "fenced", answer: "```json\n" + validDiagnosis + "\n```"},
+		{name: "in text", answer: "Here is the diagnosis:\n" + validDiagnosis + "\nHope it helps {:"},
+		{name: "no object", answer: "The index is not checked.", err: "no JSON object"},
+		{name: "invalid", answer: `{"root_cause": "the index", }`, err: "not valid JSON"},
+		{name: "no root cause", answer: strings.Replace(validDiagnosis, "the index is not checked", " ", 1), err: "root_cause is missing"},
+		{name: "confidence over 1", answer: strings.Replace(validDiagnosis, "0.9", "90", 1), err: "confidence 90 is not between 0 and 1"},
+		{name: "negative confidence", answer: strings.Replace(validDiagnosis, "0.9", "-0.1", 1), err: "not between 0 and 1"},
+		{name: "no culprit", answer: `{"root_cause":"the index is not checked","confidence":0.9}`, err: "culprit is missing"},
+		{name: "null culprit", answer: strings.Replace(validDiagnosis, `{"file":"main.go","line":12,"function":"main.divide"}`, "null", 1), err: "culprit is missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := ParseDiagnosis(tt.answer)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %+v and the error %v, want %q", d, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.RootCause != "the index is not checked" || d.Confidence != 0.9 || d.Culprit.Line != 12 || len(d.FollowUp) != 1 {
+				t.Errorf("parsed %+v", d)
+			}
+		})
+	}
+}
+
+func TestDiagnosisMarkdown(t *testing.T) {
+	d, err := ParseDiagnosis(validDiagnosis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "**Root cause** (90% confident): the index is not checked\n\n" +
+		"**Culprit**: `main.divide` at main.go:12\n\n" +
+		"`i` is 5.\n\n" +
+		"**Suggested patch**:\n\n```diff\n--- a/main.go\n+++ b/main.go\n```\n\n" +
+		"**Follow-up checks**:\n\n- check the callers"
+	if got := d.Markdown(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	d = &Diagnosis{RootCause: "unknown", Confidence: 0.25, Culprit: &Location{}}
+	if got, want := d.Markdown(), "**Root cause** (25% confident): unknown"; got != want {
+		t.Errorf("got %q, want only the root cause %q", got, want)
+	}
+}
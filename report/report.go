@@ -0,0 +1,104 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package report
+
+import (
+	"time"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/classify"
+	"github.com/ahaostudy/code-diagnostic/heuristic"
+	"github.com/ahaostudy/code-diagnostic/history"
+	"github.com/ahaostudy/code-diagnostic/parse"
+	"github.com/ahaostudy/code-diagnostic/redact"
+)
+
+// Report everything collected about a single diagnosis
+type Report struct {
+	Panic          string            `json:"panic"`
+	Classification *classify.Panic   `json:"classification"`
+	Stack          string            `json:"stack"`
+	LocalFunctions []*parse.Function `json:"local_functions"`
+	Functions      []*parse.Function `json:"functions"`
+
+	// Findings deterministic explanations found by the local heuristics
+	Findings []*heuristic.Finding `json:"findings,omitempty"`
+
+	// History recent git changes of the local functions, nil if the source is not in a git repository
+	History *history.History `json:"history,omitempty"`
+
+	// Omitted content that was trimmed or dropped to fit the prompt into the model context window
+	Omitted []*Omission `json:"omitted,omitempty"`
+
+	// Redactions sensitive content replaced before anything left the process
+	Redactions []*redact.Redaction `json:"redactions,omitempty"`
+
+	// Usage tokens used by the big model for the diagnosis and their cost
+	Usage *bigmodel.Bill `json:"usage,omitempty"`
+
+	// Similar the past incidents most similar to this one, with their answers
+	Similar []*SimilarIncident `json:"similar,omitempty"`
+
+	// Diagnosis the structured answer of the big model, nil unless the structured output is asked for
+	// or if the answer could not be parsed
+	Diagnosis *Diagnosis `json:"diagnosis,omitempty"`
+
+	// Backend the backend that answered last, reported by routing big models such as route.Router
+	Backend string `json:"backend,omitempty"`
+}
+
+// Crash what the report knows locally of the crash, see bigmodel.WithCrash
+func (r *Report) Crash() *bigmodel.Crash {
+	crash := &bigmodel.Crash{Panic: r.Panic}
+	for _, f := range r.Findings {
+		crash.Hints = append(crash.Hints, &bigmodel.Hint{File: f.File, Line: f.Line, Message: f.Message})
+	}
+	return crash
+}
+
+// SimilarIncident a past incident resembling the current one
+type SimilarIncident struct {
+	Time   time.Time `json:"time"`
+	Panic  string    `json:"panic"`
+	Frames []string  `json:"frames"`
+	// Answer the final answer of the big model to the incident
+	Answer string `json:"answer"`
+	// Score the cosine similarity to the current incident, up to 1
+	Score float64 `json:"score"`
+}
+
+// Omission a piece of content that did not make it into the prompt in full
+type Omission struct {
+	Section string `json:"section"`
+	Name    string `json:"name"`
+	Action  string `json:"action"`
+	Tokens  int    `json:"tokens"`
+}
+
+const (
+	SectionStack    = "stack"
+	SectionFunction = "function"
+	SectionHistory  = "history"
+	SectionGuidance = "guidance"
+	SectionSimilar  = "similar"
+
+	ActionTrimmed = "trimmed"
+	ActionDropped = "dropped"
+)
@@ -0,0 +1,274 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/prompt"
+)
+
+// PrivateMarker the file marking a repository as private, in the working directory or any of its parents
+const PrivateMarker = ".diagnostic-private"
+
+// Backend a named big model of the router
+type Backend struct {
+	Name     string
+	BigModel bigmodel.BigModel
+}
+
+// Request what the rules of the router are matched against
+type Request struct {
+	Messages []*bigmodel.Message
+	// Tokens the approximate number of tokens of the messages
+	Tokens int
+}
+
+// Condition report whether a rule applies to the request
+type Condition func(req *Request) bool
+
+// Rule send the requests matching the condition to its backends only, tried in order
+type Rule struct {
+	Name     string
+	When     Condition
+	Backends []*Backend
+}
+
+// Router big model sending every request to the backends of the first matching rule,
+// or to the fallback backends, trying the next backend when one fails before answering
+type Router struct {
+	rules    []*Rule
+	fallback []*Backend
+}
+
+func New(opts ...Option) bigmodel.BigModel {
+	r := new(Router)
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+type Option func(*Router)
+
+// WithFallback add backends tried in order for the requests matching no rule
+func WithFallback(backends ...*Backend) Option {
+	return func(r *Router) {
+		r.fallback = append(r.fallback, backends...)
+	}
+}
+
+// WithRule add a rule, the rules are matched in the order they are added
+func WithRule(name string, when Condition, backends ...*Backend) Option {
+	return func(r *Router) {
+		r.rules = append(r.rules, &Rule{Name: name, When: when, Backends: backends})
+	}
+}
+
+// PromptOver match the requests over the number of tokens
+func PromptOver(tokens int) Condition {
+	return func(req *Request) bool {
+		return req.Tokens > tokens
+	}
+}
+
+// Private match every request if the directory or one of its parents holds the PrivateMarker file,
+// the working directory if dir is empty. The marker is looked up once.
+func Private(dir string) Condition {
+	var once sync.Once
+	var private bool
+	return func(*Request) bool {
+		once.Do(func() {
+			private = hasMarker(dir)
+		})
+		return private
+	}
+}
+
+func hasMarker(dir string) bool {
+	if dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return false
+		}
+		dir = wd
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, PrivateMarker)); err == nil {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+func (r *Router) Chat(messages []*bigmodel.Message) chan bigmodel.Result {
+	return r.ChatContext(context.Background(), messages)
+}
+
+func (r *Router) ChatContext(ctx context.Context, messages []*bigmodel.Message) chan bigmodel.Result {
+	return r.chat(ctx, messages, func(bm bigmodel.BigModel) chan bigmodel.Result {
+		return bigmodel.ChatContext(ctx, bm, messages)
+	})
+}
+
+func (r *Router) ChatTools(ctx context.Context, messages []*bigmodel.Message, tools []*bigmodel.Tool) chan bigmodel.Result {
+	return r.chat(ctx, messages, func(bm bigmodel.BigModel) chan bigmodel.Result {
+		return bigmodel.ChatTools(ctx, bm, messages, tools)
+	})
+}
+
+// ContextWindow the largest context window of the backends, so that a large prompt can reach
+// a large-context backend, the backends whose window is known to be too small are skipped
+// and the request fails if the prompt fits none of the backends of the matching rule
+func (r *Router) ContextWindow() int {
+	max := 0
+	for _, b := range r.backends() {
+		if w := bigmodel.ContextWindow(b.BigModel); w > max {
+			max = w
+		}
+	}
+	return max
+}
+
+// Check check every backend, so that the context windows of the local ones are known
+func (r *Router) Check(ctx context.Context) error {
+	var errs []error
+	for _, b := range r.backends() {
+		if err := bigmodel.Check(ctx, b.BigModel); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Embed embed the texts with the first backend providing embeddings, in the order of the rules then the fallback,
+// so that the vectors are always from the same model
+func (r *Router) Embed(ctx context.Context, texts []string) (*bigmodel.Embeddings, error) {
+	for _, b := range r.backends() {
+		e, err := bigmodel.Embed(ctx, b.BigModel, texts)
+		if !errors.Is(err, bigmodel.ErrNoEmbeddings) {
+			return e, err
+		}
+	}
+	return nil, bigmodel.ErrNoEmbeddings
+}
+
+func (r *Router) Fingerprint() string {
+	var buf strings.Builder
+	for _, b := range r.backends() {
+		fmt.Fprintf(&buf, "%s=%s\n", b.Name, bigmodel.Fingerprint(b.BigModel))
+	}
+	return buf.String()
+}
+
+func (r *Router) backends() []*Backend {
+	backends := r.fallback[:len(r.fallback):len(r.fallback)]
+	for _, rule := range r.rules {
+		backends = append(backends, rule.Backends...)
+	}
+	return backends
+}
+
+// chain the backends to try for the request, the ones whose context window is known to be too small are skipped
+func (r *Router) chain(messages []*bigmodel.Message) (string, []*Backend, error) {
+	req := &Request{Messages: messages}
+	for _, m := range messages {
+		req.Tokens += prompt.CountTokens(m.Content)
+	}
+
+	name, backends := "fallback", r.fallback
+	for _, rule := range r.rules {
+		if rule.When(req) {
+			name, backends = rule.Name, rule.Backends
+			break
+		}
+	}
+
+	if len(backends) == 0 {
+		return name, nil, fmt.Errorf("no big model to route the request to by rule %s", name)
+	}
+	var fit []*Backend
+	for _, b := range backends {
+		if w := bigmodel.ContextWindow(b.BigModel); w == 0 || w > req.Tokens {
+			fit = append(fit, b)
+		}
+	}
+	if len(fit) == 0 {
+		return name, nil, fmt.Errorf("the prompt of %d tokens does not fit the context window of any big model of rule %s", req.Tokens, name)
+	}
+	return name, fit, nil
+}
+
+func (r *Router) chat(ctx context.Context, messages []*bigmodel.Message, call func(bm bigmodel.BigModel) chan bigmodel.Result) chan bigmodel.Result {
+	out := make(chan bigmodel.Result)
+
+	go func() {
+		defer close(out)
+		rule, chain, err := r.chain(messages)
+		if err != nil {
+			bigmodel.Send(ctx, out, bigmodel.Result{Type: bigmodel.TypeError, Content: err.Error(), Err: err})
+			return
+		}
+		for i, b := range chain {
+			in := call(b.BigModel)
+			started, failed := false, false
+			for res := range in {
+				if !started {
+					// a backend failing before it answers is replaced by the next one
+					if res.Type == bigmodel.TypeError && i < len(chain)-1 {
+						log.Printf("big model %s of rule %s failed, falling back to %s: %s", b.Name, rule, chain[i+1].Name, res.Content)
+						failed = true
+						continue
+					}
+					started = true
+					if !bigmodel.Send(ctx, out, bigmodel.Result{Type: bigmodel.TypeRoute, Content: b.Name}) {
+						go bigmodel.Drain(in)
+						return
+					}
+				}
+				if !bigmodel.Send(ctx, out, res) {
+					go bigmodel.Drain(in)
+					return
+				}
+			}
+			if !failed || ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	return out
+}
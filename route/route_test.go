@@ -0,0 +1,223 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package route
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+)
+
+// fakeModel big model answering with its results and counting its calls
+type fakeModel struct {
+	results  []bigmodel.Result
+	window   int
+	checkErr error
+	calls    int
+	checked  bool
+}
+
+func (m *fakeModel) Chat(messages []*bigmodel.Message) chan bigmodel.Result {
+	m.calls++
+	out := make(chan bigmodel.Result, len(m.results))
+	for _, res := range m.results {
+		out <- res
+	}
+	close(out)
+	return out
+}
+
+func (m *fakeModel) ContextWindow() int { return m.window }
+
+func (m *fakeModel) Check(context.Context) error {
+	m.checked = true
+	return m.checkErr
+}
+
+func answer(content string) *fakeModel {
+	return &fakeModel{results: []bigmodel.Result{{Type: bigmodel.TypeData, Content: content}, {Type: bigmodel.TypeDone}}}
+}
+
+func failing(err error) *fakeModel {
+	return &fakeModel{results: []bigmodel.Result{{Type: bigmodel.TypeError, Content: err.Error(), Err: err}}}
+}
+
+// chat the content, the backend and the last result of the answer
+func chat(t *testing.T, bm bigmodel.BigModel, prompt string) (string, string, bigmodel.Result) {
+	t.Helper()
+	var content strings.Builder
+	var backend string
+	var last bigmodel.Result
+	for res := range bm.Chat(bigmodel.Messages(bigmodel.UserMessage(prompt))) {
+		switch res.Type {
+		case bigmodel.TypeData:
+			content.WriteString(res.Content)
+		case bigmodel.TypeRoute:
+			if content.Len() > 0 || backend != "" {
+				t.Errorf("the route %s was not sent first", res.Content)
+			}
+			backend = res.Content
+		}
+		last = res
+	}
+	return content.String(), backend, last
+}
+
+func TestFallBackBeforeData(t *testing.T) {
+	first, second := failing(errors.New("overloaded")), answer("ok")
+	r := New(WithFallback(&Backend{Name: "first", BigModel: first}, &Backend{Name: "second", BigModel: second}))
+
+	content, backend, last := chat(t, r, "hi")
+	if content != "ok" || backend != "second" || last.Type != bigmodel.TypeDone {
+		t.Fatalf("got %q from %q ending with %+v, want the answer of the second backend", content, backend, last)
+	}
+	if first.calls != 1 || second.calls != 1 {
+		t.Errorf("the backends were called %d and %d times", first.calls, second.calls)
+	}
+}
+
+func TestLastBackendFails(t *testing.T) {
+	overloaded := errors.New("overloaded")
+	r := New(WithFallback(&Backend{Name: "first", BigModel: failing(errors.New("down"))}, &Backend{Name: "second", BigModel: failing(overloaded)}))
+
+	_, backend, last := chat(t, r, "hi")
+	if backend != "second" || !errors.Is(last.Err, overloaded) {
+		t.Errorf("got %+v from %q, want the error of the last backend", last, backend)
+	}
+}
+
+func TestNoFallBackAfterData(t *testing.T) {
+	cut := errors.New("connection reset")
+	first := &fakeModel{results: []bigmodel.Result{{Type: bigmodel.TypeData, Content: "partial"}, {Type: bigmodel.TypeError, Content: cut.Error(), Err: cut}}}
+	second := answer("unused")
+	r := New(WithFallback(&Backend{Name: "first", BigModel: first}, &Backend{Name: "second", BigModel: second}))
+
+	content, backend, last := chat(t, r, "hi")
+	if content != "partial" || backend != "first" || !errors.Is(last.Err, cut) {
+		t.Fatalf("got %q from %q ending with %+v, want the error after the partial answer", content, backend, last)
+	}
+	if second.calls != 0 {
+		t.Error("the answer fell back after it had started")
+	}
+}
+
+func TestFirstMatchingRule(t *testing.T) {
+	small, large, private, fallback := answer("small"), answer("large"), answer("private"), answer("fallback")
+	r := New(
+		WithRule("large prompts", PromptOver(10), &Backend{Name: "large", BigModel: large}),
+		WithRule("short prompts", PromptOver(0), &Backend{Name: "small", BigModel: small}),
+		WithRule("private", func(*Request) bool { return true }, &Backend{Name: "private", BigModel: private}),
+		WithFallback(&Backend{Name: "fallback", BigModel: fallback}),
+	)
+
+	tests := []struct {
+		prompt, want string
+	}{
+		{prompt: strings.Repeat("word ", 20), want: "large"},
+		{prompt: "hi", want: "small"},
+		{prompt: "", want: "private"},
+	}
+	for _, tt := range tests {
+		if content, backend, _ := chat(t, r, tt.prompt); content != tt.want || backend != tt.want {
+			t.Errorf("the prompt %q was answered %q by %q, want %q", tt.prompt, content, backend, tt.want)
+		}
+	}
+	if fallback.calls != 0 {
+		t.Error("the fallback was called although a rule matched")
+	}
+}
+
+func TestSkipSmallContextWindow(t *testing.T) {
+	small := answer("small")
+	small.window = 5
+	r := New(WithFallback(&Backend{Name: "small", BigModel: small}, &Backend{Name: "large", BigModel: answer("large")}))
+
+	if _, backend, _ := chat(t, r, strings.Repeat("word ", 20)); backend != "large" || small.calls != 0 {
+		t.Errorf("answered by %q, want the backend whose context window takes the prompt", backend)
+	}
+	if _, backend, _ := chat(t, r, "hi"); backend != "small" {
+		t.Errorf("answered by %q, want the first backend", backend)
+	}
+}
+
+func TestNoBackendFits(t *testing.T) {
+	local, cloud := answer("local"), answer("cloud")
+	local.window, cloud.window = 5, 100000
+	r := New(
+		WithRule("private", func(*Request) bool { return true }, &Backend{Name: "local", BigModel: local}),
+		WithFallback(&Backend{Name: "cloud", BigModel: cloud}),
+	)
+	if w := bigmodel.ContextWindow(r); w != 100000 {
+		t.Errorf("context window is %d, want the largest of the backends", w)
+	}
+
+	_, backend, last := chat(t, r, strings.Repeat("word ", 20))
+	if last.Type != bigmodel.TypeError || !strings.Contains(last.Content, "rule private") || backend != "" {
+		t.Errorf("got %+v from %q, want an error naming the rule", last, backend)
+	}
+	if local.calls != 0 || cloud.calls != 0 {
+		t.Error("the prompt was sent although it fits no backend of the rule")
+	}
+}
+
+func TestEmptyChain(t *testing.T) {
+	r := New(WithRule("never", func(*Request) bool { return false }, &Backend{Name: "unused", BigModel: answer("unused")}))
+
+	_, _, last := chat(t, r, "hi")
+	if last.Type != bigmodel.TypeError || last.Err == nil || !strings.Contains(last.Content, "rule fallback") {
+		t.Errorf("got %+v, want the error of the empty chain", last)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	down := errors.New("connection refused")
+	local, cloud := &fakeModel{checkErr: down}, answer("cloud")
+	r := New(WithRule("private", Private(t.TempDir()), &Backend{Name: "local", BigModel: local}), WithFallback(&Backend{Name: "cloud", BigModel: cloud}))
+
+	err := bigmodel.Check(context.Background(), r)
+	if !errors.Is(err, down) || !strings.Contains(err.Error(), "local") {
+		t.Errorf("check error is %v, want the error of the local backend", err)
+	}
+	if !local.checked || !cloud.checked {
+		t.Error("not every backend was checked")
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "service", "internal")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if Private(dir)(nil) {
+		t.Fatal("matched without the marker")
+	}
+	if err := os.WriteFile(filepath.Join(root, PrivateMarker), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !Private(dir)(nil) {
+		t.Error("the marker of the parent directory was not found")
+	}
+}
@@ -0,0 +1,181 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sse implements the server-sent events stream format as specified by the HTML standard.
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Event a server-sent event
+type Event struct {
+	// ID the last event id, it persists across events until the stream sets a new one
+	ID string
+	// Event the event type, "message" if the stream did not set one
+	Event string
+	Data  string
+	// Retry the reconnection time in milliseconds the stream asked for, 0 if not set
+	Retry int
+}
+
+const DefaultEvent = "message"
+
+// Decoder read events from a stream
+type Decoder struct {
+	r      *bufio.Reader
+	lastID string
+	start  bool
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), start: true}
+}
+
+// Next read the next event, it returns io.EOF at the end of the stream, an incomplete last event is discarded
+func (d *Decoder) Next() (*Event, error) {
+	var data bytes.Buffer
+	var event string
+	var retry int
+	var hasData bool
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		// an empty line dispatches the event
+		if len(line) == 0 {
+			if !hasData {
+				event, retry = "", 0
+				continue
+			}
+			if event == "" {
+				event = DefaultEvent
+			}
+			return &Event{
+				ID:    d.lastID,
+				Event: event,
+				Data:  strings.TrimSuffix(data.String(), "\n"),
+				Retry: retry,
+			}, nil
+		}
+
+		// comment
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				d.lastID = value
+			}
+		case "retry":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 && strings.Trim(value, "0123456789") == "" {
+				retry = n
+			}
+		}
+	}
+}
+
+// readLine read a line ending with CRLF, LF or CR, without the line ending
+func (d *Decoder) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			// the last line without line ending is incomplete
+			return "", err
+		}
+		switch b {
+		case '\n':
+			return d.trimBOM(line), nil
+		case '\r':
+			if next, err := d.r.Peek(1); err == nil && next[0] == '\n' {
+				_, _ = d.r.ReadByte()
+			}
+			return d.trimBOM(line), nil
+		}
+		line = append(line, b)
+	}
+}
+
+// trimBOM remove the byte order mark at the start of the stream
+func (d *Decoder) trimBOM(line []byte) string {
+	if d.start {
+		d.start = false
+		line = bytes.TrimPrefix(line, []byte("\xEF\xBB\xBF"))
+	}
+	return string(line)
+}
+
+// Encoder write events to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode write the event, data with line breaks is split into several data fields,
+// the writer is flushed if it is an http.Flusher
+func (e *Encoder) Encode(ev *Event) error {
+	var buf bytes.Buffer
+	if ev.ID != "" {
+		buf.WriteString("id: " + sanitize(ev.ID) + "\n")
+	}
+	if ev.Event != "" && ev.Event != DefaultEvent {
+		buf.WriteString("event: " + sanitize(ev.Event) + "\n")
+	}
+	if ev.Retry > 0 {
+		buf.WriteString("retry: " + strconv.Itoa(ev.Retry) + "\n")
+	}
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(ev.Data)
+	for _, line := range strings.Split(data, "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+	if _, err := e.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if f, ok := e.w.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func sanitize(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
@@ -0,0 +1,136 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sse
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// splitReader return the stream in pieces cut at the offsets
+type splitReader struct {
+	data []byte
+	cuts []int
+}
+
+func (r *splitReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := len(r.data)
+	for len(r.cuts) > 0 {
+		cut := r.cuts[0]
+		r.cuts = r.cuts[1:]
+		if cut > 0 && cut < n {
+			n = cut
+			break
+		}
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// decodeAll the events of the stream and the error it ended with
+func decodeAll(r io.Reader) ([]*Event, error) {
+	dec := NewDecoder(r)
+	var events []*Event
+	for {
+		ev, err := dec.Next()
+		if err != nil {
+			return events, err
+		}
+		events = append(events, ev)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	stream := "\xEF\xBB\xBF: comment\r\n" +
+		"id: 1\r\n" +
+		"event: delta\r\n" +
+		"data: first\r\n" +
+		"data:  second\r\n\r\n" +
+		"data: cr\r\r" +
+		":\n" +
+		"retry: 300\n" +
+		"event: ignored\n\n" +
+		"id: 2\n" +
+		"data\n\n" +
+		"data: incomplete"
+	want := []*Event{
+		{ID: "1", Event: "delta", Data: "first\n second"},
+		{ID: "1", Event: DefaultEvent, Data: "cr"},
+		{ID: "2", Event: DefaultEvent, Data: ""},
+	}
+
+	events, err := decodeAll(strings.NewReader(stream))
+	if err != io.EOF {
+		t.Fatalf("the stream ended with %v, want io.EOF", err)
+	}
+	if !reflect.DeepEqual(events, want) {
+		for _, ev := range events {
+			t.Logf("%+v", ev)
+		}
+		t.Fatalf("got %d events, want %+v", len(events), want)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	want := &Event{ID: "7", Event: "tool", Data: "line 1\nline 2\n", Retry: 100}
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := NewDecoder(&buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func FuzzDecoder(f *testing.F) {
+	f.Add([]byte("data: a\n\n"), []byte{3})
+	f.Add([]byte("event: x\r\ndata: a\r\ndata: b\r\n\r\n: comment\r\ndata: c\r\n\r\n"), []byte{1, 5, 8, 17})
+	f.Add([]byte("data: a\r\rdata: b\r\r:\r\rdata: c\r"), []byte{7, 8, 9, 20})
+	f.Add([]byte("\xEF\xBB\xBFid: 1\ndata: a\r\n\rid\x00: 2\nretry: 10\ndata\n\n"), []byte{1, 2, 3})
+	f.Add([]byte(": only a comment\n\n:\r\n\r"), []byte{})
+	f.Fuzz(func(t *testing.T, stream []byte, cuts []byte) {
+		want, wantErr := decodeAll(bytes.NewReader(stream))
+		offsets := make([]int, len(cuts))
+		for i, cut := range cuts {
+			offsets[i] = int(cut)
+		}
+		got, gotErr := decodeAll(&splitReader{data: stream, cuts: offsets})
+		if gotErr != wantErr {
+			t.Fatalf("split stream ended with %v, want %v", gotErr, wantErr)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("split stream decoded %d events, want %d", len(got), len(want))
+		}
+	})
+}
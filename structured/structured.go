@@ -0,0 +1,81 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package structured
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/prompt"
+	"github.com/ahaostudy/code-diagnostic/report"
+)
+
+// Diagnose ask the big model for a diagnosis matching report.DiagnosisSchema, and once more to repair an invalid one.
+// The results other than the answer and its end are passed to forward, such as the usage and the tool calls.
+// If the answer is still invalid the diagnosis is nil, and the first answer is returned to be shown as it is.
+func Diagnose(ctx context.Context, bm bigmodel.BigModel, messages []*bigmodel.Message, forward func(bigmodel.Result)) (*report.Diagnosis, string, error) {
+	ctx = bigmodel.WithSchema(ctx, report.DiagnosisSchema)
+	answer, err := collect(ctx, bm, messages, forward)
+	if err != nil {
+		return nil, answer, err
+	}
+	d, perr := report.ParseDiagnosis(answer)
+	if perr == nil {
+		return d, answer, nil
+	}
+
+	log.Printf("invalid structured diagnosis, asking to repair it: %v", perr)
+	messages = append(messages[:len(messages):len(messages)],
+		bigmodel.AssistantMessage(answer),
+		bigmodel.UserMessage(prompt.Repair(perr)),
+	)
+	repaired, err := collect(ctx, bm, messages, forward)
+	if err != nil {
+		log.Printf("failed to repair the structured diagnosis: %v", err)
+		return nil, answer, nil
+	}
+	if d, perr = report.ParseDiagnosis(repaired); perr != nil {
+		log.Printf("invalid repaired structured diagnosis, falling back to the free-form answer: %v", perr)
+		return nil, answer, nil
+	}
+	return d, repaired, nil
+}
+
+// collect the answer of the big model
+func collect(ctx context.Context, bm bigmodel.BigModel, messages []*bigmodel.Message, forward func(bigmodel.Result)) (string, error) {
+	var answer strings.Builder
+	var err error
+	for ans := range bigmodel.ChatContext(ctx, bm, messages) {
+		switch ans.Type {
+		case bigmodel.TypeData:
+			answer.WriteString(ans.Content)
+		case bigmodel.TypeError:
+			err = ans.Err
+		case bigmodel.TypeDone:
+		default:
+			if forward != nil {
+				forward(ans)
+			}
+		}
+	}
+	return answer.String(), err
+}
@@ -0,0 +1,120 @@
+/**
+ * Copyright ahaostudy
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package structured_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/bigmodel/bigmodeltest"
+	"github.com/ahaostudy/code-diagnostic/report"
+	"github.com/ahaostudy/code-diagnostic/structured"
+)
+
+const validDiagnosis = `{"root_cause":"the index is not checked","confidence":0.9,` +
+	`"culprit":{"file":"main.go","line":12,"function":"main.divide"},"explanation":"","patch":"","follow_up":[]}`
+
+// diagnose the diagnosis by the server, the answer and the forwarded results
+func diagnose(t *testing.T, srv *bigmodeltest.Server) (*report.Diagnosis, string, []bigmodel.Result, error) {
+	t.Helper()
+	var forwarded []bigmodel.Result
+	d, answer, err := structured.Diagnose(context.Background(), srv.ChatGPT(), bigmodel.Messages(bigmodel.UserMessage("diagnose")),
+		func(res bigmodel.Result) {
+			forwarded = append(forwarded, res)
+		})
+	return d, answer, forwarded, err
+}
+
+func TestDiagnose(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Reply("```json\n", validDiagnosis, "\n```").WithUsage(100, 20))
+	defer srv.Close()
+
+	d, answer, forwarded, err := diagnose(t, srv)
+	if err != nil || d == nil || d.RootCause != "the index is not checked" {
+		t.Fatalf("got %+v and %v", d, err)
+	}
+	if answer != "```json\n"+validDiagnosis+"\n```" {
+		t.Errorf("answer is %q", answer)
+	}
+	if len(forwarded) != 1 || forwarded[0].Type != bigmodel.TypeUsage {
+		t.Errorf("forwarded %+v, want the usage", forwarded)
+	}
+	req := srv.AssertRequests(t, 1)[0]
+	if format, _ := req.Body["response_format"].(map[string]interface{}); format["type"] != "json_schema" {
+		t.Errorf("response_format is %v, want the diagnosis schema", req.Body["response_format"])
+	}
+}
+
+func TestDiagnoseRepaired(t *testing.T) {
+	srv := bigmodeltest.NewServer(
+		bigmodeltest.Reply(`{"root_cause":"the index is not checked","confidence":90}`).WithUsage(100, 20),
+		bigmodeltest.Reply(validDiagnosis).WithUsage(130, 40),
+	)
+	defer srv.Close()
+
+	d, answer, forwarded, err := diagnose(t, srv)
+	if err != nil || d == nil || d.Confidence != 0.9 || answer != validDiagnosis {
+		t.Fatalf("got %+v, %q and %v, want the repaired diagnosis", d, answer, err)
+	}
+	if len(forwarded) != 2 {
+		t.Errorf("forwarded %+v, want the usage of both answers", forwarded)
+	}
+	repair := srv.AssertRequests(t, 2)[1]
+	repair.AssertMessage(t, 1, bigmodel.RoleAssistant, `"confidence":90`)
+	repair.AssertMessage(t, 2, bigmodel.RoleUser, "confidence 90 is not between 0 and 1")
+}
+
+func TestDiagnoseInvalidRepair(t *testing.T) {
+	first := "The index `i` is not checked against the length of `values`."
+	srv := bigmodeltest.NewServer(bigmodeltest.Reply(first), bigmodeltest.Reply(`{"root_cause":"the index"}`))
+	defer srv.Close()
+
+	d, answer, _, err := diagnose(t, srv)
+	if err != nil || d != nil || answer != first {
+		t.Fatalf("got %+v, %q and %v, want the first answer without a diagnosis", d, answer, err)
+	}
+	srv.AssertRequests(t, 2)[1].AssertMessage(t, 2, bigmodel.RoleUser, "no JSON object")
+}
+
+func TestDiagnoseRepairFailed(t *testing.T) {
+	first := "not json"
+	srv := bigmodeltest.NewServer(bigmodeltest.Reply(first), bigmodeltest.Fail(http.StatusBadRequest, "context too long"))
+	defer srv.Close()
+
+	d, answer, _, err := diagnose(t, srv)
+	if err != nil || d != nil || answer != first {
+		t.Fatalf("got %+v, %q and %v, want the first answer without a diagnosis", d, answer, err)
+	}
+}
+
+func TestDiagnoseFailed(t *testing.T) {
+	srv := bigmodeltest.NewServer(bigmodeltest.Unauthorized())
+	defer srv.Close()
+
+	d, _, _, err := diagnose(t, srv)
+	var apiErr *bigmodel.APIError
+	if d != nil || !errors.As(err, &apiErr) {
+		t.Fatalf("got %+v and %v, want the api error", d, err)
+	}
+	srv.AssertRequests(t, 1)
+}
@@ -21,14 +21,28 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
+	"time"
 )
 
+// DefaultClient the client of requests without one set, unlike http.DefaultClient it stops waiting
+// for a server that accepted the connection but never responds, the streamed body is not limited
+var DefaultClient = newDefaultClient()
+
+func newDefaultClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 2 * time.Minute
+	return &http.Client{Transport: transport}
+}
+
 type Request struct {
 	url    string
 	header map[string]string
 	data   map[string]interface{}
+	client *http.Client
 }
 
 func NewRequest(url string) *Request {
@@ -39,20 +53,38 @@ func (r *Request) SetHeader(key, value string) {
 	if r.header == nil {
 		r.header = make(map[string]string)
 	}
-	r.header[key] = value
+	r.header[http.CanonicalHeaderKey(key)] = value
 }
 
 func (r *Request) SetData(data map[string]interface{}) {
 	r.data = data
 }
 
+// SetClient send the request with the client, DefaultClient if nil
+func (r *Request) SetClient(client *http.Client) {
+	r.client = client
+}
+
 func (r *Request) POST() (*http.Response, error) {
+	return r.POSTWithContext(context.Background())
+}
+
+// POSTWithContext send the request, it is aborted when the context is done
+func (r *Request) POSTWithContext(ctx context.Context) (*http.Response, error) {
 	data, err := json.Marshal(r.data)
 	if err != nil {
 		return nil, err
 	}
+	return r.do(ctx, "POST", bytes.NewBuffer(data))
+}
 
-	req, err := http.NewRequest("POST", r.url, bytes.NewBuffer(data))
+// GETWithContext send the request without body, it is aborted when the context is done
+func (r *Request) GETWithContext(ctx context.Context) (*http.Response, error) {
+	return r.do(ctx, "GET", nil)
+}
+
+func (r *Request) do(ctx context.Context, method string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, r.url, body)
 	if err != nil {
 		return nil, err
 	}
@@ -61,5 +93,9 @@ func (r *Request) POST() (*http.Response, error) {
 		req.Header.Set(k, v)
 	}
 
-	return new(http.Client).Do(req)
+	client := r.client
+	if client == nil {
+		client = DefaultClient
+	}
+	return client.Do(req)
 }
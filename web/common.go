@@ -21,8 +21,9 @@ package web
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
+
+	"github.com/ahaostudy/code-diagnostic/sse"
 )
 
 type JSON map[string]any
@@ -51,6 +52,5 @@ func Error(w http.ResponseWriter, err string) {
 }
 
 func Event(w http.ResponseWriter, event, data string) {
-	_, _ = fmt.Fprintf(w, "event:%s\ndata:%s\n\n", event, data)
-	w.(http.Flusher).Flush()
+	_ = sse.NewEncoder(w).Encode(&sse.Event{Event: event, Data: data})
 }
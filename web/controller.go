@@ -20,14 +20,19 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"path/filepath"
+	"strings"
 
 	"github.com/ahaostudy/code-diagnostic/bigmodel"
+	"github.com/ahaostudy/code-diagnostic/cache"
 	"github.com/ahaostudy/code-diagnostic/parse"
+	"github.com/ahaostudy/code-diagnostic/redact"
+	"github.com/ahaostudy/code-diagnostic/report"
 )
 
 func HTMLHandlerFunc(path string) http.HandlerFunc {
@@ -37,13 +42,51 @@ func HTMLHandlerFunc(path string) http.HandlerFunc {
 }
 
 func GetPanic(w http.ResponseWriter, r *http.Request) {
+	reportMu.RLock()
+	defer reportMu.RUnlock()
+	usage := usageJSON()
 	Success(w, JSON{
-		"panic":     config.Panic,
-		"stack":     config.Stack,
-		"functions": config.Functions,
+		"usage":          usage["usage"],
+		"process_usage":  usage["process_usage"],
+		"backend":        config.Report.Backend,
+		"panic":          config.Report.Panic,
+		"classification": config.Report.Classification,
+		"findings":       config.Report.Findings,
+		"stack":          config.Report.Stack,
+		"functions":      config.Report.Functions,
+		"omitted":        config.Report.Omitted,
+		"history":        config.Report.History,
+		"diagnosis":      config.Report.Diagnosis,
+		"similar":        config.Report.Similar,
+		"redactions":     config.Redactor.Summary(),
 	})
 }
 
+// GetFile serve the source files of the report
+func GetFile(w http.ResponseWriter, r *http.Request) {
+	file := "/" + strings.TrimPrefix(r.URL.Path, "/")
+	if !inReport(file) {
+		http.NotFound(w, r)
+		return
+	}
+	source, err := parse.ReadSourceFile(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, config.Redactor.Redact(string(source)))
+}
+
+func inReport(file string) bool {
+	for _, f := range append(config.Report.LocalFunctions[:len(config.Report.LocalFunctions):len(config.Report.LocalFunctions)], config.Report.Functions...) {
+		if f.File == file {
+			return true
+		}
+	}
+	return false
+}
+
 // GetFuncSource
 // TODO: unused
 func GetFuncSource(w http.ResponseWriter, r *http.Request) {
@@ -55,6 +98,7 @@ func GetFuncSource(w http.ResponseWriter, r *http.Request) {
 		Error(w, err.Error())
 		return
 	}
+	function.Source = config.Redactor.Redact(function.Source)
 	Success(w, JSON{
 		"function": function,
 	})
@@ -62,6 +106,8 @@ func GetFuncSource(w http.ResponseWriter, r *http.Request) {
 
 type ChatRequest struct {
 	Messages []*bigmodel.Message `json:"messages"`
+	// Regenerate ask the big model again instead of replaying a cached answer
+	Regenerate bool `json:"regenerate"`
 }
 
 func Chat(w http.ResponseWriter, r *http.Request) {
@@ -82,20 +128,103 @@ func Chat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	answer := ChatService(data.Messages)
-	for finish := false; !finish; {
-		ans := <-answer
+	ctx := r.Context()
+	if data.Regenerate {
+		ctx = cache.Bypass(ctx)
+	}
+	if config.Structured && len(data.Messages) == 0 {
+		diagnose(ctx, w)
+		return
+	}
+	var buf strings.Builder
+	stream := config.Redactor.Stream()
+	for ans := range ChatService(ctx, data.Messages) {
+		sendResult(w, stream, ans)
 		switch ans.Type {
 		case bigmodel.TypeData:
-			Event(w, "message", ans.Content)
+			buf.WriteString(ans.Content)
 		case bigmodel.TypeDone:
-			Event(w, "done", "")
-		case bigmodel.TypeError:
-			Event(w, "error", "chatgpt response error: "+ans.Content)
-		default:
-			Event(w, "error", "chatgpt response unknown type: "+fmt.Sprint(ans.Type))
+			if len(data.Messages) == 0 {
+				answered(buf.String())
+			}
+		}
+	}
+}
+
+// diagnose send the structured diagnosis as a diagnosis event, followed by its markdown as the answer,
+// or by the free-form answer if it could not be parsed
+func diagnose(ctx context.Context, w http.ResponseWriter) {
+	stream := config.Redactor.Stream()
+	d, answer, err := DiagnoseService(ctx, func(ans bigmodel.Result) {
+		sendResult(w, stream, ans)
+	})
+	if err != nil {
+		sendResult(w, stream, bigmodel.Result{Type: bigmodel.TypeError, Err: err})
+		return
+	}
+	if d != nil {
+		d = redactDiagnosis(d)
+		setDiagnosis(d)
+		diagnosis, _ := json.Marshal(d)
+		Event(w, "diagnosis", string(diagnosis))
+		answer = d.Markdown()
+	}
+	sendResult(w, stream, bigmodel.Result{Type: bigmodel.TypeData, Content: answer})
+	sendResult(w, stream, bigmodel.Result{Type: bigmodel.TypeDone})
+	answered(answer)
+}
+
+func redactDiagnosis(d *report.Diagnosis) *report.Diagnosis {
+	r := config.Redactor.Redact
+	cp := *d
+	cp.RootCause = r(d.RootCause)
+	cp.Explanation = r(d.Explanation)
+	cp.Patch = r(d.Patch)
+	if d.Culprit != nil {
+		culprit := *d.Culprit
+		culprit.File, culprit.Function = r(culprit.File), r(culprit.Function)
+		cp.Culprit = &culprit
+	}
+	cp.FollowUp = make([]string, len(d.FollowUp))
+	for i, check := range d.FollowUp {
+		cp.FollowUp[i] = r(check)
+	}
+	return &cp
+}
+
+// sendResult send the result of the big model as an event, the content is redacted by the stream of the answer
+func sendResult(w http.ResponseWriter, stream *redact.Stream, ans bigmodel.Result) {
+	if ans.Type != bigmodel.TypeData {
+		// the content held back by the stream comes before the other events, such as done
+		if text := stream.Flush(); text != "" {
+			Event(w, "message", text)
+		}
+	}
+	switch ans.Type {
+	case bigmodel.TypeData:
+		if text := stream.Write(ans.Content); text != "" {
+			Event(w, "message", text)
+		}
+	case bigmodel.TypeRoute:
+		setBackend(ans.Content)
+		Event(w, "backend", ans.Content)
+	case bigmodel.TypeToolCall:
+		for _, call := range ans.ToolCalls {
+			tool, _ := json.Marshal(JSON{
+				"name":      call.Name,
+				"arguments": config.Redactor.Redact(call.Arguments),
+				"output":    config.Redactor.Redact(ans.Content),
+			})
+			Event(w, "tool", string(tool))
 		}
-		finish = ans.Type != bigmodel.TypeData
+	case bigmodel.TypeUsage:
+		usage, _ := json.Marshal(setUsage())
+		Event(w, "usage", string(usage))
+	case bigmodel.TypeDone:
+		Event(w, "done", "")
+	case bigmodel.TypeError:
+		Event(w, "error", "big model response error: "+config.Redactor.Redact(fmt.Sprint(ans.Err)))
+	default:
+		Event(w, "error", "chatgpt response unknown type: "+fmt.Sprint(ans.Type))
 	}
-	close(answer)
 }
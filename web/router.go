@@ -28,7 +28,7 @@ func initRouter() {
 	http.Handle("/", HTMLHandlerFunc("index.html"))
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(filepath.Join(root, "static")))))
-	http.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir("/"))))
+	http.Handle("/files/", http.StripPrefix("/files/", http.HandlerFunc(GetFile)))
 
 	http.HandleFunc("/api/chat", Chat)
 	http.HandleFunc("/api/panic", GetPanic)
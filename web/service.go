@@ -20,20 +20,70 @@
 package web
 
 import (
+	"context"
+
 	"github.com/ahaostudy/code-diagnostic/bigmodel"
-	"github.com/ahaostudy/code-diagnostic/parse"
+	"github.com/ahaostudy/code-diagnostic/prompt"
+	"github.com/ahaostudy/code-diagnostic/report"
+	"github.com/ahaostudy/code-diagnostic/structured"
 )
 
-func ChatService(messages []*bigmodel.Message) chan bigmodel.Result {
-	var msg string
-	msg += "The following error occurred in the current program: \n```\n" + config.Panic + "\n```\n\n"
-	msg += "Here is its call stack: \n```\n" + config.Stack + "```\n\n"
-	msg += "The source code list is as follows:\n" + parse.BuildFuncListDescription(config.LocalFunctions) + "\n"
-	if config.UseChinese {
-		msg += "Please reply in Chinese to help analyze the cause of the error and solve it!"
-	} else {
-		msg += "Please help analyze the cause of the error and solve it!"
+func ChatService(ctx context.Context, messages []*bigmodel.Message) chan bigmodel.Result {
+	messages, err := chatMessages(messages)
+	if err != nil {
+		out := make(chan bigmodel.Result, 1)
+		out <- bigmodel.Result{Type: bigmodel.TypeError, Err: err}
+		close(out)
+		return out
+	}
+	return bigmodel.ChatContext(bigmodel.WithCrash(ctx, config.Report.Crash()), config.BigModel, messages)
+}
+
+// DiagnoseService ask for the structured diagnosis of the report, see structured.Diagnose
+func DiagnoseService(ctx context.Context, forward func(bigmodel.Result)) (*report.Diagnosis, string, error) {
+	messages, err := chatMessages(nil, prompt.WithStructured())
+	if err != nil {
+		return nil, "", err
+	}
+	return structured.Diagnose(bigmodel.WithCrash(ctx, config.Report.Crash()), config.BigModel, messages, forward)
+}
+
+// chatMessages the diagnosis prompt followed by the conversation so far
+func chatMessages(messages []*bigmodel.Message, opts ...prompt.Option) ([]*bigmodel.Message, error) {
+	// the conversation so far shares the budget with the diagnosis prompt, which keeps at least half of it
+	floor := config.TokenBudget / 2
+	messages = recentTurns(messages, config.TokenBudget-floor)
+	budget := config.TokenBudget
+	for _, m := range messages {
+		budget -= prompt.CountTokens(m.Content)
+	}
+	if budget < floor {
+		budget = floor
+	}
+	opts = append(append(config.PromptOptions[:len(config.PromptOptions):len(config.PromptOptions)], opts...), prompt.WithBudget(budget))
+	prompts, omitted, err := prompt.NewBuilder(opts...).Build(config.Report)
+	if err != nil {
+		return nil, err
+	}
+	setOmitted(omitted)
+	return append(prompts, messages...), nil
+}
+
+// recentTurns drop the oldest turns of the conversation until it fits into max tokens,
+// a turn starts with the role of the first message and the last message is always kept
+func recentTurns(messages []*bigmodel.Message, max int) []*bigmodel.Message {
+	var tokens int
+	for _, m := range messages {
+		tokens += prompt.CountTokens(m.Content)
+	}
+	for len(messages) > 1 && tokens > max {
+		role := messages[0].Role
+		tokens -= prompt.CountTokens(messages[0].Content)
+		messages = messages[1:]
+		for len(messages) > 1 && messages[0].Role != role {
+			tokens -= prompt.CountTokens(messages[0].Content)
+			messages = messages[1:]
+		}
 	}
-	messages = append(bigmodel.Messages(bigmodel.SystemMessage(msg)), messages...)
-	return config.BigModel.Chat(messages)
+	return messages
 }
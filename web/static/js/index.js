@@ -28,6 +28,11 @@ function initPanicDiv() {
         const panicTracebackElement = document.getElementById('panic-traceback')
         panicTitleElement.innerText = data['panic']
         document.title = data['panic']
+        initClassificationDiv(data['classification'])
+        initFindingsDiv(data['findings'])
+        initChangesDiv(data['history'])
+        initSimilarDiv(data['similar'])
+        updateUsage(data)
 
         const hoverElement = createElement('div', 'panic-traceback-hover')
         const hoverElementPre = createElement('pre', 'panic-traceback-hover-pre')
@@ -146,6 +151,150 @@ function initPanicDiv() {
     })
 }
 
+function initClassificationDiv(classification) {
+    if (!classification) return
+    const classificationElement = document.getElementById('panic-classification')
+    const fields = [
+        ['kind', classification['kind']],
+        ['type', classification['go_type']],
+        ['category', classification['category']],
+        ['index', classification['index']],
+        ['bounds', classification['bounds'] && `[${classification['bounds']}]`],
+        ['length', classification['length']],
+        ['capacity', classification['capacity']],
+        ['interface', classification['interface']],
+        ['expected', classification['expected']],
+        ['actual', classification['actual']],
+        ['missing method', classification['missing_method']],
+    ]
+    for (let [name, value] of fields) {
+        if (value === undefined || value === '') continue
+        const item = createElement('span', 'panic-classification-item')
+        const itemName = createElement('span', 'panic-classification-item-name')
+        const itemValue = createElement('span', 'panic-classification-item-value')
+        itemName.innerText = name
+        itemValue.innerText = String(value).replaceAll('_', ' ')
+        item.append(itemName, itemValue)
+        classificationElement.append(item)
+    }
+}
+
+function initFindingsDiv(findings) {
+    if (!findings) return
+    const findingsElement = document.getElementById('panic-findings')
+    for (let finding of findings) {
+        const item = createElement('div', 'panic-findings-item')
+        const itemMessage = createElement('div', 'panic-findings-item-message')
+        const itemFooter = createElement('div', 'panic-findings-item-footer')
+        itemMessage.innerHTML = marked.parseInline(escapeHTML(finding['message']))
+        itemFooter.innerText = `${finding['detector'].replaceAll('_', ' ')} · ${getBase(finding['file'])}:${finding['line']}`
+        item.append(itemMessage, itemFooter)
+        findingsElement.append(item)
+    }
+}
+
+function escapeHTML(str) {
+    const element = document.createElement('div')
+    element.innerText = str
+    return element.innerHTML
+}
+
+function initChangesDiv(history) {
+    if (!history) return
+    const changesElement = document.getElementById('panic-changes')
+    const titleElement = createElement('div', 'panic-changes-title')
+    titleElement.innerText = 'Recent changes'
+    changesElement.append(titleElement)
+
+    const commitText = (commit) => `${commit['hash']} ${commit['date']} ${commit['author']}: ${commit['subject']}`
+    for (let blame of history['blames'] || []) {
+        const item = createElement('div', 'panic-changes-item')
+        const itemHeader = createElement('div', 'panic-changes-item-header')
+        const itemCode = createElement('code', 'panic-changes-item-code')
+        const itemCommit = createElement('div', 'panic-changes-item-commit')
+        itemHeader.innerText = `${getBase(blame['file'])}:${blame['line']}`
+        itemCode.innerText = blame['code']
+        itemCommit.innerText = blame['modified'] ? 'Not committed yet' : commitText(blame['commit'])
+        item.append(itemHeader, itemCode, itemCommit)
+        changesElement.append(item)
+    }
+    for (let log of history['logs'] || []) {
+        const item = createElement('div', 'panic-changes-item')
+        const itemHeader = createElement('div', 'panic-changes-item-header')
+        itemHeader.innerText = getBase(log['function'])
+        item.append(itemHeader)
+        for (let commit of log['commits']) {
+            const itemCommit = createElement('div', 'panic-changes-item-commit')
+            itemCommit.innerText = commitText(commit)
+            item.append(itemCommit)
+        }
+        changesElement.append(item)
+    }
+    for (let diff of history['diffs'] || []) {
+        const item = createElement('div', 'panic-changes-item')
+        const itemHeader = createElement('div', 'panic-changes-item-header')
+        const itemPre = createElement('pre', 'panic-changes-item-diff')
+        const itemCode = createElement('code', 'language-diff')
+        itemHeader.innerText = `Uncommitted changes of ${getBase(diff['file'])}`
+        itemCode.textContent = diff['patch']
+        itemPre.append(itemCode)
+        item.append(itemHeader, itemPre)
+        changesElement.append(item)
+        highlightElement(itemCode, false, false)
+    }
+    if (history['truncated']) {
+        const item = createElement('div', 'panic-changes-item-commit')
+        item.innerText = 'The history was truncated.'
+        changesElement.append(item)
+    }
+}
+
+// initSimilarDiv show the past incidents similar to this one, with their answers folded
+function initSimilarDiv(similar) {
+    if (!similar) return
+    const similarElement = document.getElementById('panic-similar')
+    const titleElement = createElement('div', 'panic-similar-title')
+    titleElement.innerText = 'Similar incidents'
+    similarElement.append(titleElement)
+
+    for (let incident of similar) {
+        const item = createElement('div', 'panic-similar-item')
+        const itemHeader = createElement('div', 'panic-similar-item-header')
+        const itemPanic = createElement('code', 'panic-similar-item-panic')
+        const itemFrames = createElement('div', 'panic-similar-item-frames')
+        const itemAnswer = createElement('details', 'panic-similar-item-answer')
+        const itemSummary = document.createElement('summary')
+        const itemContent = createElement('div', 'panic-similar-item-content')
+        itemHeader.innerText = `${new Date(incident['time']).toLocaleString()} · ${Math.round(incident['score'] * 100)}% similar`
+        itemPanic.innerText = incident['panic']
+        itemFrames.innerText = (incident['frames'] || []).join('\n')
+        itemSummary.innerText = 'Resolution'
+        itemContent.innerHTML = marked.parse(incident['answer'])
+        itemAnswer.append(itemSummary, itemContent)
+        item.append(itemHeader, itemPanic, itemFrames, itemAnswer)
+        similarElement.append(item)
+    }
+}
+
+let usageData = {}
+
+// updateUsage show the backend answering and the tokens and cost of the diagnosis and of the process
+function updateUsage(data) {
+    usageData = {...usageData, ...data}
+    data = usageData
+    const usageElement = document.getElementById('usage')
+    const billText = (bill) => {
+        let text = `${bill['prompt_tokens']} prompt + ${bill['completion_tokens']} completion tokens · $${bill['cost'].toFixed(4)}`
+        if (bill['unpriced']) text += ` (no price of ${bill['unpriced'].join(', ')})`
+        return text
+    }
+    const items = []
+    if (data['backend']) items.push(`Answered by ${data['backend']}`)
+    if (data['usage']) items.push(`This diagnosis: ${billText(data['usage'])}`)
+    if (data['process_usage'] && data['process_usage']['usage'].length) items.push(`Process: ${billText(data['process_usage'])}`)
+    usageElement.innerText = items.join('  |  ')
+}
+
 function checkIn(event, element) {
     const x = Number(event.clientX)
     const y = Number(event.clientY)
@@ -229,7 +378,11 @@ function newMessageElement(role) {
     return messageElement
 }
 
-function sendMsg(message) {
+// sendMsg send the message and the conversation so far, regenerate asks the big model again
+// instead of replaying a cached answer
+function sendMsg(message, regenerate = false) {
+    // only the last answer can be regenerated
+    for (let button of messagesDiv.querySelectorAll('.message-regenerate')) button.remove()
     if (message) {
         const messageElement = newMessageElement('user')
         messageElement.innerHTML = marked.parse(message)
@@ -243,58 +396,71 @@ function sendMsg(message) {
             headers: {
                 'Content-Type': 'application/json',
             },
-            body: JSON.stringify({messages})
+            body: JSON.stringify({messages, regenerate})
         }
     ).then((response) => {
         const reader = response.body.getReader()
         const decoder = new TextDecoder('utf-8')
         const messageElement = newMessageElement('assistant')
+        // the tool calls served while answering are listed above the answer
+        let toolsElement = null
+        // the structured diagnosis is shown instead of its markdown, which is kept for the conversation
+        let structured = false
         let assistantMessage = ''
         let preHeight = messagesDiv.scrollHeight
 
-        function processStreamResult(result) {
-            const chunk = decoder.decode(result.value, {stream: !result.done})
-
-            // 解析chunk
-            chunk.split('event:').forEach((group) => {
-                group = group.slice(0, -2)
-                const msgs = group.split('\ndata:')
-
-                if (msgs.length < 2) {
-                    return
-                }
-
-                if (msgs[0] === 'error') {
-                    // TODO: onerror
-                    return
-                }
-                if (msgs[0] === 'done') {
-                    messages.push({role: 'assistant', content: assistantMessage})
-                    return
+        const parser = newEventParser((event, data) => {
+            if (event === 'error') {
+                // TODO: onerror
+                return
+            }
+            if (event === 'done') {
+                messages.push({role: 'assistant', content: assistantMessage})
+                messageElement.append(newRegenerateElement(messageElement, toolsElement))
+                return
+            }
+            if (event === 'usage') {
+                updateUsage(JSON.parse(data))
+                return
+            }
+            if (event === 'backend') {
+                updateUsage({backend: data})
+                return
+            }
+            if (event === 'diagnosis') {
+                structured = true
+                messageElement.append(newDiagnosisElement(JSON.parse(data)))
+                return
+            }
+            if (event === 'tool') {
+                if (!toolsElement) {
+                    toolsElement = createElement('div', 'message-tools')
+                    messagesDiv.insertBefore(toolsElement, messageElement)
                 }
+                toolsElement.append(newToolElement(JSON.parse(data)))
+                return
+            }
 
-                assistantMessage += msgs[1]
-                for (let i = 2; i < msgs.length; i++) {
-                    if (msgs[i] === '') assistantMessage += '\n'
-                }
-                messageElement.innerHTML = marked.parse(assistantMessage)
-                // hljs.highlightAll()
-                for (let children of messageElement.children) {
-                    if (children.localName !== 'pre') continue
-                    const codeElement = children.children[0]
-                    if (codeElement.localName !== 'code') continue
-                    highlightElement(codeElement)
-                }
-                if (messagesDiv.scrollHeight !== preHeight && messagesDiv.scrollTop >= messagesDiv.scrollHeight - messagesDiv.offsetHeight - 120) {
-                    messagesDiv.scrollTop = messagesDiv.scrollHeight - messagesDiv.offsetHeight
-                }
-                preHeight = messagesDiv.scrollHeight
-            })
+            assistantMessage += data
+            if (structured) return
+            messageElement.innerHTML = marked.parse(assistantMessage)
+            // hljs.highlightAll()
+            for (let children of messageElement.children) {
+                if (children.localName !== 'pre') continue
+                const codeElement = children.children[0]
+                if (codeElement.localName !== 'code') continue
+                highlightElement(codeElement)
+            }
+            if (messagesDiv.scrollHeight !== preHeight && messagesDiv.scrollTop >= messagesDiv.scrollHeight - messagesDiv.offsetHeight - 120) {
+                messagesDiv.scrollTop = messagesDiv.scrollHeight - messagesDiv.offsetHeight
+            }
+            preHeight = messagesDiv.scrollHeight
+        })
 
+        function processStreamResult(result) {
+            parser(decoder.decode(result.value, {stream: !result.done}))
             if (!result.done) {
                 reader.read().then(processStreamResult)
-            } else {
-                messages.push({role: 'assistant', content: assistantMessage})
             }
         }
 
@@ -302,6 +468,108 @@ function sendMsg(message) {
     })
 }
 
+// newRegenerateElement a button replacing the answer with a fresh one from the big model
+function newRegenerateElement(messageElement, toolsElement) {
+    const element = createElement('button', 'message-regenerate')
+    element.innerText = 'Regenerate'
+    element.title = 'Ask the big model again instead of replaying the cached answer'
+    element.onclick = () => {
+        messages.pop()
+        messageElement.remove()
+        if (toolsElement) toolsElement.remove()
+        sendMsg(undefined, true)
+    }
+    return element
+}
+
+// newDiagnosisElement the structured diagnosis, its culprit links to the source file
+function newDiagnosisElement(diagnosis) {
+    const element = createElement('div', 'diagnosis')
+    const header = createElement('div', 'diagnosis-header')
+    const rootCause = createElement('div', 'diagnosis-root-cause')
+    const confidence = createElement('div', 'diagnosis-confidence')
+    rootCause.innerHTML = marked.parseInline(escapeHTML(diagnosis['root_cause']))
+    confidence.innerText = `${Math.round(diagnosis['confidence'] * 100)}% confident`
+    header.append(rootCause, confidence)
+    element.append(header)
+
+    const culprit = diagnosis['culprit']
+    if (culprit && culprit['file']) {
+        const culpritElement = createElement('a', 'diagnosis-culprit')
+        culpritElement.href = '/files/' + culprit['file'].replace(/^\//, '')
+        culpritElement.innerText = `${culprit['function']} (${getBase(culprit['file'])}:${culprit['line']})`
+        element.append(culpritElement)
+    }
+    if (diagnosis['explanation']) {
+        const explanation = createElement('div', 'diagnosis-explanation')
+        explanation.innerHTML = marked.parse(diagnosis['explanation'])
+        element.append(explanation)
+    }
+    if (diagnosis['patch']) {
+        const pre = createElement('pre', 'diagnosis-patch')
+        const code = createElement('code', 'language-diff')
+        code.textContent = diagnosis['patch']
+        pre.append(code)
+        element.append(pre)
+        highlightElement(code, false, false)
+    }
+    if (diagnosis['follow_up'] && diagnosis['follow_up'].length) {
+        const title = createElement('div', 'diagnosis-title')
+        const list = createElement('ul', 'diagnosis-follow-up')
+        title.innerText = 'Follow-up checks'
+        for (let check of diagnosis['follow_up']) {
+            const item = document.createElement('li')
+            item.innerHTML = marked.parseInline(escapeHTML(check))
+            list.append(item)
+        }
+        element.append(title, list)
+    }
+    return element
+}
+
+// newToolElement a collapsed tool call showing its output when opened
+function newToolElement(tool) {
+    const element = createElement('details', 'message-tool')
+    const summary = createElement('summary', 'message-tool-summary')
+    const pre = createElement('pre', 'message-tool-output')
+    const code = createElement('code')
+    summary.innerText = `${tool['name']}(${tool['arguments']})`
+    code.innerText = tool['output']
+    pre.append(code)
+    element.append(summary, pre)
+    return element
+}
+
+// newEventParser parse a server-sent events stream fed in chunks and call onEvent for every event
+function newEventParser(onEvent) {
+    let buffer = ''
+    let event = ''
+    let data = []
+    return (chunk) => {
+        buffer += chunk
+        // a trailing \r may still be followed by \n in the next chunk
+        const tail = buffer.endsWith('\r') ? '\r' : ''
+        const lines = buffer.slice(0, buffer.length - tail.length).split(/\r\n|\r|\n/)
+        // the last line is incomplete
+        buffer = lines.pop() + tail
+        for (let line of lines) {
+            if (line === '') {
+                if (data.length) onEvent(event || 'message', data.join('\n'))
+                event = ''
+                data = []
+                continue
+            }
+            if (line.startsWith(':')) continue
+            const i = line.indexOf(':')
+            const field = i < 0 ? line : line.slice(0, i)
+            let value = i < 0 ? '' : line.slice(i + 1)
+            if (value.startsWith(' ')) value = value.slice(1)
+            if (field === 'event') event = value
+            else if (field === 'data') data.push(value)
+        }
+    }
+}
+
 function getBase(str) {
     let lis = str.split('/');
     if (lis.length === 0) {
@@ -20,42 +20,109 @@
 package web
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"path/filepath"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/ahaostudy/code-diagnostic/bigmodel"
-	"github.com/ahaostudy/code-diagnostic/parse"
+	"github.com/ahaostudy/code-diagnostic/prompt"
+	"github.com/ahaostudy/code-diagnostic/redact"
+	"github.com/ahaostudy/code-diagnostic/report"
 )
 
 type Config struct {
-	Panic          string
-	Stack          string
-	LocalFunctions []*parse.Function
-	Functions      []*parse.Function
+	Report *report.Report
 
-	BigModel   bigmodel.BigModel
-	UseChinese bool
+	BigModel bigmodel.BigModel
+	// Redactor applied to everything served, nil to serve the content as it is
+	Redactor    *redact.Redactor
+	TokenBudget int
+	// PromptOptions the options of the prompt besides the budget, such as its language
+	PromptOptions []prompt.Option
+
+	// Meter the token usage of the diagnosis, Prices convert it to cost
+	Meter  *bigmodel.Meter
+	Prices bigmodel.Prices
+
+	// Structured ask for the diagnosis matching report.DiagnosisSchema, the follow-up chat is free-form
+	Structured bool
+
+	// OnAnswer called with the answer of the diagnosis once it completes, not with the follow-up chat
+	OnAnswer func(answer string)
 }
 
+const shutdownTimeout = 5 * time.Second
+
 var (
 	config *Config
 	root   string
+
+	// reportMu guards the fields of the report updated while serving
+	reportMu sync.RWMutex
 )
 
 func InitConfig(conf *Config) {
 	config = conf
 }
 
+func answered(answer string) {
+	if config.OnAnswer != nil {
+		config.OnAnswer(answer)
+	}
+}
+
+func setOmitted(omitted []*report.Omission) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	config.Report.Omitted = omitted
+}
+
+func setBackend(backend string) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	config.Report.Backend = backend
+}
+
+func setDiagnosis(d *report.Diagnosis) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	config.Report.Diagnosis = d
+}
+
+// setUsage update the usage of the report, return the usage of the diagnosis and of the process
+func setUsage() JSON {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	config.Report.Usage = config.Prices.Bill(config.Meter.Usage())
+	return usageJSON()
+}
+
+func usageJSON() JSON {
+	return JSON{
+		"usage":         config.Report.Usage,
+		"process_usage": config.Prices.Bill(bigmodel.ProcessMeter.Usage()),
+	}
+}
+
 func init() {
 	_, file, _, _ := runtime.Caller(0)
 	root = filepath.Dir(file)
 }
 
 func Run(port int) error {
+	return RunContext(context.Background(), port)
+}
+
+// RunContext run the web service until the context is done,
+// the context is the parent of every request so that pending big model requests are aborted too
+func RunContext(ctx context.Context, port int) error {
 	initRouter()
 
 	logStr := fmt.Sprintf("Diagnostic service started:\n\nhttp://localhost:%d/", port)
@@ -66,7 +133,24 @@ func Run(port int) error {
 	logStr += "\n\nYou can enter the diagnostic service to view detailed error analysis."
 	log.Println(logStr)
 
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	server := &http.Server{
+		Addr: fmt.Sprintf(":%d", port),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
 func getLocalIP() (string, bool) {